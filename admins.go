@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// RoleOwner : Can do everything admins can, and manage the organization's admins. Each organization has
+	// exactly one owner
+	RoleOwner = "owner"
+	// RoleAdmin : Can manage members, rounds & settings
+	RoleAdmin = "admin"
+	// RoleViewer : Can only see members, rounds & pairs
+	RoleViewer = "viewer"
+)
+
+// roleRanks : Each role can do everything the roles ranked below it can
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleAdmin:  2,
+	RoleOwner:  3,
+}
+
+var (
+	// ErrAdminNotFound : The user isn't an admin of the organization
+	ErrAdminNotFound = errors.New("User is not an admin of this organization")
+	// ErrOwnerRole : The owner can't be removed or demoted except by transferring ownership
+	ErrOwnerRole = errors.New("The owner's role can only be changed by transferring ownership")
+	// ErrInvalidRole : Admins can only be invited as admins or viewers
+	ErrInvalidRole = errors.New("Role must be 'admin' or 'viewer'")
+)
+
+// OrganizationAdmin : A user who can access an organization, and what they can do in it
+type OrganizationAdmin struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// GetAdminsResponse :
+type GetAdminsResponse struct {
+	Admins []OrganizationAdmin `json:"admins"`
+}
+
+// AdminRequestBody : Body for inviting an admin or changing their role, and for transferring ownership (w/o
+// a role)
+type AdminRequestBody struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// hasRole : Whether 'role' allows doing what 'requiredRole' can
+func hasRole(role string, requiredRole string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[requiredRole]
+}
+
+// AdminsHandler : Combined HTTP handler for listing, inviting & removing an organization's admins
+func (app *App) AdminsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetAdminsHandler(w, r)
+	} else if r.Method == "POST" {
+		app.SetAdminHandler(w, r)
+	} else if r.Method == "DELETE" {
+		app.RemoveAdminHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET, POST and DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"AdminsHandler",
+		)
+	}
+}
+
+// GetAdminsHandler : HTTP handler for listing an organization's admins & their roles
+func (app *App) GetAdminsHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetAdminsHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
+	}
+
+	admins, err := app.Store.GetAdmins(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, GetAdminsResponse{Admins: admins}, http.StatusOK, function)
+}
+
+// SetAdminHandler : HTTP handler for inviting an admin or viewer, or changing an existing admin's role
+func (app *App) SetAdminHandler(w http.ResponseWriter, r *http.Request) {
+	function := "SetAdminHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleOwner, function) {
+		return
+	}
+
+	body, err := readAdminRequestBody(r)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if body.Role != RoleAdmin && body.Role != RoleViewer {
+		LogAndWriteStatusBadRequest(w, ErrInvalidRole, function)
+		return
+	}
+
+	err = app.Store.SetAdmin(orgname, body.Email, body.Role)
+	if err == ErrOwnerRole {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully saved the admin", http.StatusOK, function)
+}
+
+// RemoveAdminHandler : HTTP handler for revoking an admin's or viewer's access to an organization
+func (app *App) RemoveAdminHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RemoveAdminHandler"
+	if r.Method != "DELETE" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	values, err := getQueryParams(r, []string{"org", "email"})
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	orgname := values[0]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleOwner, function) {
+		return
+	}
+
+	err = app.Store.RemoveAdmin(orgname, values[1])
+	if err == ErrAdminNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return
+	}
+	if err == ErrOwnerRole {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully removed the admin", http.StatusOK, function)
+}
+
+// TransferOwnershipHandler : HTTP handler for handing an organization over to a new owner (e.g when organizers
+// rotate). The previous owner stays on as an admin
+func (app *App) TransferOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	function := "TransferOwnershipHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleOwner, function) {
+		return
+	}
+
+	body, err := readAdminRequestBody(r)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.TransferOwnership(orgname, body.Email)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully transferred ownership", http.StatusOK, function)
+}
+
+func readAdminRequestBody(r *http.Request) (AdminRequestBody, error) {
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return AdminRequestBody{}, errors.New("Malformed body.")
+	}
+	defer r.Body.Close()
+
+	var body AdminRequestBody
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		return AdminRequestBody{}, errors.New("Request body is malformed")
+	}
+
+	if body.Email == "" {
+		return AdminRequestBody{}, errors.New("Request body must contain 'email'")
+	}
+
+	return body, nil
+}
+
+// getRoleFromDB : The user's role in the organization, or "" if they have none
+func getRoleFromDB(db *sql.DB, orgname string, user string) (string, error) {
+	var role string
+	err := db.QueryRow(
+		"SELECT role FROM organization_admins WHERE organization = $1 AND email = $2",
+		orgname,
+		user,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// getAdminsFromDB : Admins of the organization, owner first
+func getAdminsFromDB(db *sql.DB, orgname string) ([]OrganizationAdmin, error) {
+	admins := []OrganizationAdmin{}
+
+	rows, err := db.Query(
+		`SELECT email, role FROM organization_admins WHERE organization = $1
+		ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, email`,
+		orgname,
+	)
+	if err != nil {
+		return admins, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var admin OrganizationAdmin
+		err := rows.Scan(&admin.Email, &admin.Role)
+		if err != nil {
+			return admins, err
+		}
+
+		admins = append(admins, admin)
+	}
+
+	return admins, nil
+}
+
+// setAdminInDB : Invite an admin or change their role; ErrOwnerRole if they're the owner
+func setAdminInDB(db *sql.DB, orgname string, email string, role string) error {
+	result, err := db.Exec(
+		`INSERT INTO organization_admins (organization, email, role) VALUES ($1, $2, $3)
+		ON CONFLICT (organization, email) DO UPDATE SET role = EXCLUDED.role
+		WHERE organization_admins.role <> 'owner'`,
+		orgname,
+		email,
+		role,
+	)
+	if err != nil {
+		return err
+	}
+
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrOwnerRole
+	}
+
+	return nil
+}
+
+// removeAdminFromDB : ErrAdminNotFound if they aren't an admin, or ErrOwnerRole if they're the owner
+func removeAdminFromDB(db *sql.DB, orgname string, email string) error {
+	role, err := getRoleFromDB(db, orgname, email)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrAdminNotFound
+	}
+	if role == RoleOwner {
+		return ErrOwnerRole
+	}
+
+	_, err = db.Exec(
+		"DELETE FROM organization_admins WHERE organization = $1 AND email = $2 AND role <> $3",
+		orgname,
+		email,
+		RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// transferOwnershipInDB : Make 'email' the owner, inviting them if needed, and demote the previous owner to admin
+func transferOwnershipInDB(db *sql.DB, orgname string, email string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// demote first, since there can only be one owner at a time
+	_, err = tx.Exec(
+		"UPDATE organization_admins SET role = $1 WHERE organization = $2 AND role = $3",
+		RoleAdmin,
+		orgname,
+		RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO organization_admins (organization, email, role) VALUES ($1, $2, $3)
+		ON CONFLICT (organization, email) DO UPDATE SET role = EXCLUDED.role`,
+		orgname,
+		email,
+		RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRoles(t *testing.T) {
+	t.Log("Test that viewers can only read, and that only the owner can manage admins & transfer ownership")
+
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, "test", "owner@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(handler http.HandlerFunc, method string, target string, body string, caller string) int {
+		w := httptest.NewRecorder()
+		handler(w, withCaller(httptest.NewRequest(method, target, strings.NewReader(body)), caller))
+		return w.Code
+	}
+
+	code := request(app.AdminsHandler, "POST", "/admins?org=test", `{"email": "viewer@gmail.com", "role": "viewer"}`, "owner@gmail.com")
+	if code >= http.StatusBadRequest {
+		t.Fatalf("Expected the owner to invite a viewer, got %d", code)
+	}
+
+	code = request(app.GetRoundsHandler, "GET", "/rounds?org=test", "", "viewer@gmail.com")
+	if code >= http.StatusBadRequest {
+		t.Errorf("Expected a viewer to see rounds, got %d", code)
+	}
+
+	code = request(app.AddRoundHandler, "POST", "/round?org=test&round=2019-01-02T18:30:00Z", "", "viewer@gmail.com")
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when a viewer schedules a round, got %d", http.StatusForbidden, code)
+	}
+
+	code = request(app.AdminsHandler, "POST", "/admins?org=test", `{"email": "viewer@gmail.com", "role": "admin"}`, "viewer@gmail.com")
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when a viewer promotes themselves, got %d", http.StatusForbidden, code)
+	}
+
+	code = request(app.AdminsHandler, "POST", "/admins?org=test", `{"email": "other@gmail.com", "role": "owner"}`, "owner@gmail.com")
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected %d when inviting another owner, got %d", http.StatusBadRequest, code)
+	}
+
+	code = request(app.TransferOwnershipHandler, "POST", "/admins/transfer?org=test", `{"email": "viewer@gmail.com"}`, "owner@gmail.com")
+	if code >= http.StatusBadRequest {
+		t.Fatalf("Expected the owner to transfer ownership, got %d", code)
+	}
+
+	code = request(app.AdminsHandler, "DELETE", "/admins?org=test&email=viewer@gmail.com", "", "owner@gmail.com")
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when the previous owner removes the new one, got %d", http.StatusForbidden, code)
+	}
+
+	admins, err := app.Store.GetAdmins("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OrganizationAdmin{{Email: "viewer@gmail.com", Role: RoleOwner}, {Email: "owner@gmail.com", Role: RoleAdmin}}
+	if len(admins) != len(expected) || admins[0] != expected[0] || admins[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, admins)
+	}
+
+	err = app.Store.RemoveAdmin("test", "viewer@gmail.com")
+	if err != ErrOwnerRole {
+		t.Errorf("Expected the owner to not be removable, got %v", err)
+	}
+}
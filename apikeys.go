@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// APIKeyPrefix : Every API key starts w/ this, so the auth middleware can tell them apart from JWTs
+	APIKeyPrefix = "mbk_"
+	// APIKeyBytes : No. of random bytes in an API key
+	APIKeyBytes = 32
+	// APIKeyDisplayLength : No. of characters of a key that are stored in plain text to identify it
+	APIKeyDisplayLength = len(APIKeyPrefix) + 8
+
+	// APIKeyScopeRead : Can see everything a viewer can
+	APIKeyScopeRead = "read"
+	// APIKeyScopeWrite : Can do everything an admin can, e.g sync rosters
+	APIKeyScopeWrite = "write"
+)
+
+// apiKeyRoles : The role each scope acts as. API keys can never act as the owner, so they can't manage access
+var apiKeyRoles = map[string]string{
+	APIKeyScopeRead:  RoleViewer,
+	APIKeyScopeWrite: RoleAdmin,
+}
+
+var (
+	// ErrAPIKeyNotFound : The key doesn't exist, or it has been revoked
+	ErrAPIKeyNotFound = errors.New("API key does not exist or has been revoked")
+	// ErrAPIKeyNotAllowed : Some things can only be done by people
+	ErrAPIKeyNotAllowed = errors.New("API keys are not allowed at this route")
+)
+
+// APIKey : A key for tools to access a single organization w/o logging in. The key itself is only returned
+// when it's created
+type APIKey struct {
+	ID           int    `json:"id"`
+	Organization string `json:"organization"`
+	Name         string `json:"name"`
+	Prefix       string `json:"prefix"`
+	Scope        string `json:"scope"`
+	CreatedBy    string `json:"createdBy"`
+	CreatedAt    string `json:"createdAt"`
+	LastUsedAt   string `json:"lastUsedAt,omitempty"`
+	RevokedAt    string `json:"revokedAt,omitempty"`
+}
+
+// CreateAPIKeyRequestBody :
+type CreateAPIKeyRequestBody struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// CreateAPIKeyResponse : The key can't be retrieved again, since only its hash is stored
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// GetAPIKeysResponse :
+type GetAPIKeysResponse struct {
+	APIKeys []APIKey `json:"apiKeys"`
+}
+
+type apiKeyContextKeyType string
+
+// apiKeyContextKey : Request context key for the API key a request was authenticated w/
+const apiKeyContextKey apiKeyContextKeyType = "apiKey"
+
+// APIKeysHandler : Combined HTTP handler for listing, creating and revoking API keys
+func (app *App) APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetAPIKeysHandler(w, r)
+	} else if r.Method == "POST" {
+		app.CreateAPIKeyHandler(w, r)
+	} else if r.Method == "DELETE" {
+		app.RevokeAPIKeyHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET, POST and DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"APIKeysHandler",
+		)
+	}
+}
+
+// GetAPIKeysHandler : HTTP handler for listing an organization's API keys, including revoked ones
+func (app *App) GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetAPIKeysHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !rejectAPIKey(w, r, function) || !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	apiKeys, err := app.Store.GetAPIKeys(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, GetAPIKeysResponse{APIKeys: apiKeys}, http.StatusOK, function)
+}
+
+// CreateAPIKeyHandler : HTTP handler for creating an API key. The response is the only time the key is shown
+func (app *App) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	function := "CreateAPIKeyHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !rejectAPIKey(w, r, function) || !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+	defer r.Body.Close()
+
+	var body CreateAPIKeyRequestBody
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	if body.Name == "" {
+		LogAndWriteStatusBadRequest(w, errors.New("API key name cannot be an empty string"), function)
+		return
+	}
+	if _, ok := apiKeyRoles[body.Scope]; !ok {
+		LogAndWriteStatusBadRequest(w, errors.New("API key scope must be 'read' or 'write'"), function)
+		return
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	caller, _ := getCaller(r)
+	apiKey, err := app.Store.CreateAPIKey(
+		APIKey{
+			Organization: orgname,
+			Name:         body.Name,
+			Prefix:       key[:APIKeyDisplayLength],
+			Scope:        body.Scope,
+			CreatedBy:    caller,
+		},
+		hashAPIKey(key),
+	)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, CreateAPIKeyResponse{APIKey: apiKey, Key: key}, http.StatusCreated, function)
+}
+
+// RevokeAPIKeyHandler : HTTP handler for revoking an API key. Revoked keys are kept so they still show up
+// when listing keys
+func (app *App) RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RevokeAPIKeyHandler"
+	if r.Method != "DELETE" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	values, err := getQueryParams(r, []string{"org", "id"})
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	orgname := values[0]
+
+	if !rejectAPIKey(w, r, function) || !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	apiKeyID, err := strconv.Atoi(values[1])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.RevokeAPIKey(orgname, apiKeyID)
+	if err == ErrAPIKeyNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully revoked API key", http.StatusOK, function)
+}
+
+// rejectAPIKey : Write a 403 if the request was authenticated w/ an API key, since keys can't manage keys.
+// Handlers return straight away when this is false
+func rejectAPIKey(w http.ResponseWriter, r *http.Request, function string) bool {
+	if _, ok := getAPIKey(r); ok {
+		LogAndWriteErr(w, ErrAPIKeyNotAllowed, http.StatusForbidden, function)
+		return false
+	}
+
+	return true
+}
+
+// getAPIKey : The API key the request was authenticated w/, if it wasn't authenticated w/ a JWT
+func getAPIKey(r *http.Request) (APIKey, bool) {
+	apiKey, ok := r.Context().Value(apiKeyContextKey).(APIKey)
+	return apiKey, ok
+}
+
+// isAPIKey : Whether a bearer token is an API key rather than a JWT
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func newAPIKey() (string, error) {
+	bytes := make([]byte, APIKeyBytes)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return APIKeyPrefix + hex.EncodeToString(bytes), nil
+}
+
+// hashAPIKey : Keys are long & random, so a plain SHA-256 is enough (unlike passwords)
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func getAPIKeysFromDB(db *sql.DB, orgname string) ([]APIKey, error) {
+	rows, err := db.Query(
+		`SELECT id, organization, name, prefix, scope, created_by, to_char(created_at, $1),
+		to_char(last_used_at, $1), to_char(revoked_at, $1)
+		FROM api_keys WHERE organization = $2 ORDER BY id ASC`,
+		TimestampFormat,
+		orgname,
+	)
+	if err != nil {
+		return []APIKey{}, err
+	}
+	defer rows.Close()
+
+	apiKeys := []APIKey{}
+	for rows.Next() {
+		apiKey, err := scanAPIKey(rows)
+		if err != nil {
+			return []APIKey{}, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	return apiKeys, nil
+}
+
+// getAPIKeyByHashFromDB : ErrAPIKeyNotFound if there's no such key, or it has been revoked
+func getAPIKeyByHashFromDB(db *sql.DB, keyHash string) (APIKey, error) {
+	rows, err := db.Query(
+		`SELECT id, organization, name, prefix, scope, created_by, to_char(created_at, $1),
+		to_char(last_used_at, $1), to_char(revoked_at, $1)
+		FROM api_keys WHERE key_hash = $2 AND revoked_at IS NULL`,
+		TimestampFormat,
+		keyHash,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	return scanAPIKey(rows)
+}
+
+func scanAPIKey(rows *sql.Rows) (APIKey, error) {
+	var apiKey APIKey
+	var lastUsedAt, revokedAt sql.NullString
+	err := rows.Scan(
+		&apiKey.ID,
+		&apiKey.Organization,
+		&apiKey.Name,
+		&apiKey.Prefix,
+		&apiKey.Scope,
+		&apiKey.CreatedBy,
+		&apiKey.CreatedAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	apiKey.LastUsedAt = lastUsedAt.String
+	apiKey.RevokedAt = revokedAt.String
+	return apiKey, nil
+}
+
+func createAPIKey(db *sql.DB, apiKey APIKey, keyHash string) (APIKey, error) {
+	err := db.QueryRow(
+		`INSERT INTO api_keys (organization, name, prefix, key_hash, scope, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now() AT TIME ZONE 'utc')
+		RETURNING id, to_char(created_at, $7)`,
+		apiKey.Organization,
+		apiKey.Name,
+		apiKey.Prefix,
+		keyHash,
+		apiKey.Scope,
+		apiKey.CreatedBy,
+		TimestampFormat,
+	).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return apiKey, nil
+}
+
+// touchAPIKey : Record that a key was used. It's only written once a minute, so busy keys don't turn every
+// request into a write
+func touchAPIKey(db *sql.DB, apiKeyID int) error {
+	_, err := db.Exec(
+		`UPDATE api_keys SET last_used_at = now() AT TIME ZONE 'utc'
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() AT TIME ZONE 'utc' - interval '1 minute')`,
+		apiKeyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func revokeAPIKey(db *sql.DB, orgname string, apiKeyID int) error {
+	result, err := db.Exec(
+		"UPDATE api_keys SET revoked_at = now() AT TIME ZONE 'utc' WHERE organization = $1 AND id = $2 AND revoked_at IS NULL",
+		orgname,
+		apiKeyID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
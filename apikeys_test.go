@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	t.Log("Test that API keys are only stored hashed, act within their organization & scope, and stop working once revoked")
+
+	app := &App{Store: NewMemoryStore()}
+	for _, orgname := range []string{"test", "other"} {
+		err := createOrganization(app.Store, orgname, "owner@gmail.com", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	app.APIKeysHandler(
+		w,
+		withCaller(httptest.NewRequest("POST", "/apikeys?org=test", strings.NewReader(`{"name": "sync", "scope": "read"}`)), "owner@gmail.com"),
+	)
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("Expected the key to be created, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var created CreateAPIKeyResponse
+	err := decodeData(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAPIKey(created.Key) || !strings.HasPrefix(created.Key, created.Prefix) {
+		t.Fatalf("Expected a key starting w/ %s & '%s', got %s", APIKeyPrefix, created.Prefix, created.Key)
+	}
+
+	apiKeys, err := app.Store.GetAPIKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apiKeys) != 1 || apiKeys[0].CreatedBy != "owner@gmail.com" || apiKeys[0].LastUsedAt != "" {
+		t.Fatalf("Expected 1 unused key created by the owner, got %v", apiKeys)
+	}
+
+	mw := &CustomJWTMiddleware{Store: app.Store}
+	request := func(handler http.HandlerFunc, method string, target string, body string, key string) (int, bool) {
+		reached := false
+		h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+			handler(w, r)
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		h.ServeHTTP(w, r)
+		return w.Code, reached
+	}
+
+	code, reached := request(app.GetRoundsHandler, "GET", "/rounds?org=test", "", created.Key)
+	if !reached || code >= http.StatusBadRequest {
+		t.Errorf("Expected a read key to see rounds, got %d", code)
+	}
+
+	code, _ = request(app.AddRoundHandler, "POST", "/round?org=test&round=2019-01-02T18:30:00Z", "", created.Key)
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when a read key schedules a round, got %d", http.StatusForbidden, code)
+	}
+
+	code, _ = request(app.GetRoundsHandler, "GET", "/rounds?org=other", "", created.Key)
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when a key is used for another organization, got %d", http.StatusForbidden, code)
+	}
+
+	code, _ = request(app.APIKeysHandler, "GET", "/apikeys?org=test", "", created.Key)
+	if code != http.StatusForbidden {
+		t.Errorf("Expected %d when a key lists keys, got %d", http.StatusForbidden, code)
+	}
+
+	apiKeys, err = app.Store.GetAPIKeys("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKeys[0].LastUsedAt == "" {
+		t.Errorf("Expected the key's last use to be recorded")
+	}
+
+	code, reached = request(app.GetRoundsHandler, "GET", "/rounds?org=test", "", created.Key+"0")
+	if reached || code != http.StatusUnauthorized {
+		t.Errorf("Expected %d for an unknown key, got %d", http.StatusUnauthorized, code)
+	}
+
+	w = httptest.NewRecorder()
+	app.APIKeysHandler(w, withCaller(httptest.NewRequest("DELETE", "/apikeys?org=test&id=1", nil), "owner@gmail.com"))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("Expected the key to be revoked, got %d: %s", w.Code, w.Body.String())
+	}
+
+	code, reached = request(app.GetRoundsHandler, "GET", "/rounds?org=test", "", created.Key)
+	if reached || code != http.StatusUnauthorized {
+		t.Errorf("Expected %d for a revoked key, got %d", http.StatusUnauthorized, code)
+	}
+
+	err = app.Store.RevokeAPIKey("test", 1)
+	if err != ErrAPIKeyNotFound {
+		t.Errorf("Expected %v when revoking a key twice, got %v", ErrAPIKeyNotFound, err)
+	}
+}
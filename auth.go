@@ -1,79 +1,319 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	// InvalidAccessToken : Message to show if invalid access is invalid
 	InvalidAccessToken = "Invalid access token"
-	// Issuer : Value of the 'iss' claim in a JSON Web Token https://jwt.io/introduction/
-	Issuer = "https://mealbot.auth0.com/"
-	// Audience : Value of the 'aud' claim in a JSON Web Token https://jwt.io/introduction/
-	Audience = "https://mealbot-2.herokuapp.com/"
-	// JSONWebKeySet : Location of keys containing public keys used for verifying any JSON Web Token issued by the authorization server https://auth0.com/docs/jwks
-	JSONWebKeySet = "https://mealbot.auth0.com/.well-known/jwks.json"
+	// DefaultIssuer : Value of the 'iss' claim in a JSON Web Token https://jwt.io/introduction/
+	DefaultIssuer = "https://mealbot.auth0.com/"
+	// DefaultAudience : Value of the 'aud' claim in a JSON Web Token https://jwt.io/introduction/
+	DefaultAudience = "https://mealbot-2.herokuapp.com/"
+	// DefaultJSONWebKeySet : Location of keys containing public keys used for verifying any JSON Web Token issued by the authorization server https://auth0.com/docs/jwks
+	DefaultJSONWebKeySet = "https://mealbot.auth0.com/.well-known/jwks.json"
+	// AuthRealm : Realm sent in the 'WWW-Authenticate' header
+	AuthRealm = "mealbot"
 )
 
+// AuthConfig : Which tokens are accepted, read from the environment by loadAuthConfig
+type AuthConfig struct {
+	Issuer       string
+	Audience     string
+	JWKSURL      string
+	JWKSCacheTTL time.Duration
+}
+
+var (
+	// ErrForbidden : The caller has no role in the organization they're trying to access
+	ErrForbidden = errors.New("You do not have access to this organization")
+	// ErrInvalidAudience : The token was issued for another API
+	ErrInvalidAudience = errors.New("Invalid audience")
+	// ErrInvalidIssuer : The token was issued by another authorization server
+	ErrInvalidIssuer = errors.New("Invalid issuer")
+)
+
+// AuthError : Why the auth middleware rejected a request, and how to respond
+type AuthError struct {
+	Status int
+	// Code : Error code for the 'WWW-Authenticate' header https://tools.ietf.org/html/rfc6750#section-3.1, or ""
+	// if the request had no credentials at all
+	Code string
+	Err  error
+}
+
+// Error :
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+// newUnauthorizedError : The credentials are missing (w/ no code) or invalid (w/ 'invalid_token'), so the client
+// should log in again
+func newUnauthorizedError(code string, err error) *AuthError {
+	return &AuthError{Status: http.StatusUnauthorized, Code: code, Err: err}
+}
+
+// newForbiddenError : The token is genuine, but isn't meant for this API
+func newForbiddenError(err error) *AuthError {
+	return &AuthError{Status: http.StatusForbidden, Code: "invalid_token", Err: err}
+}
+
+type contextKey string
+
+// callerContextKey : Request context key for the identity of the caller, as set by the auth middleware
+const callerContextKey contextKey = "caller"
+
 // CustomJWTMiddleware : HTTP Handler w/ authentication capabilities
 type CustomJWTMiddleware struct {
 	ValidationKeyGetter jwt.Keyfunc
 	SigningMethod       jwt.SigningMethod
+	// Audience : Namespace of custom claims
+	Audience string
+	// Store : Where API keys are looked up; if nil, only JWTs are accepted
+	Store Store
 }
 
-// Handler : Start HTTP server if JWT is valid; else return
+// Handler : Start HTTP server if JWT or API key is valid; else return. The caller identified by the token (or
+// the API key) is added to the request's context for handlers to authorize against
 func (mw *CustomJWTMiddleware) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := mw.CheckJWT(w, r)
+		if bearer, err := getBearerToken(r); err == nil && mw.Store != nil && isAPIKey(bearer) {
+			apiKey, err := mw.CheckAPIKey(bearer)
+			if err != nil {
+				writeAuthError(w, r, err)
+				return
+			}
+
+			h.ServeHTTP(w, withAPIKey(r, apiKey))
+			return
+		}
+
+		token, err := mw.CheckJWT(w, r)
 		if err != nil {
-			fmt.Println(err)
+			writeAuthError(w, r, err)
 			return
 		}
+
+		if token != nil {
+			caller, err := getCallerFromClaims(token.Claims, mw.Audience)
+			if err != nil {
+				writeAuthError(w, r, newUnauthorizedError("invalid_token", err))
+				return
+			}
+			r = withCaller(r, caller)
+		}
+
 		h.ServeHTTP(w, r)
 	})
 }
 
-// CheckJWT : Validate JWT sent to server
+// CheckJWT : Validate JWT sent to server; the token is nil for preflight requests. Errors are *AuthError
 func (mw *CustomJWTMiddleware) CheckJWT(
 	w http.ResponseWriter,
 	r *http.Request,
-) error {
+) (*jwt.Token, error) {
 	// preflight request
 	if r.Method == "OPTIONS" {
-		return nil
+		return nil, nil
+	}
+
+	token, err := getBearerToken(r)
+	if err != nil {
+		return nil, err
 	}
 
+	parsedToken, err := jwt.Parse(token, mw.ValidationKeyGetter)
+	if err != nil {
+		// errors from ValidationKeyGetter are wrapped by the parser
+		if validationErr, ok := err.(*jwt.ValidationError); ok {
+			if authErr, ok := validationErr.Inner.(*AuthError); ok {
+				return nil, authErr
+			}
+		}
+		return nil, newUnauthorizedError("invalid_token", err)
+	}
+
+	if !parsedToken.Valid {
+		return nil, newUnauthorizedError("invalid_token", errors.New("Token is invalid"))
+	}
+
+	if mw.SigningMethod.Alg() != parsedToken.Header["alg"] {
+		return nil, newUnauthorizedError("invalid_token", errors.New("Token must use 'alg' signing method"))
+	}
+
+	return parsedToken, nil
+}
+
+// CheckAPIKey : Look up the API key sent to server, and record that it was used
+func (mw *CustomJWTMiddleware) CheckAPIKey(key string) (APIKey, error) {
+	apiKey, err := mw.Store.GetAPIKeyByHash(hashAPIKey(key))
+	if err == ErrAPIKeyNotFound {
+		return APIKey{}, newUnauthorizedError("invalid_token", err)
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	// not worth failing the request over
+	err = mw.Store.TouchAPIKey(apiKey.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"logger":   "logrus",
+			"function": "CheckAPIKey",
+		}).Warn(err)
+	}
+
+	return apiKey, nil
+}
+
+// getBearerToken : The token from an 'Authorization: Bearer {token}' header. Errors are *AuthError
+func getBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return errors.New("No authorization header")
+		return "", newUnauthorizedError("", errors.New("No authorization header"))
 	}
 
 	authStr := strings.Split(authHeader, " ")
 	if len(authStr) != 2 || strings.ToLower(authStr[0]) != "bearer" {
-		return errors.New("Authorization header format must be Bearer {token}")
+		return "", newUnauthorizedError(
+			"invalid_request",
+			errors.New("Authorization header format must be Bearer {token}"),
+		)
 	}
 
-	token := authStr[1]
-	parsedToken, err := jwt.Parse(token, mw.ValidationKeyGetter)
-	if err != nil {
-		return err
+	return authStr[1], nil
+}
+
+// writeAuthError : Respond to a request that couldn't be authenticated. Only 401s & 403s get a
+// 'WWW-Authenticate' header, and anything other than an *AuthError is our fault, so it's a 500
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	authErr, ok := err.(*AuthError)
+	if !ok {
+		authErr = &AuthError{Status: http.StatusInternalServerError, Code: statusCodes[http.StatusInternalServerError], Err: err}
 	}
 
-	if !parsedToken.Valid {
-		return errors.New("Token is invalid")
+	log.WithFields(log.Fields{
+		"logger":   "logrus",
+		"status":   authErr.Status,
+		"function": "CustomJWTMiddleware",
+		"path":     r.URL.Path,
+	}).Warn(authErr.Err)
+
+	if authErr.Status == http.StatusUnauthorized || authErr.Status == http.StatusForbidden {
+		challenge := fmt.Sprintf("Bearer realm=\"%s\"", AuthRealm)
+		if authErr.Code != "" {
+			challenge += fmt.Sprintf(", error=\"%s\", error_description=\"%s\"",
+				authErr.Code,
+				strings.Replace(authErr.Error(), "\"", "'", -1),
+			)
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
 	}
 
-	if mw.SigningMethod.Alg() != parsedToken.Header["alg"] {
-		return errors.New("Token must use 'alg' signing method")
+	code := authErr.Code
+	if code == "" {
+		code = "unauthorized"
+	}
+
+	writeResponse(w, Response{Error: &ErrorResponse{Code: code, Message: authErr.Error()}}, authErr.Status)
+}
+
+// getCallerFromClaims : The caller is identified by their email, or by 'sub' if the token doesn't have one.
+// Auth0 only adds the email to access tokens as a custom claim, namespaced w/ the audience
+func getCallerFromClaims(tokenClaims jwt.Claims, audience string) (string, error) {
+	claims, ok := tokenClaims.(jwt.MapClaims)
+	if !ok {
+		return "", errors.New("Token claims are malformed")
+	}
+
+	for _, claim := range []string{"email", audience + "email", "sub"} {
+		if caller, ok := claims[claim].(string); ok && caller != "" {
+			return caller, nil
+		}
+	}
+
+	return "", errors.New("Token does not identify the caller")
+}
+
+// withCaller : Add the identity of the caller to the request's context
+func withCaller(r *http.Request, caller string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerContextKey, caller))
+}
+
+// withAPIKey : Add the API key the request was authenticated w/ to the request's context
+func withAPIKey(r *http.Request, apiKey APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, apiKey))
+}
+
+// getCaller : The identity of the caller, as set by the auth middleware
+func getCaller(r *http.Request) (string, bool) {
+	caller, ok := r.Context().Value(callerContextKey).(string)
+	return caller, ok && caller != ""
+}
+
+// authorizeOrganization : Check that the caller's role in the organization (or the API key's scope) allows what
+// 'requiredRole' can do, and write a 403 if not. Handlers return straight away when this is false
+func (app *App) authorizeOrganization(
+	w http.ResponseWriter,
+	r *http.Request,
+	orgname string,
+	requiredRole string,
+	function string,
+) bool {
+	if apiKey, ok := getAPIKey(r); ok {
+		if apiKey.Organization != orgname {
+			LogAndWriteErr(w, ErrForbidden, http.StatusForbidden, function)
+			return false
+		}
+		if !hasRole(apiKeyRoles[apiKey.Scope], requiredRole) {
+			LogAndWriteErr(
+				w,
+				fmt.Errorf("This requires the %s role, but the API key only has the %s scope", requiredRole, apiKey.Scope),
+				http.StatusForbidden,
+				function,
+			)
+			return false
+		}
+
+		return true
+	}
+
+	caller, ok := getCaller(r)
+	if !ok {
+		LogAndWriteErr(w, ErrForbidden, http.StatusForbidden, function)
+		return false
+	}
+
+	role, err := app.Store.GetRole(orgname, caller)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return false
+	}
+	if role == "" {
+		LogAndWriteErr(w, ErrForbidden, http.StatusForbidden, function)
+		return false
+	}
+	if !hasRole(role, requiredRole) {
+		LogAndWriteErr(
+			w,
+			fmt.Errorf("This requires the %s role, but you are a %s of this organization", requiredRole, role),
+			http.StatusForbidden,
+			function,
+		)
+		return false
 	}
 
-	return nil
+	return true
 }
 
 // Jwks :
@@ -96,73 +336,82 @@ func GetFakeAuthHandler(handler http.Handler) http.Handler {
 	return handler
 }
 
-// GetAuthHandler : Create handler w/ authentication logic for validating JWT sent to server
-func GetAuthHandler(handler http.Handler) http.Handler {
-	mw := &CustomJWTMiddleware{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			checkAud := verifyAudience(token.Claims, Audience)
-
-			if checkAud != nil {
-				return token, errors.New("Invalid audience")
-			}
-
-			checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(Issuer, true)
-			if !checkIss {
-				return token, errors.New("Invalid issuer")
-			}
-
-			cert, err := getPEMCertificate(token)
-			if err != nil {
-				return token, errors.New("PEM Certificate failed")
-			}
-
-			result, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cert))
-			if err != nil {
-				return token, errors.New("Failed to parse RSA public key from PEM certificate")
-			}
-
-			return result, nil
-		},
-
-		// When set, the middleware verifies that tokens are signed with the specific signing algorithm
-		// If the signing method is not constant the ValidationKeyGetter callback can be used to implement additional checks
-		// Important to avoid security issues described here: https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
-		SigningMethod: jwt.SigningMethodRS256,
+// loadAuthConfig : Tokens are issued by Auth0 unless AUTH_ISSUER, AUTH_AUDIENCE & AUTH_JWKS_URL point
+// somewhere else (AUTH_JWKS_URL defaults to the issuer's '.well-known/jwks.json'). AUTH_JWKS_CACHE_TTL
+// (e.g '1h') sets how long keys are cached for
+func loadAuthConfig() (AuthConfig, error) {
+	config := AuthConfig{
+		Issuer:       DefaultIssuer,
+		Audience:     DefaultAudience,
+		JWKSURL:      DefaultJSONWebKeySet,
+		JWKSCacheTTL: DefaultJWKSCacheTTL,
 	}
 
-	return mw.Handler(handler)
-}
-
-// https://support.quovadisglobal.com/kb/a37/what-is-pem-format.aspx
-func getPEMCertificate(token *jwt.Token) (string, error) {
-	cert := ""
-
-	resp, err := http.Get(JSONWebKeySet)
-	if err != nil {
-		return cert, err
+	if issuer := os.Getenv("AUTH_ISSUER"); issuer != "" {
+		config.Issuer = issuer
+		config.JWKSURL = strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json"
+	}
+	if audience := os.Getenv("AUTH_AUDIENCE"); audience != "" {
+		config.Audience = audience
+	}
+	if jwksURL := os.Getenv("AUTH_JWKS_URL"); jwksURL != "" {
+		config.JWKSURL = jwksURL
 	}
-	defer resp.Body.Close()
 
-	var jwks = Jwks{}
-	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	var err error
+	config.JWKSCacheTTL, err = getDurationEnv("AUTH_JWKS_CACHE_TTL", config.JWKSCacheTTL)
 	if err != nil {
-		return cert, err
+		return config, err
 	}
 
-	for k := range jwks.Keys {
-		if token.Header["kid"] == jwks.Keys[k].Kid {
-			cert = "-----BEGIN CERTIFICATE-----\n" +
-				jwks.Keys[k].X5c[0] +
-				"\n-----END CERTIFICATE-----"
+	return config, nil
+}
+
+// NewAuthHandler : Create middleware w/ authentication logic for validating JWT or API key sent to server. Every
+// handler it wraps shares one JWKSCache, so keys are only fetched once per TTL
+func NewAuthHandler(config AuthConfig, store Store) func(handler http.Handler) http.Handler {
+	keys := NewJWKSCache(config.JWKSURL, config.JWKSCacheTTL)
+
+	return func(handler http.Handler) http.Handler {
+		mw := &CustomJWTMiddleware{
+			ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
+				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+					return token, newUnauthorizedError("invalid_token", errors.New("Token must be signed w/ RSA"))
+				}
+
+				checkAud := verifyAudience(token.Claims, config.Audience)
+				if checkAud != nil {
+					return token, newForbiddenError(ErrInvalidAudience)
+				}
+
+				checkIss := token.Claims.(jwt.MapClaims).VerifyIssuer(config.Issuer, true)
+				if !checkIss {
+					return token, newForbiddenError(ErrInvalidIssuer)
+				}
+
+				kid, _ := token.Header["kid"].(string)
+				key, err := keys.GetKey(kid)
+				if err == ErrUnknownKey {
+					return token, newUnauthorizedError("invalid_token", err)
+				}
+				if err != nil {
+					// the identity provider is down, which isn't the client's fault
+					return token, &AuthError{Status: http.StatusServiceUnavailable, Code: "temporarily_unavailable", Err: err}
+				}
+
+				return key, nil
+			},
+
+			// When set, the middleware verifies that tokens are signed with the specific signing algorithm
+			// If the signing method is not constant the ValidationKeyGetter callback can be used to implement additional checks
+			// Important to avoid security issues described here: https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
+			SigningMethod: jwt.SigningMethodRS256,
+			Audience:      config.Audience,
+			Store:         store,
 		}
-	}
 
-	if cert == "" {
-		err := errors.New("Unable to find appropriate key")
-		return cert, err
+		return mw.Handler(handler)
 	}
-
-	return cert, nil
 }
 
 // https://github.com/dgrijalva/jwt-go/issues/290
@@ -174,6 +423,11 @@ func verifyAudience(tokenClaims jwt.Claims, audience string) error {
 		return errors.New("No audience claim")
 	}
 
+	// 'aud' is an array if the token is for several audiences, and a string otherwise
+	if claims["aud"] == audience {
+		return nil
+	}
+
 	claimsMap, _ := claims["aud"].([]interface{})
 	for _, item := range claimsMap {
 		if item == audience {
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestGetCallerFromClaims(t *testing.T) {
+	t.Log("Test that the caller is identified by their email if the token has one, and by 'sub' otherwise")
+
+	cases := []struct {
+		claims jwt.MapClaims
+		caller string
+	}{
+		{jwt.MapClaims{"email": "a@gmail.com", "sub": "auth0|1"}, "a@gmail.com"},
+		{jwt.MapClaims{DefaultAudience + "email": "b@gmail.com", "sub": "auth0|2"}, "b@gmail.com"},
+		{jwt.MapClaims{"email": "", "sub": "auth0|3"}, "auth0|3"},
+	}
+
+	for _, c := range cases {
+		caller, err := getCallerFromClaims(c.claims, DefaultAudience)
+		if err != nil {
+			t.Errorf("%v: %s", c.claims, err)
+			continue
+		}
+		if caller != c.caller {
+			t.Errorf("%v: expected %s, got %s", c.claims, c.caller, caller)
+		}
+	}
+
+	_, err := getCallerFromClaims(jwt.MapClaims{"aud": DefaultAudience}, DefaultAudience)
+	if err == nil {
+		t.Error("expected a token w/o any identity claims to be rejected")
+	}
+}
+
+func TestAuthMiddlewareErrors(t *testing.T) {
+	t.Log("Test that rejected tokens get a 401 or 403 w/ a JSON body & 'WWW-Authenticate' header, and valid ones reach the handler")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Jwks{Keys: []JSONWebKeys{newTestJWK("key", key)}})
+	}))
+	defer jwksServer.Close()
+
+	config := AuthConfig{
+		Issuer:       "https://issuer.test/",
+		Audience:     "https://api.test/",
+		JWKSURL:      jwksServer.URL,
+		JWKSCacheTTL: time.Hour,
+	}
+
+	var caller string
+	handler := NewAuthHandler(config, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ = getCaller(r)
+	}))
+
+	sign := func(signingKey *rsa.PrivateKey, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key"
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":   config.Issuer,
+			"aud":   []string{config.Audience, "https://issuer.test/userinfo"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"email": "a@gmail.com",
+		}
+		for claim, value := range changes {
+			claims[claim] = value
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name          string
+		authorization string
+		status        int
+		code          string
+	}{
+		{"no header", "", http.StatusUnauthorized, "unauthorized"},
+		{"not bearer", "Basic YTpi", http.StatusUnauthorized, "invalid_request"},
+		{"malformed", "Bearer abc", http.StatusUnauthorized, "invalid_token"},
+		{"expired", sign(key, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), http.StatusUnauthorized, "invalid_token"},
+		{"wrong key", sign(otherKey, claims(nil)), http.StatusUnauthorized, "invalid_token"},
+		{"no identity", sign(key, claims(jwt.MapClaims{"email": ""})), http.StatusUnauthorized, "invalid_token"},
+		{"wrong audience", sign(key, claims(jwt.MapClaims{"aud": "https://other.test/"})), http.StatusForbidden, "invalid_token"},
+		{"wrong issuer", sign(key, claims(jwt.MapClaims{"iss": "https://other.test/"})), http.StatusForbidden, "invalid_token"},
+	}
+
+	for _, c := range cases {
+		caller = ""
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orgs", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		handler.ServeHTTP(w, r)
+
+		if caller != "" {
+			t.Errorf("%s: expected the handler not to be reached", c.name)
+		}
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, w.Code)
+		}
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer realm=") {
+			t.Errorf("%s: expected a 'WWW-Authenticate' header, got '%s'", c.name, w.Header().Get("WWW-Authenticate"))
+		}
+
+		var body Response
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil || body.Error == nil || body.Error.Code != c.code || body.Error.Message == "" {
+			t.Errorf("%s: expected a JSON body w/ error '%s', got %s", c.name, c.code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/orgs", nil)
+	r.Header.Set("Authorization", sign(key, claims(nil)))
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || caller != "a@gmail.com" {
+		t.Errorf("Expected a valid token to reach the handler as a@gmail.com, got %d & '%s'", w.Code, caller)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ChatWebhookModeGroup : Post one chat message per group
+	ChatWebhookModeGroup = "group"
+	// ChatWebhookModeSummary : Post a single chat message listing every group in the round
+	ChatWebhookModeSummary = "summary"
+	// ChatWebhookTimeout : Max. time to wait for the chat server to accept a message
+	ChatWebhookTimeout = 10 * time.Second
+	// ChatSummaryIntro : Text to put in the beginning of a round summary message
+	ChatSummaryIntro = "Mealbot groups for this round:"
+	// ChatGroupIntro : Text to put in the beginning of a per-group message
+	ChatGroupIntro = "New Mealbot group:"
+)
+
+// ChatWebhook : An organization's outgoing chat webhook settings
+type ChatWebhook struct {
+	URL        string `json:"url"`
+	Mode       string `json:"mode"`
+	SendEmails bool   `json:"sendEmails"`
+}
+
+// ChatMessage : Slack/Mattermost-compatible incoming webhook payload
+type ChatMessage struct {
+	Text string `json:"text"`
+}
+
+var chatClient = &http.Client{Timeout: ChatWebhookTimeout}
+
+// ChatWebhookHandler : Combined HTTP handler for reading and configuring an organization's chat webhook
+func (app *App) ChatWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetChatWebhookHandler(w, r)
+	} else if r.Method == "POST" {
+		app.SetChatWebhookHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET and POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"ChatWebhookHandler",
+		)
+	}
+}
+
+// GetChatWebhookHandler : HTTP handler for retrieving an organization's chat webhook settings
+func (app *App) GetChatWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetChatWebhookHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	webhook, err := app.Store.GetChatWebhook(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, webhook, http.StatusOK, function)
+}
+
+// SetChatWebhookHandler : HTTP handler for configuring where (and whether) pairings are posted to chat
+func (app *App) SetChatWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	function := "SetChatWebhookHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(w, errors.New("Only POST requests are allowed at this route"), http.StatusMethodNotAllowed, function)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Malformed body."), http.StatusBadRequest, function)
+		return
+	}
+	defer r.Body.Close()
+
+	webhook := ChatWebhook{Mode: ChatWebhookModeSummary, SendEmails: true}
+	err = json.Unmarshal(bytes, &webhook)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	err = validateChatWebhook(webhook)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.SetChatWebhook(orgname, webhook)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully updated the chat webhook", http.StatusOK, function)
+}
+
+func validateChatWebhook(webhook ChatWebhook) error {
+	if webhook.Mode != ChatWebhookModeGroup && webhook.Mode != ChatWebhookModeSummary {
+		return fmt.Errorf("Mode must be either '%s' or '%s'", ChatWebhookModeGroup, ChatWebhookModeSummary)
+	}
+	if webhook.URL != "" && !strings.HasPrefix(webhook.URL, "http://") && !strings.HasPrefix(webhook.URL, "https://") {
+		return errors.New("Webhook URL must start with http:// or https://")
+	}
+	if webhook.URL == "" && !webhook.SendEmails {
+		return errors.New("Pairings must be sent by email, chat, or both")
+	}
+
+	return nil
+}
+
+// sendChatMessages : Post the round's groups to the organization's chat webhook
+func sendChatMessages(webhook ChatWebhook, round Round, members MembersMap) error {
+	groups := []string{}
+	for _, pair := range round.DrawOrderedPairs {
+		groups = append(groups, formatChatGroup(pair, members))
+	}
+
+	if webhook.Mode == ChatWebhookModeGroup {
+		for _, group := range groups {
+			err := postChatMessage(webhook.URL, fmt.Sprintf("%s %s", ChatGroupIntro, group))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if len(groups) == 0 {
+		return nil
+	}
+
+	sort.Strings(groups)
+	return postChatMessage(webhook.URL, ChatSummaryIntro+"\n• "+strings.Join(groups, "\n• "))
+}
+
+func formatChatGroup(pair Pair, members MembersMap) string {
+	names := []string{members[pair.ID1].Name, members[pair.ID2].Name}
+	if pair.ExtraID != "" {
+		names = append(names, members[pair.ExtraID].Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// postChatMessage : Send a single message to a Slack/Mattermost-compatible incoming webhook
+func postChatMessage(url string, text string) error {
+	body, err := json.Marshal(ChatMessage{Text: text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := chatClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Chat webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// getChatWebhook : Get an organization's chat webhook settings; organizations w/o a webhook only get emails
+func getChatWebhook(db *sql.DB, orgname string) (ChatWebhook, error) {
+	webhook := ChatWebhook{Mode: ChatWebhookModeSummary, SendEmails: true}
+
+	var url, mode sql.NullString
+	var sendEmails bool
+	err := db.QueryRow(
+		"SELECT chat_webhook_url, chat_webhook_mode, send_emails FROM organizations WHERE name = $1",
+		orgname,
+	).Scan(&url, &mode, &sendEmails)
+	if err == sql.ErrNoRows {
+		return webhook, nil
+	}
+	if err != nil {
+		return webhook, err
+	}
+
+	webhook.URL = url.String
+	if mode.Valid {
+		webhook.Mode = mode.String
+	}
+	webhook.SendEmails = sendEmails
+
+	return webhook, nil
+}
+
+func setChatWebhook(db *sql.DB, orgname string, webhook ChatWebhook) error {
+	var url sql.NullString
+	if webhook.URL != "" {
+		url = sql.NullString{String: webhook.URL, Valid: true}
+	}
+
+	_, err := db.Exec(
+		"UPDATE organizations SET chat_webhook_url = $1, chat_webhook_mode = $2, send_emails = $3 WHERE name = $4",
+		url,
+		webhook.Mode,
+		webhook.SendEmails,
+		orgname,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getMockChatServer(t *testing.T, messages *[]ChatMessage) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message ChatMessage
+		err := json.NewDecoder(r.Body).Decode(&message)
+		if err != nil {
+			t.Error(err)
+		}
+		*messages = append(*messages, message)
+	}))
+}
+
+func getMockRound() Round {
+	round := NewRound(0)
+	round.AddPair("a@gmail.com", "b@gmail.com")
+	round.AddPair("c@gmail.com", "d@gmail.com")
+	return round
+}
+
+func TestSendChatMessagesSummary(t *testing.T) {
+	t.Log("Test that summary mode posts every group in a single message")
+
+	messages := []ChatMessage{}
+	chatServer := getMockChatServer(t, &messages)
+	defer chatServer.Close()
+
+	members, err := getMockMembersMap(4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	webhook := ChatWebhook{URL: chatServer.URL, Mode: ChatWebhookModeSummary}
+	err = sendChatMessages(webhook, getMockRound(), members)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	for _, group := range []string{"Person A, Person B", "Person C, Person D"} {
+		if !strings.Contains(messages[0].Text, group) {
+			t.Errorf("summary %q is missing group %q", messages[0].Text, group)
+		}
+	}
+}
+
+func TestSendChatMessagesPerGroup(t *testing.T) {
+	t.Log("Test that group mode posts one message per group")
+
+	messages := []ChatMessage{}
+	chatServer := getMockChatServer(t, &messages)
+	defer chatServer.Close()
+
+	members, err := getMockMembersMap(4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	webhook := ChatWebhook{URL: chatServer.URL, Mode: ChatWebhookModeGroup}
+	err = sendChatMessages(webhook, getMockRound(), members)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+}
+
+func TestPostChatMessageError(t *testing.T) {
+	t.Log("Test that a non-2xx response from the chat server is reported")
+
+	chatServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer chatServer.Close()
+
+	err := postChatMessage(chatServer.URL, "hello")
+	if err == nil {
+		t.Error("expected an error when the chat server responds with 404")
+	}
+}
@@ -2,28 +2,119 @@ package main
 
 import (
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	// AccessControlAllowHeaders : https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Headers
 	AccessControlAllowHeaders = "Authorization, Content-Type, Origin, Accept, token"
-	// AccessControlAllowOrigin = "http://localhost:3000"
-	// AccessControlAllowOrigin  = "https://mealbot-web.herokuapp.com"
+	// AccessControlAllowMethods : https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Methods
+	AccessControlAllowMethods = "GET, POST, PUT, PATCH, DELETE"
+	// AccessControlExposeHeaders : Lets the frontend read why a request was rejected by the auth middleware
+	AccessControlExposeHeaders = "WWW-Authenticate"
+	// DefaultCorsAllowedOrigins : The production frontend & the frontend's dev server
+	DefaultCorsAllowedOrigins = "https://mealbot-web.herokuapp.com,http://localhost:3000"
+	// DefaultCorsMaxAge : How long browsers can cache the result of a preflight request
+	DefaultCorsMaxAge = 10 * time.Minute
 )
 
-// GetCorsHandler : Create handler that sets up CORS policy https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
-func GetCorsHandler(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// CorsConfig : Which sites can call the API from a browser, read from the environment by loadCorsConfig
+type CorsConfig struct {
+	// AllowedOrigins : e.g 'https://mealbot.example.com', or 'https://*.example.com' for any subdomain
+	AllowedOrigins []string
+	MaxAge         time.Duration
+}
+
+// loadCorsConfig : CORS_ALLOWED_ORIGINS is a comma-separated list of origins, and CORS_MAX_AGE (e.g '1h') sets
+// how long preflight requests are cached for
+func loadCorsConfig() (CorsConfig, error) {
+	allowedOrigins := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if allowedOrigins == "" {
+		allowedOrigins = DefaultCorsAllowedOrigins
+	}
+
+	config := CorsConfig{}
+	for _, origin := range strings.Split(allowedOrigins, ",") {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin != "" {
+			config.AllowedOrigins = append(config.AllowedOrigins, origin)
+		}
+	}
+
+	var err error
+	config.MaxAge, err = getDurationEnv("CORS_MAX_AGE", DefaultCorsMaxAge)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// isAllowed : Whether 'origin' is in the allow-list. A wildcard only matches subdomains, not the domain itself
+func (config CorsConfig) isAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	if origin == "" {
+		return false
+	}
+
+	for _, allowed := range config.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
 
-		// TODO: Get rid of temporary AccessControlAllowOrigin debugging setup
-		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Add("Access-Control-Allow-Headers", AccessControlAllowHeaders)
-		w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		wildcard := strings.Index(allowed, "*.")
+		if wildcard == -1 {
+			continue
+		}
 
-		if r.Method == "OPTIONS" {
-			return
+		prefix, suffix := allowed[:wildcard], allowed[wildcard+1:]
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+			if subdomain != "" && !strings.ContainsAny(subdomain, "/:@") {
+				return true
+			}
 		}
+	}
+
+	return false
+}
+
+// NewCorsHandler : Create middleware that sets up CORS policy https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS.
+// Only allowed origins get CORS headers, so browsers block every other site from calling the API w/ a user's
+// token. Preflight requests are answered here w/o reaching the handler
+func NewCorsHandler(config CorsConfig) func(handler http.Handler) http.Handler {
+	maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			allowed := config.isAllowed(origin)
+
+			// the response depends on the origin, so caches mustn't serve it to other sites
+			w.Header().Add("Vary", "Origin")
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", AccessControlExposeHeaders)
+			}
+
+			// preflight request
+			if r.Method == "OPTIONS" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				if allowed {
+					w.Header().Set("Access-Control-Allow-Methods", AccessControlAllowMethods)
+					w.Header().Set("Access-Control-Allow-Headers", AccessControlAllowHeaders)
+					w.Header().Set("Access-Control-Max-Age", maxAge)
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
 
-		handler.ServeHTTP(w, r)
-	})
+			handler.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCorsHandler(t *testing.T) {
+	t.Log("Test that only allowed origins (incl. wildcard subdomains) get CORS headers, and that preflight requests get a 204")
+
+	config := CorsConfig{
+		AllowedOrigins: []string{"http://localhost:3000", "https://*.example.com"},
+		MaxAge:         time.Hour,
+	}
+
+	reached := false
+	handler := NewCorsHandler(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://localhost:3000", true},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"http://app.example.com", false},
+		{"https://evil.com/.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"http://localhost:3001", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		reached = false
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/orgs", nil)
+		r.Header.Set("Origin", c.origin)
+		handler.ServeHTTP(w, r)
+
+		if !reached {
+			t.Errorf("%s: expected the handler to be reached", c.origin)
+		}
+		if allowOrigin := w.Header().Get("Access-Control-Allow-Origin"); (allowOrigin == c.origin && c.origin != "") != c.allowed {
+			t.Errorf("%s: expected allowed to be %v, got 'Access-Control-Allow-Origin: %s'", c.origin, c.allowed, allowOrigin)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: expected 'Vary: Origin', got '%s'", c.origin, w.Header().Get("Vary"))
+		}
+	}
+
+	reached = false
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("OPTIONS", "/members", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PATCH")
+	handler.ServeHTTP(w, r)
+
+	if reached {
+		t.Error("expected the preflight request not to reach the handler")
+	}
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected %d for a preflight request, got %d", http.StatusNoContent, w.Code)
+	}
+	if w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("expected 'Access-Control-Max-Age: 3600', got '%s'", w.Header().Get("Access-Control-Max-Age"))
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != AccessControlAllowMethods {
+		t.Errorf("expected the allowed methods, got '%s'", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
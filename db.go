@@ -1,12 +1,206 @@
 package main
 
-import "github.com/johnamadeo/server"
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	// registers the "postgres" driver
+	_ "github.com/lib/pq"
+)
 
 // DuplicateKeyErr : Error message when user tries to insert row with duplicate key
 const DuplicateKeyErr = "duplicate key value violates unique constraint"
 
-// LocalDBConnection :
-var LocalDBConnection = server.LocalDBConnection{
-	User:   "johnamadeodaniswara",
-	DBName: "mealbot",
+const (
+	// DBDriver :
+	DBDriver = "postgres"
+	// DefaultDBName : Database used for local development if PGDATABASE isn't set
+	DefaultDBName = "mealbot"
+	// DefaultDBMaxOpenConns : Heroku's hobby Postgres plans allow 20 connections, which are shared by the
+	// web & scheduler dynos
+	DefaultDBMaxOpenConns = 10
+	// DefaultDBMaxIdleConns :
+	DefaultDBMaxIdleConns = 5
+	// DefaultDBConnMaxLifetime : Connections are recycled so that failovers & restarts are picked up
+	DefaultDBConnMaxLifetime = 30 * time.Minute
+	// DefaultDBConnectTimeout : How long to wait for Postgres when opening a connection
+	DefaultDBConnectTimeout = 10 * time.Second
+)
+
+// DBConfig : Database connection settings, read from the environment by loadDBConfig
+type DBConfig struct {
+	DataSource      string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+}
+
+// App : Dependencies shared by the HTTP handlers
+type App struct {
+	DB *sql.DB
+	// Store : Organizations, members, rounds & pairs; backed by DB except in tests
+	Store Store
+	// Scheduler : Scheduler running inside the web server, if any
+	Scheduler *Scheduler
+}
+
+// loadDBConfig : DATABASE_URL (as set by Heroku) takes precedence. Otherwise the connection is built from
+// the standard Postgres variables PGHOST, PGPORT, PGUSER, PGPASSWORD, PGDATABASE & PGSSLMODE. The pool is
+// tuned w/ DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME & DB_CONNECT_TIMEOUT (e.g '30m', '5s')
+func loadDBConfig() (DBConfig, error) {
+	config := DBConfig{
+		MaxOpenConns:    DefaultDBMaxOpenConns,
+		MaxIdleConns:    DefaultDBMaxIdleConns,
+		ConnMaxLifetime: DefaultDBConnMaxLifetime,
+		ConnectTimeout:  DefaultDBConnectTimeout,
+	}
+
+	var err error
+	config.MaxOpenConns, err = getIntEnv("DB_MAX_OPEN_CONNS", config.MaxOpenConns)
+	if err != nil {
+		return config, err
+	}
+	config.MaxIdleConns, err = getIntEnv("DB_MAX_IDLE_CONNS", config.MaxIdleConns)
+	if err != nil {
+		return config, err
+	}
+	config.ConnMaxLifetime, err = getDurationEnv("DB_CONN_MAX_LIFETIME", config.ConnMaxLifetime)
+	if err != nil {
+		return config, err
+	}
+	config.ConnectTimeout, err = getDurationEnv("DB_CONNECT_TIMEOUT", config.ConnectTimeout)
+	if err != nil {
+		return config, err
+	}
+
+	if dbURL := os.Getenv("DATABASE_URL"); dbURL != "" {
+		config.DataSource, err = withConnectTimeout(dbURL, config.ConnectTimeout)
+		return config, err
+	}
+
+	params := map[string]string{
+		"host":     os.Getenv("PGHOST"),
+		"port":     os.Getenv("PGPORT"),
+		"user":     os.Getenv("PGUSER"),
+		"password": os.Getenv("PGPASSWORD"),
+		"dbname":   os.Getenv("PGDATABASE"),
+		"sslmode":  os.Getenv("PGSSLMODE"),
+	}
+	if params["dbname"] == "" {
+		params["dbname"] = DefaultDBName
+	}
+	if params["sslmode"] == "" {
+		params["sslmode"] = "disable"
+	}
+	params["connect_timeout"] = strconv.Itoa(timeoutSeconds(config.ConnectTimeout))
+
+	keywords := []string{}
+	for _, key := range []string{"host", "port", "user", "password", "dbname", "sslmode", "connect_timeout"} {
+		if params[key] != "" {
+			keywords = append(keywords, fmt.Sprintf("%s=%s", key, quoteDSNValue(params[key])))
+		}
+	}
+	config.DataSource = strings.Join(keywords, " ")
+
+	return config, nil
+}
+
+// openDB : Open the connection pool that's shared by the whole process, and check that Postgres is reachable
+func openDB(config DBConfig) (*sql.DB, error) {
+	db, err := sql.Open(DBDriver, config.DataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// openDBFromEnv : loadDBConfig & openDB
+func openDBFromEnv() (*sql.DB, error) {
+	config, err := loadDBConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return openDB(config)
+}
+
+// withConnectTimeout : Add connect_timeout to a postgres:// URL, unless it already sets one
+func withConnectTimeout(dbURL string, timeout time.Duration) (string, error) {
+	parsed, err := url.Parse(dbURL)
+	if err != nil {
+		return "", fmt.Errorf("DATABASE_URL is invalid: %s", err.Error())
+	}
+
+	query := parsed.Query()
+	if query.Get("connect_timeout") == "" {
+		query.Set("connect_timeout", strconv.Itoa(timeoutSeconds(timeout)))
+		parsed.RawQuery = query.Encode()
+	}
+
+	return parsed.String(), nil
+}
+
+// timeoutSeconds : connect_timeout is in whole seconds, and 0 means wait forever
+func timeoutSeconds(timeout time.Duration) int {
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// quoteDSNValue : Quote a value for a keyword/value connection string, so passwords w/ spaces or quotes work
+func quoteDSNValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+func getIntEnv(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return defaultValue, fmt.Errorf("%s must be a non-negative integer, got '%s'", key, value)
+	}
+
+	return number, nil
+}
+
+func getDurationEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return defaultValue, fmt.Errorf("%s must be a positive duration e.g '30s', got '%s'", key, value)
+	}
+
+	return duration, nil
 }
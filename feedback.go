@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FeedbackTokenBytes : No. of random bytes in a feedback token (hex-encoded to twice as many characters)
+	FeedbackTokenBytes = 16
+	// DefaultMealbotURL : Base URL used to build feedback links if MEALBOT_URL is not set
+	DefaultMealbotURL = "https://mealbot-2.herokuapp.com"
+	// MinRating : Lowest rating a group can give their meeting
+	MinRating = 1
+	// MaxRating : Highest rating a group can give their meeting
+	MaxRating = 5
+)
+
+// SubmitFeedbackRequestBody : Data structure for a group's feedback on their meeting
+type SubmitFeedbackRequestBody struct {
+	Met     *bool  `json:"met"`
+	Rating  *int   `json:"rating"`
+	Comment string `json:"comment"`
+}
+
+// FeedbackRoundStats : Data structure for how many groups in a round responded & met
+type FeedbackRoundStats struct {
+	Round          int     `json:"round"`
+	Groups         int     `json:"groups"`
+	Responses      int     `json:"responses"`
+	Met            int     `json:"met"`
+	CompletionRate float64 `json:"completionRate"`
+	AverageRating  float64 `json:"averageRating"`
+}
+
+// GetFeedbackStatsResponse : Data structure for storing feedback stats, separated by rounds
+type GetFeedbackStatsResponse struct {
+	Rounds []FeedbackRoundStats `json:"rounds"`
+}
+
+// SetAvoidMissedPairsRequestBody :
+type SetAvoidMissedPairsRequestBody struct {
+	Avoid bool `json:"avoid"`
+}
+
+// feedbackPageTemplate : What members see when they open a feedback link. Opening the link only shows the form,
+// since mail scanners open every link in an email; the answer is recorded once the form is submitted
+var feedbackPageTemplate = template.Must(template.New("feedback").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Mealbot</title>
+</head>
+<body>
+{{if .Message}}
+<p>{{.Message}}</p>
+{{else}}
+<h1>Did your group meet?</h1>
+<form method="POST" action="{{.Action}}">
+<p>
+<label><input type="radio" name="met" value="yes" required{{if eq .Met "yes"}} checked{{end}}> Yes, we met</label><br>
+<label><input type="radio" name="met" value="no"{{if eq .Met "no"}} checked{{end}}> No, we didn't</label>
+</p>
+<p>
+<label>How was it? (optional)
+<select name="rating">
+<option value=""></option>
+{{range .Ratings}}<option value="{{.}}">{{.}}</option>
+{{end}}</select>
+</label>
+</p>
+<p><label>Anything else? (optional)<br><textarea name="comment" rows="4" cols="40"></textarea></label></p>
+<button type="submit">Send</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// feedbackPage : Data for feedbackPageTemplate. The form is shown unless there's a message
+type feedbackPage struct {
+	Message string
+	Action  string
+	Met     string
+	Ratings []int
+}
+
+// FeedbackHandler : HTTP handler for groups to report whether they met. Authenticated by the token
+// in the feedback link rather than a JWT, so that members can respond straight from their email. A GET (i.e
+// opening the link) shows a form that POSTs the answer back; API clients can also POST JSON directly
+func (app *App) FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	function := "FeedbackHandler"
+	if r.Method != "GET" && r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET and POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	// people get a page back, while API clients get JSON
+	isForm := r.Method == "GET" || isFormRequest(r)
+	fail := func(err error, status int) {
+		if isForm {
+			LogAndWriteFeedbackPage(w, feedbackPage{Message: err.Error()}, status, function)
+		} else {
+			LogAndWriteErr(w, err, status, function)
+		}
+	}
+	// the details are logged, but only API clients see them
+	failInternal := func(err error) {
+		if isForm {
+			log.WithFields(log.Fields{"logger": "logrus", "function": function}).Error(err)
+			err = errors.New("Something went wrong, please try again later")
+		}
+		fail(err, http.StatusInternalServerError)
+	}
+
+	token, err := getQueryParam(r, "token")
+	if err != nil {
+		fail(err, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		found, err := app.Store.FeedbackTokenExists(token)
+		if err != nil {
+			failInternal(err)
+			return
+		}
+		if !found {
+			fail(errors.New("Feedback link is invalid"), http.StatusNotFound)
+			return
+		}
+
+		page := feedbackPage{
+			Action: r.URL.Path + "?token=" + url.QueryEscape(token),
+			Met:    r.URL.Query().Get("met"),
+		}
+		for rating := MinRating; rating <= MaxRating; rating++ {
+			page.Ratings = append(page.Ratings, rating)
+		}
+
+		LogAndWriteFeedbackPage(w, page, http.StatusOK, function)
+		return
+	}
+
+	var body SubmitFeedbackRequestBody
+	if isForm {
+		body, err = getFeedbackFromForm(r)
+		if err != nil {
+			fail(err, http.StatusBadRequest)
+			return
+		}
+	} else {
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fail(err, http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		err = json.Unmarshal(bytes, &body)
+		if err != nil {
+			fail(errors.New("Request body is malformed"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if body.Met == nil {
+		fail(errors.New("Feedback must say whether the group met"), http.StatusBadRequest)
+		return
+	}
+	if body.Rating != nil && (*body.Rating < MinRating || *body.Rating > MaxRating) {
+		fail(fmt.Errorf("Rating must be between %d and %d", MinRating, MaxRating), http.StatusBadRequest)
+		return
+	}
+
+	found, err := app.Store.SaveFeedback(token, body)
+	if err != nil {
+		failInternal(err)
+		return
+	}
+	if !found {
+		fail(errors.New("Feedback link is invalid"), http.StatusNotFound)
+		return
+	}
+
+	if isForm {
+		LogAndWriteFeedbackPage(w, feedbackPage{Message: "Thanks for letting us know!"}, http.StatusOK, function)
+		return
+	}
+
+	LogAndWriteMessage(
+		w,
+		"Thanks for letting us know!",
+		http.StatusOK,
+		function,
+	)
+}
+
+// LogAndWriteFeedbackPage : Respond w/ feedbackPageTemplate instead of JSON
+func LogAndWriteFeedbackPage(w http.ResponseWriter, page feedbackPage, status int, function string) {
+	entry := log.WithFields(log.Fields{
+		"logger":   "logrus",
+		"status":   status,
+		"function": function,
+	})
+	if status >= http.StatusBadRequest {
+		entry.Error(page.Message)
+	} else {
+		entry.Debug(status)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := feedbackPageTemplate.Execute(w, page)
+	if err != nil {
+		entry.Error(err)
+	}
+}
+
+// isFormRequest : Whether the request was submitted by an HTML form
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// getFeedbackFromForm : The answers from the form in feedbackPageTemplate
+func getFeedbackFromForm(r *http.Request) (SubmitFeedbackRequestBody, error) {
+	body := SubmitFeedbackRequestBody{}
+
+	err := r.ParseForm()
+	if err != nil {
+		return body, errors.New("Form is malformed")
+	}
+
+	switch r.PostForm.Get("met") {
+	case "yes":
+		met := true
+		body.Met = &met
+	case "no":
+		met := false
+		body.Met = &met
+	}
+
+	if rating := r.PostForm.Get("rating"); rating != "" {
+		parsed, err := strconv.Atoi(rating)
+		if err != nil {
+			return body, fmt.Errorf("Rating must be between %d and %d", MinRating, MaxRating)
+		}
+		body.Rating = &parsed
+	}
+
+	body.Comment = r.PostForm.Get("comment")
+	return body, nil
+}
+
+// GetFeedbackStatsHandler : HTTP handler for retrieving per-round feedback completion rates
+func (app *App) GetFeedbackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetFeedbackStatsHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
+	}
+
+	stats, err := app.Store.GetFeedbackStats(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, GetFeedbackStatsResponse{Rounds: stats}, http.StatusOK, function)
+}
+
+// AvoidMissedPairsHandler : HTTP handler for toggling whether the pairing algorithm should avoid
+// re-pairing members whose last meeting didn't happen
+func (app *App) AvoidMissedPairsHandler(w http.ResponseWriter, r *http.Request) {
+	function := "AvoidMissedPairsHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(w, errors.New("Only POST requests are allowed at this route"), http.StatusMethodNotAllowed, function)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Malformed body."), http.StatusBadRequest, function)
+		return
+	}
+	defer r.Body.Close()
+
+	var body SetAvoidMissedPairsRequestBody
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	err = app.Store.SetAvoidMissedPairs(orgname, body.Avoid)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(w, "Successfully updated the missed pairs setting", http.StatusOK, function)
+}
+
+// newFeedbackTokens : Generate a random feedback token for every group in the round
+func newFeedbackTokens(round Round) (map[Pair]string, error) {
+	tokens := map[Pair]string{}
+	for pair := range round.Pairs {
+		bytes := make([]byte, FeedbackTokenBytes)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return map[Pair]string{}, err
+		}
+
+		tokens[pair] = hex.EncodeToString(bytes)
+	}
+
+	return tokens, nil
+}
+
+// feedbackURL : Build the one-click link a group uses to report whether they met
+func feedbackURL(token string, met bool) string {
+	baseURL, ok := os.LookupEnv("MEALBOT_URL")
+	if !ok {
+		baseURL = DefaultMealbotURL
+	}
+
+	answer := "no"
+	if met {
+		answer = "yes"
+	}
+
+	return fmt.Sprintf("%s/feedback?token=%s&met=%s", baseURL, token, answer)
+}
+
+func saveFeedbackTokensInTx(tx *sql.Tx, orgname string, roundNum int, tokens map[Pair]string) error {
+	for pair, token := range tokens {
+		_, err := tx.Exec(
+			"INSERT INTO feedback (token, organization, round, id1, id2, extraId) VALUES ($1, $2, $3, $4, $5, $6)",
+			token,
+			orgname,
+			roundNum,
+			pair.ID1,
+			pair.ID2,
+			pair.ExtraID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// feedbackTokenExistsInDB : Whether a group was sent the token
+func feedbackTokenExistsInDB(db *sql.DB, token string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM feedback WHERE token = $1)", token).Scan(&exists)
+	return exists, err
+}
+
+// saveFeedbackInDB : Record a group's response; returns false if no group has the token
+func saveFeedbackInDB(db *sql.DB, token string, body SubmitFeedbackRequestBody) (bool, error) {
+	var rating sql.NullInt64
+	if body.Rating != nil {
+		rating = sql.NullInt64{Int64: int64(*body.Rating), Valid: true}
+	}
+
+	// answering again w/o a rating or comment shouldn't wipe out the ones submitted earlier
+	result, err := db.Exec(
+		"UPDATE feedback SET met = $1, rating = COALESCE($2, rating), comment = COALESCE(NULLIF($3, ''), comment), responded_at = now() AT TIME ZONE 'utc' WHERE token = $4",
+		*body.Met,
+		rating,
+		body.Comment,
+		token,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return numRows > 0, nil
+}
+
+func getFeedbackStatsFromDB(db *sql.DB, orgname string) ([]FeedbackRoundStats, error) {
+	rows, err := db.Query(
+		`SELECT round, COUNT(*), COUNT(responded_at), COUNT(*) FILTER (WHERE met), COALESCE(AVG(rating), 0)
+		FROM feedback WHERE organization = $1 GROUP BY round ORDER BY round ASC`,
+		orgname,
+	)
+	if err != nil {
+		return []FeedbackRoundStats{}, err
+	}
+	defer rows.Close()
+
+	stats := []FeedbackRoundStats{}
+	for rows.Next() {
+		var roundStats FeedbackRoundStats
+		err := rows.Scan(
+			&roundStats.Round,
+			&roundStats.Groups,
+			&roundStats.Responses,
+			&roundStats.Met,
+			&roundStats.AverageRating,
+		)
+		if err != nil {
+			return []FeedbackRoundStats{}, err
+		}
+
+		if roundStats.Groups > 0 {
+			roundStats.CompletionRate = float64(roundStats.Responses) / float64(roundStats.Groups)
+		}
+
+		stats = append(stats, roundStats)
+	}
+
+	return stats, nil
+}
+
+// getMissedPairsFromDB : For each member, the partners whose most recent meeting (with feedback)
+// was reported as not having happened
+func getMissedPairsFromDB(db *sql.DB, orgname string) (map[string]map[string]bool, error) {
+	missed := map[string]map[string]bool{}
+
+	rows, err := db.Query(
+		`SELECT DISTINCT ON (id1, id2, extraId) id1, id2, extraId, met
+		FROM feedback WHERE organization = $1 AND met IS NOT NULL
+		ORDER BY id1, id2, extraId, round DESC`,
+		orgname,
+	)
+	if err != nil {
+		return missed, err
+	}
+	defer rows.Close()
+
+	markMissed := func(id1 string, id2 string) {
+		if id1 == "" || id2 == "" {
+			return
+		}
+		if _, ok := missed[id1]; !ok {
+			missed[id1] = map[string]bool{}
+		}
+		if _, ok := missed[id2]; !ok {
+			missed[id2] = map[string]bool{}
+		}
+		missed[id1][id2] = true
+		missed[id2][id1] = true
+	}
+
+	for rows.Next() {
+		var id1, id2 string
+		var extraID sql.NullString
+		var met bool
+		err := rows.Scan(&id1, &id2, &extraID, &met)
+		if err != nil {
+			return missed, err
+		}
+
+		if met {
+			continue
+		}
+
+		markMissed(id1, id2)
+		if extraID.Valid {
+			markMissed(id1, extraID.String)
+			markMissed(id2, extraID.String)
+		}
+	}
+
+	return missed, nil
+}
+
+// getAvoidMissedPairs : Check whether an organization wants to avoid re-pairing members who didn't meet
+func getAvoidMissedPairs(db *sql.DB, orgname string) (bool, error) {
+	var avoid bool
+	err := db.QueryRow(
+		"SELECT avoid_missed_pairs FROM organizations WHERE name = $1",
+		orgname,
+	).Scan(&avoid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return avoid, nil
+}
+
+func setAvoidMissedPairs(db *sql.DB, orgname string, avoid bool) error {
+	_, err := db.Exec(
+		"UPDATE organizations SET avoid_missed_pairs = $1 WHERE name = $2",
+		avoid,
+		orgname,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedbackHandlerResponds(t *testing.T) {
+	t.Log("Test that people opening feedback links get pages, while API clients get JSON")
+
+	app := &App{Store: NewMemoryStore()}
+
+	cases := []struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+		html        bool
+	}{
+		{"GET", "/feedback?met=yes", "", "", http.StatusBadRequest, true},
+		{"POST", "/feedback?token=abc", "application/x-www-form-urlencoded", "rating=3", http.StatusBadRequest, true},
+		{"POST", "/feedback?token=abc", "application/x-www-form-urlencoded", "met=yes&rating=9", http.StatusBadRequest, true},
+		{"POST", "/feedback?token=abc", "application/json", `{"rating": 3}`, http.StatusBadRequest, false},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		app.FeedbackHandler(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s %s (%s): expected %d, got %d", c.method, c.target, c.body, c.status, w.Code)
+		}
+		if isHTML := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"); isHTML != c.html {
+			t.Errorf("%s %s (%s): expected a page: %t, got '%s'", c.method, c.target, c.body, c.html, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestFeedbackRecordedOnSubmit(t *testing.T) {
+	t.Log("Test that opening a feedback link records nothing, and that a group who didn't meet is a missed pair")
+
+	store := NewMemoryStore()
+	app := &App{Store: store}
+	err := createOrganization(store, "test", "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AddRound("test", time.Date(2019, 1, 2, 18, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := Pair{ID1: "a@gmail.com", ID2: "b@gmail.com"}
+	round := Round{Number: 0, Pairs: map[Pair]bool{pair: true}}
+	err = store.SaveRound("test", round, map[Pair]string{pair: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	app.FeedbackHandler(w, httptest.NewRequest("GET", "/feedback?token=abc&met=no", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the form, got %d: %s", w.Code, w.Body.String())
+	}
+
+	stats, err := store.GetFeedbackStats("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Groups != 1 || stats[0].Responses != 0 {
+		t.Fatalf("Expected opening the link not to record a response, got %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/feedback?token=abc", strings.NewReader("met=no&rating=2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	app.FeedbackHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the answer to be recorded, got %d: %s", w.Code, w.Body.String())
+	}
+
+	stats, err = store.GetFeedbackStats("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Responses != 1 || stats[0].Met != 0 || stats[0].AverageRating != 2 {
+		t.Errorf("Expected a response from a group who didn't meet, got %+v", stats)
+	}
+
+	missed, err := store.GetMissedPairs("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !missed["a@gmail.com"]["b@gmail.com"] || !missed["b@gmail.com"]["a@gmail.com"] {
+		t.Errorf("Expected a & b to have missed each other, got %v", missed)
+	}
+}
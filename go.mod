@@ -9,6 +9,7 @@ require (
 	github.com/gobuffalo/envy v1.6.11 // indirect
 	github.com/johnamadeo/server v0.0.0-20181223122326-3cd1bc6d2320
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/lib/pq v1.0.0
 	github.com/mailgun/mailgun-go v2.0.0+incompatible
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0 // indirect
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// RoundPair : A group made in a particular round, as stored in the pairs table
+type RoundPair struct {
+	Pair  Pair
+	Round int
+}
+
+// PairHistory : The last round each pair of members were grouped together. Like the pair_history table, each
+// pair is keyed by the email that sorts first, and pairs who've never been grouped together have no entry
+type PairHistory map[string]map[string]int
+
+// orderPair : The order a pair of members is stored in
+func orderPair(id1 string, id2 string) (string, string) {
+	if id2 < id1 {
+		return id2, id1
+	}
+	return id1, id2
+}
+
+// LastRound : The last round 2 members were grouped together, or -1 if they never have been
+func (ph PairHistory) LastRound(id1 string, id2 string) int {
+	id1, id2 = orderPair(id1, id2)
+	if round, ok := ph[id1][id2]; ok {
+		return round
+	}
+	return -1
+}
+
+// Update : Record that 2 members were grouped together in a round, unless they've already met in a later one
+func (ph PairHistory) Update(id1 string, id2 string, round int) {
+	if id1 == id2 {
+		return
+	}
+
+	id1, id2 = orderPair(id1, id2)
+	if _, ok := ph[id1]; !ok {
+		ph[id1] = map[string]int{}
+	}
+	if lastRound, ok := ph[id1][id2]; !ok || round > lastRound {
+		ph[id1][id2] = round
+	}
+}
+
+// Partners : Every member that has been grouped w/ 'id', and the last round they were
+func (ph PairHistory) Partners(id string) map[string]int {
+	partners := map[string]int{}
+	for id1, rounds := range ph {
+		for id2, round := range rounds {
+			if id1 == id {
+				partners[id2] = round
+			} else if id2 == id {
+				partners[id1] = round
+			}
+		}
+	}
+
+	return partners
+}
+
+// groupIDs : The 2 or 3 members of a group
+func groupIDs(pair Pair) []string {
+	ids := []string{pair.ID1, pair.ID2}
+	if pair.ExtraID != "" {
+		ids = append(ids, pair.ExtraID)
+	}
+	return ids
+}
+
+// computePairHistory : Rebuild the pairing history from every group ever made
+func computePairHistory(history []RoundPair) PairHistory {
+	pairHistory := PairHistory{}
+	for _, roundPair := range history {
+		ids := groupIDs(roundPair.Pair)
+		for i := range ids {
+			for j := i + 1; j < len(ids); j++ {
+				pairHistory.Update(ids[i], ids[j], roundPair.Round)
+			}
+		}
+	}
+
+	return pairHistory
+}
+
+// lastRoundWith : A member's LastRoundWith for the pairing algorithm. It has an entry for every other active
+// member (-1 if they've never been grouped together), since the algorithm only considers members in
+// LastRoundWith as candidates
+func lastRoundWith(id string, activeIDs []string, pairHistory PairHistory) map[string]int {
+	lastRounds := map[string]int{}
+	for _, otherID := range activeIDs {
+		if otherID != id {
+			lastRounds[otherID] = pairHistory.LastRound(id, otherID)
+		}
+	}
+
+	return lastRounds
+}
+
+// HistoryInconsistency : A pair whose stored last round together doesn't match the pairs table. Member sorts
+// before Partner. Stored is nil if the pair is missing; Computed is nil if the pair never met
+type HistoryInconsistency struct {
+	Member   string `json:"member"`
+	Partner  string `json:"partner"`
+	Stored   *int   `json:"stored"`
+	Computed *int   `json:"computed"`
+}
+
+// RebuildHistoryReport : Data structure for the result of rebuilding an organization's pairing history
+type RebuildHistoryReport struct {
+	Organization    string                 `json:"organization"`
+	DryRun          bool                   `json:"dryRun"`
+	PairsChecked    int                    `json:"pairsChecked"`
+	PairsUpdated    int                    `json:"pairsUpdated"`
+	Inconsistencies []HistoryInconsistency `json:"inconsistencies"`
+}
+
+// RebuildHistoryHandler : HTTP handler for rebuilding an organization's pairing history from the pairs table.
+// Nothing is saved if 'dryRun' is true, so admins can see what would change first
+func (app *App) RebuildHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RebuildHistoryHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	report, err := app.Store.RebuildHistory(orgname, dryRun)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, report, http.StatusOK, function)
+}
+
+// diffPairHistory : Every pair whose stored last round together differs from the computed one
+func diffPairHistory(stored PairHistory, computed PairHistory) []HistoryInconsistency {
+	inconsistencies := []HistoryInconsistency{}
+
+	members := map[string]bool{}
+	for member := range computed {
+		members[member] = true
+	}
+	for member := range stored {
+		members[member] = true
+	}
+
+	sortedMembers := []string{}
+	for member := range members {
+		sortedMembers = append(sortedMembers, member)
+	}
+	sort.Strings(sortedMembers)
+
+	for _, member := range sortedMembers {
+		partners := map[string]bool{}
+		for partner := range computed[member] {
+			partners[partner] = true
+		}
+		for partner := range stored[member] {
+			partners[partner] = true
+		}
+
+		sortedPartners := []string{}
+		for partner := range partners {
+			sortedPartners = append(sortedPartners, partner)
+		}
+		sort.Strings(sortedPartners)
+
+		for _, partner := range sortedPartners {
+			storedRound, hasStored := stored[member][partner]
+			computedRound, hasComputed := computed[member][partner]
+			if hasStored == hasComputed && storedRound == computedRound {
+				continue
+			}
+
+			inconsistency := HistoryInconsistency{Member: member, Partner: partner}
+			if hasStored {
+				inconsistency.Stored = &storedRound
+			}
+			if hasComputed {
+				inconsistency.Computed = &computedRound
+			}
+			inconsistencies = append(inconsistencies, inconsistency)
+		}
+	}
+
+	return inconsistencies
+}
+
+// rebuildHistory : Rebuild an organization's pairing history from the pairs table in a single transaction
+func rebuildHistory(db *sql.DB, orgname string, dryRun bool) (RebuildHistoryReport, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return RebuildHistoryReport{}, err
+	}
+	defer tx.Rollback()
+
+	report, err := rebuildHistoryInTx(tx, orgname, dryRun)
+	if err != nil {
+		return RebuildHistoryReport{}, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	return report, tx.Commit()
+}
+
+// rebuildPairHistory : Recompute & save the organization's pairing history from the pairs table, as part of
+// the given transaction
+func rebuildPairHistory(tx *sql.Tx, orgname string) error {
+	_, err := rebuildHistoryInTx(tx, orgname, false)
+	return err
+}
+
+func rebuildHistoryInTx(tx *sql.Tx, orgname string, dryRun bool) (RebuildHistoryReport, error) {
+	report := RebuildHistoryReport{Organization: orgname, DryRun: dryRun}
+
+	stored, err := getPairHistoryInTx(tx, orgname)
+	if err != nil {
+		return report, err
+	}
+
+	history, err := getPairsHistoryInTx(tx, orgname)
+	if err != nil {
+		return report, err
+	}
+
+	computed := computePairHistory(history)
+	for _, partners := range computed {
+		report.PairsChecked += len(partners)
+	}
+	report.Inconsistencies = diffPairHistory(stored, computed)
+	report.PairsUpdated = len(report.Inconsistencies)
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, inconsistency := range report.Inconsistencies {
+		if inconsistency.Computed == nil {
+			_, err = tx.Exec(
+				"DELETE FROM pair_history WHERE organization = $1 AND member1 = $2 AND member2 = $3",
+				orgname,
+				inconsistency.Member,
+				inconsistency.Partner,
+			)
+		} else {
+			_, err = tx.Exec(
+				`INSERT INTO pair_history (organization, member1, member2, last_round) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (organization, member1, member2) DO UPDATE SET last_round = EXCLUDED.last_round`,
+				orgname,
+				inconsistency.Member,
+				inconsistency.Partner,
+				*inconsistency.Computed,
+			)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// updatePairHistoryInTx : Record that the members of each group in the round met, as part of the given
+// transaction. Only one row per pair of members is written, instead of every member's whole history
+func updatePairHistoryInTx(tx *sql.Tx, orgname string, round Round) error {
+	roundPairs := []RoundPair{}
+	for pair := range round.Pairs {
+		roundPairs = append(roundPairs, RoundPair{Pair: pair, Round: round.Number})
+	}
+
+	for member1, partners := range computePairHistory(roundPairs) {
+		for member2, lastRound := range partners {
+			_, err := tx.Exec(
+				`INSERT INTO pair_history (organization, member1, member2, last_round) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (organization, member1, member2)
+				DO UPDATE SET last_round = GREATEST(pair_history.last_round, EXCLUDED.last_round)`,
+				orgname,
+				member1,
+				member2,
+				lastRound,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// getPairHistoryFromDB : The pairing history of an organization
+func getPairHistoryFromDB(db *sql.DB, orgname string) (PairHistory, error) {
+	rows, err := db.Query(
+		"SELECT member1, member2, last_round FROM pair_history WHERE organization = $1",
+		orgname,
+	)
+	if err != nil {
+		return PairHistory{}, err
+	}
+	defer rows.Close()
+
+	return scanPairHistory(rows)
+}
+
+func getPairHistoryInTx(tx *sql.Tx, orgname string) (PairHistory, error) {
+	rows, err := tx.Query(
+		"SELECT member1, member2, last_round FROM pair_history WHERE organization = $1",
+		orgname,
+	)
+	if err != nil {
+		return PairHistory{}, err
+	}
+	defer rows.Close()
+
+	return scanPairHistory(rows)
+}
+
+func scanPairHistory(rows *sql.Rows) (PairHistory, error) {
+	pairHistory := PairHistory{}
+	for rows.Next() {
+		var member1, member2 string
+		var lastRound int
+		err := rows.Scan(&member1, &member2, &lastRound)
+		if err != nil {
+			return PairHistory{}, err
+		}
+
+		pairHistory.Update(member1, member2, lastRound)
+	}
+
+	return pairHistory, rows.Err()
+}
+
+// getPartnersFromDB : Every member that has been grouped w/ 'email', and the last round they were. Each
+// side of the pair is indexed, so this doesn't scan the organization's whole history
+func getPartnersFromDB(db *sql.DB, orgname string, email string) (map[string]int, error) {
+	partners := map[string]int{}
+
+	rows, err := db.Query(
+		`SELECT member2, last_round FROM pair_history WHERE organization = $1 AND member1 = $2
+		UNION ALL
+		SELECT member1, last_round FROM pair_history WHERE organization = $1 AND member2 = $2`,
+		orgname,
+		email,
+	)
+	if err != nil {
+		return partners, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var partner string
+		var lastRound int
+		err := rows.Scan(&partner, &lastRound)
+		if err != nil {
+			return partners, err
+		}
+
+		partners[partner] = lastRound
+	}
+
+	return partners, rows.Err()
+}
+
+// getLastRoundTogetherFromDB : The last round 2 members were grouped together, or -1 if they never have been
+func getLastRoundTogetherFromDB(db *sql.DB, orgname string, email1 string, email2 string) (int, error) {
+	member1, member2 := orderPair(email1, email2)
+
+	var lastRound int
+	err := db.QueryRow(
+		"SELECT last_round FROM pair_history WHERE organization = $1 AND member1 = $2 AND member2 = $3",
+		orgname,
+		member1,
+		member2,
+	).Scan(&lastRound)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	return lastRound, nil
+}
+
+// getPairsHistoryInTx : Every group ever made in the organization, in round order. Unlike getPairsFromDB,
+// this doesn't stop at rounds w/o any pairs (e.g cancelled or rolled back rounds)
+func getPairsHistoryInTx(tx *sql.Tx, orgname string) ([]RoundPair, error) {
+	rows, err := tx.Query(
+		"SELECT id1, id2, extraId, round FROM pairs WHERE organization = $1 ORDER BY round ASC",
+		orgname,
+	)
+	if err != nil {
+		return []RoundPair{}, err
+	}
+	defer rows.Close()
+
+	history := []RoundPair{}
+	for rows.Next() {
+		var roundPair RoundPair
+		var extraID sql.NullString
+		err := rows.Scan(&roundPair.Pair.ID1, &roundPair.Pair.ID2, &extraID, &roundPair.Round)
+		if err != nil {
+			return []RoundPair{}, err
+		}
+
+		roundPair.Pair.ExtraID = extraID.String
+		history = append(history, roundPair)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestComputePairHistory(t *testing.T) {
+	t.Log("Test that the pairing history is rebuilt from pairs, including extra members & gaps between rounds")
+
+	history := []RoundPair{
+		{Pair: Pair{ID1: "a@gmail.com", ID2: "b@gmail.com", ExtraID: "c@gmail.com"}, Round: 0},
+		{Pair: Pair{ID1: "d@gmail.com", ID2: "a@gmail.com"}, Round: 1},
+		// round 2 was cancelled, so there's a gap
+		{Pair: Pair{ID1: "b@gmail.com", ID2: "a@gmail.com"}, Round: 3},
+	}
+
+	pairHistory := computePairHistory(history)
+
+	expected := PairHistory{
+		"a@gmail.com": {"b@gmail.com": 3, "c@gmail.com": 0, "d@gmail.com": 1},
+		"b@gmail.com": {"c@gmail.com": 0},
+	}
+	if len(pairHistory) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, pairHistory)
+	}
+	for member1, partners := range expected {
+		if len(pairHistory[member1]) != len(partners) {
+			t.Errorf("%s: expected %v, got %v", member1, partners, pairHistory[member1])
+			continue
+		}
+		for member2, round := range partners {
+			if pairHistory.LastRound(member2, member1) != round {
+				t.Errorf("%s's last round with %s: expected %d, got %d", member2, member1, round, pairHistory.LastRound(member2, member1))
+			}
+		}
+	}
+
+	partners := pairHistory.Partners("b@gmail.com")
+	if len(partners) != 2 || partners["a@gmail.com"] != 3 || partners["c@gmail.com"] != 0 {
+		t.Errorf("expected b@gmail.com's partners to be a@gmail.com in 3 & c@gmail.com in 0, got %v", partners)
+	}
+
+	// d@gmail.com was deactivated, so they aren't a candidate for anyone
+	activeIDs := []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "e@gmail.com"}
+	lastRounds := lastRoundWith("c@gmail.com", activeIDs, pairHistory)
+	expectedLastRounds := map[string]int{"a@gmail.com": 0, "b@gmail.com": 0, "e@gmail.com": -1}
+	if len(lastRounds) != len(expectedLastRounds) {
+		t.Fatalf("expected %v, got %v", expectedLastRounds, lastRounds)
+	}
+	for partner, round := range expectedLastRounds {
+		if lastRounds[partner] != round {
+			t.Errorf("c@gmail.com's last round with %s: expected %d, got %d", partner, round, lastRounds[partner])
+		}
+	}
+}
+
+func TestDiffPairHistory(t *testing.T) {
+	t.Log("Test that mismatched, missing & extra pairs are all reported")
+
+	stored := PairHistory{
+		"a@gmail.com": {"b@gmail.com": 2, "c@gmail.com": 0},
+		"b@gmail.com": {"x@gmail.com": 1},
+	}
+	computed := PairHistory{
+		"a@gmail.com": {"b@gmail.com": 3, "c@gmail.com": 0},
+		"b@gmail.com": {"c@gmail.com": 4},
+	}
+
+	inconsistencies := diffPairHistory(stored, computed)
+
+	expected := []string{
+		"a@gmail.com b@gmail.com 2 3",
+		"b@gmail.com c@gmail.com missing 4",
+		"b@gmail.com x@gmail.com 1 missing",
+	}
+	if len(inconsistencies) != len(expected) {
+		t.Fatalf("expected %d inconsistencies, got %d: %v", len(expected), len(inconsistencies), inconsistencies)
+	}
+	for i, inconsistency := range inconsistencies {
+		got := inconsistency.Member + " " + inconsistency.Partner + " " +
+			formatHistoryRound(inconsistency.Stored) + " " + formatHistoryRound(inconsistency.Computed)
+		if got != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], got)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultJWKSCacheTTL : How long keys are used before the key set is fetched again
+	DefaultJWKSCacheTTL = time.Hour
+	// JWKSRefreshInterval : Min. time between fetches triggered by tokens signed w/ an unknown key, so that
+	// garbage tokens can't make us hammer the identity provider
+	JWKSRefreshInterval = 30 * time.Second
+	// JWKSTimeout : Max. time to wait for the identity provider when fetching its key set
+	JWKSTimeout = 10 * time.Second
+)
+
+// ErrUnknownKey : The token was signed w/ a key that isn't in the key set
+var ErrUnknownKey = errors.New("Unable to find appropriate key")
+
+// JWKSCache : Public keys from a JSON Web Key Set, fetched once per TTL instead of on every request. When the
+// identity provider rotates its keys, tokens signed w/ the new key trigger a refresh
+type JWKSCache struct {
+	URL string
+	TTL time.Duration
+
+	client *http.Client
+	// mutex : Guards the fields below, but is never held while fetching, so a slow identity provider only holds
+	// up requests that need a new key
+	mutex       sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetching    *jwksFetch
+}
+
+// jwksFetch : A fetch of the key set in progress. Concurrent refreshes wait for it instead of fetching again
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewJWKSCache :
+func NewJWKSCache(url string, ttl time.Duration) *JWKSCache {
+	return &JWKSCache{
+		URL:    url,
+		TTL:    ttl,
+		client: &http.Client{Timeout: JWKSTimeout},
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+// GetKey : The public key w/ the given ID. If the key set can't be fetched, the keys from the last successful
+// fetch keep being used
+func (c *JWKSCache) GetKey(kid string) (*rsa.PublicKey, error) {
+	key, ok, stale, numKeys := c.lookup(kid)
+	if ok && !stale {
+		return key, nil
+	}
+
+	if stale {
+		_, err := c.refresh()
+		if err != nil && numKeys == 0 {
+			return nil, err
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"url": c.URL}).Error(err)
+		}
+
+		key, ok, _, _ = c.lookup(kid)
+		if ok {
+			return key, nil
+		}
+	}
+
+	// the key may have just been rotated in
+	refreshed, err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	if refreshed {
+		key, ok, _, _ = c.lookup(kid)
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// lookup : The key w/ the given ID, whether the key set is older than the TTL, and how many keys there are
+func (c *JWKSCache) lookup(kid string) (*rsa.PublicKey, bool, bool, int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	key, ok := c.keys[kid]
+	return key, ok, time.Since(c.fetchedAt) > c.TTL, len(c.keys)
+}
+
+// refresh : Fetch the key set, or wait for the fetch that's already in progress. Returns false w/o fetching if
+// the last attempt was within JWKSRefreshInterval; failed attempts count too, so an outage doesn't block every
+// request on a timeout
+func (c *JWKSCache) refresh() (bool, error) {
+	c.mutex.Lock()
+	if fetching := c.fetching; fetching != nil {
+		c.mutex.Unlock()
+		<-fetching.done
+		return true, fetching.err
+	}
+	if time.Since(c.attemptedAt) <= JWKSRefreshInterval {
+		c.mutex.Unlock()
+		return false, nil
+	}
+
+	fetching := &jwksFetch{done: make(chan struct{})}
+	c.fetching = fetching
+	c.attemptedAt = time.Now()
+	c.mutex.Unlock()
+
+	keys, err := c.fetch()
+
+	c.mutex.Lock()
+	if err == nil {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+	}
+	c.fetching = nil
+	c.mutex.Unlock()
+
+	fetching.err = err
+	close(fetching.done)
+	return true, err
+}
+
+// fetch : Get & parse the key set
+func (c *JWKSCache) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching JSON Web Key Set failed w/ status %d", resp.StatusCode)
+	}
+
+	var jwks Jwks
+	err = json.NewDecoder(resp.Body).Decode(&jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		// keys for encryption, or that aren't RSA, can't verify our tokens
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		key, err := parseRSAPublicKey(jwk)
+		if err != nil {
+			log.WithFields(log.Fields{"url": c.URL, "kid": jwk.Kid}).Error(err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// parseRSAPublicKey : Build the key from its modulus & exponent, or from its certificate chain if the key set
+// doesn't include them https://tools.ietf.org/html/rfc7518#section-6.3.1
+func parseRSAPublicKey(jwk JSONWebKeys) (*rsa.PublicKey, error) {
+	if jwk.N != "" && jwk.E != "" {
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("Key '%s' has a malformed modulus: %s", jwk.Kid, err.Error())
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("Key '%s' has a malformed exponent: %s", jwk.Kid, err.Error())
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("Key '%s' has an unsupported exponent", jwk.Kid)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	}
+
+	if len(jwk.X5c) > 0 {
+		cert := "-----BEGIN CERTIFICATE-----\n" + jwk.X5c[0] + "\n-----END CERTIFICATE-----"
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(cert))
+	}
+
+	return nil, fmt.Errorf("Key '%s' has neither 'n' & 'e' nor 'x5c'", jwk.Kid)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestJWK : The public half of 'key' as a JWK w/ only 'n' & 'e'
+func newTestJWK(kid string, key *rsa.PrivateKey) JSONWebKeys {
+	return JSONWebKeys{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	t.Log("Test that keys are cached, and that the key set is fetched again when a token uses an unknown key")
+
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	jwks := Jwks{Keys: []JSONWebKeys{newTestJWK("key1", key1)}}
+	fetches := 0
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		fetches++
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer jwksServer.Close()
+
+	cache := NewJWKSCache(jwksServer.URL, time.Hour)
+	for i := 0; i < 3; i++ {
+		key, err := cache.GetKey("key1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.N.Cmp(key1.N) != 0 || key.E != key1.E {
+			t.Fatal("expected the key to be built from 'n' & 'e'")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the key set to be fetched once, got %d", fetches)
+	}
+
+	// the key is rotated, but tokens w/ unknown keys only trigger a fetch every JWKSRefreshInterval
+	mutex.Lock()
+	jwks.Keys = append(jwks.Keys, newTestJWK("key2", key2))
+	mutex.Unlock()
+
+	_, err = cache.GetKey("key2")
+	if err != ErrUnknownKey {
+		t.Errorf("expected %v right after a fetch, got %v", ErrUnknownKey, err)
+	}
+
+	cache.attemptedAt = time.Now().Add(-2 * JWKSRefreshInterval)
+	key, err := cache.GetKey("key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.N.Cmp(key2.N) != 0 {
+		t.Error("expected the rotated key")
+	}
+	if fetches != 2 {
+		t.Errorf("expected the key set to be fetched again, got %d fetches", fetches)
+	}
+
+	_, err = parseRSAPublicKey(JSONWebKeys{Kty: "RSA", Kid: "empty"})
+	if err == nil {
+		t.Error("expected a key w/o 'n', 'e' or 'x5c' to be rejected")
+	}
+}
+
+func TestJWKSCacheConcurrentRefresh(t *testing.T) {
+	t.Log("Test that concurrent refreshes share one fetch, and that known keys don't wait for it")
+
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	jwks := Jwks{Keys: []JSONWebKeys{newTestJWK("key1", key1)}}
+	fetches := 0
+	fetching := make(chan bool, 1)
+	release := make(chan bool)
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetches++
+		slow := fetches > 1
+		mutex.Unlock()
+
+		if slow {
+			fetching <- true
+			<-release
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer jwksServer.Close()
+
+	cache := NewJWKSCache(jwksServer.URL, time.Hour)
+	_, err = cache.GetKey("key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	jwks.Keys = append(jwks.Keys, newTestJWK("key2", key2))
+	mutex.Unlock()
+	cache.mutex.Lock()
+	cache.attemptedAt = time.Now().Add(-2 * JWKSRefreshInterval)
+	cache.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetKey("key2")
+			errs <- err
+		}()
+	}
+
+	<-fetching
+	done := make(chan bool)
+	go func() {
+		cache.GetKey("key1")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected a known key to be returned while the key set is being fetched")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected every request to get the rotated key, got %v", err)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected the requests w/ the rotated key to share one fetch, got %d fetches in total", fetches)
+	}
+}
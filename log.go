@@ -1,28 +1,92 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 
-	"github.com/johnamadeo/server"
 	log "github.com/sirupsen/logrus"
 )
 
+// Response : Envelope of every response from the API. Successful responses only have 'data', and failed
+// ones only have 'error'
+type Response struct {
+	Data  interface{}    `json:"data,omitempty"`
+	Error *ErrorResponse `json:"error,omitempty"`
+}
+
+// ErrorResponse : 'Code' is meant for clients to switch on, while 'Message' is meant for people
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// MessageResponse : Data of responses that only confirm something was done
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// errorCodes : Codes for errors that clients may want to handle specifically; other errors get the code of
+// their status
+var errorCodes = map[error]string{
+	ErrForbidden:          "forbidden",
+	ErrOrganizationExists: "organization_exists",
+	ErrAdminNotFound:      "admin_not_found",
+	ErrOwnerRole:          "owner_role",
+	ErrInvalidRole:        "invalid_role",
+	ErrAPIKeyNotFound:     "api_key_not_found",
+	ErrAPIKeyNotAllowed:   "api_key_not_allowed",
+	ErrRoundNotFound:      "round_not_found",
+	ErrRoundDone:          "round_done",
+	ErrRoundRunning:       "round_running",
+	ErrRoundNotDone:       "round_not_done",
+	ErrRoundNotPending:    "round_not_pending",
+	ErrWebhookNotFound:    "webhook_not_found",
+}
+
+// statusCodes : Codes for errors that aren't in errorCodes
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// LogAndWriteErr : Respond w/ the error in an envelope, w/ its code from errorCodes or else from its status
 func LogAndWriteErr(w http.ResponseWriter, err error, status int, function string) {
 	log.WithFields(log.Fields{
 		"logger":   "logrus",
 		"status":   status,
 		"function": function,
 	}).Error(err)
-	w.WriteHeader(status)
-	w.Write(server.ErrToBytes(err))
+
+	code, ok := errorCodes[err]
+	if !ok {
+		code, ok = statusCodes[status]
+	}
+	if !ok {
+		code = "error"
+	}
+
+	writeResponse(w, Response{Error: &ErrorResponse{Code: code, Message: err.Error()}}, status)
 }
 
-func LogAndWrite(w http.ResponseWriter, bytes []byte, status int, function string) {
+// LogAndWrite : Respond w/ 'data' in an envelope
+func LogAndWrite(w http.ResponseWriter, data interface{}, status int, function string) {
 	log.WithFields(log.Fields{
 		"logger":   "logrus",
 		"function": function,
 	}).Debug(status)
-	w.Write(bytes)
+
+	writeResponse(w, Response{Data: data}, status)
+}
+
+// LogAndWriteMessage : Respond w/ a message confirming that something was done
+func LogAndWriteMessage(w http.ResponseWriter, message string, status int, function string) {
+	LogAndWrite(w, MessageResponse{Message: message}, status, function)
 }
 
 func LogAndWriteStatusBadRequest(w http.ResponseWriter, err error, function string) {
@@ -32,3 +96,19 @@ func LogAndWriteStatusBadRequest(w http.ResponseWriter, err error, function stri
 func LogAndWriteStatusInternalServerError(w http.ResponseWriter, err error, function string) {
 	LogAndWriteErr(w, err, http.StatusInternalServerError, function)
 }
+
+// writeResponse : The status can only be written once, so the response is marshalled before anything is
+// written in case that fails
+func writeResponse(w http.ResponseWriter, resp Response, status int) {
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		log.WithFields(log.Fields{"logger": "logrus", "status": status}).Error(err)
+
+		status = http.StatusInternalServerError
+		bytes, _ = json.Marshal(Response{Error: &ErrorResponse{Code: statusCodes[status], Message: err.Error()}})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// decodeData : Unmarshal the data in a response's envelope into 'data'
+func decodeData(body []byte, data interface{}) error {
+	var resp struct {
+		Data  json.RawMessage `json:"data"`
+		Error *ErrorResponse  `json:"error"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return errors.New(resp.Error.Message)
+	}
+
+	return json.Unmarshal(resp.Data, data)
+}
+
+func TestResponseEnvelopes(t *testing.T) {
+	t.Log("Test that responses are JSON envelopes w/ the right status, and that errors have machine-readable codes")
+
+	w := httptest.NewRecorder()
+	LogAndWriteMessage(w, "Successfully cancelled round", http.StatusOK, "TestResponseEnvelopes")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected %d w/ 'Content-Type: application/json', got %d w/ '%s'", http.StatusOK, w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Body.String() != `{"data":{"message":"Successfully cancelled round"}}` {
+		t.Errorf("Expected the message in 'data', got %s", w.Body.String())
+	}
+
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrRoundNotFound, http.StatusNotFound, "round_not_found"},
+		{errors.New("Request body is malformed"), http.StatusBadRequest, "bad_request"},
+		{errors.New("Only GET requests are allowed at this route"), http.StatusMethodNotAllowed, "method_not_allowed"},
+		{errors.New("I'm a teapot"), http.StatusTeapot, "error"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		LogAndWriteErr(w, c.err, c.status, "TestResponseEnvelopes")
+		if w.Code != c.status {
+			t.Errorf("%v: expected %d, got %d", c.err, c.status, w.Code)
+		}
+
+		var resp Response
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil || resp.Data != nil || resp.Error == nil || resp.Error.Code != c.code || resp.Error.Message != c.err.Error() {
+			t.Errorf("%v: expected an error w/ code '%s', got %s", c.err, c.code, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	LogAndWrite(w, func() {}, http.StatusOK, "TestResponseEnvelopes")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected %d when the data can't be marshalled, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"bufio"
+	"database/sql"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -28,11 +28,11 @@ const (
 
 // Member :
 type Member struct {
-	Organization  string
-	Email         string `json:"email"`
-	Name          string `json:"name"`
-	Metadata      map[string]string
-	LastRoundWith map[string]int
+	Organization string
+	Email        string `json:"email"`
+	Name         string `json:"name"`
+	Metadata     map[string]string
+	Active       bool
 }
 
 // MemberResponse : Data structure for representing a member
@@ -52,16 +52,23 @@ type GetMembersResponse struct {
 }
 
 // MembersHandler : Combined handlers for create and retrieving members
-func MembersHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) MembersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		CreateMembersHandler(w, r)
+		app.CreateMembersHandler(w, r)
 	} else if r.Method == "GET" {
-		GetMembersHandler(w, r)
+		app.GetMembersHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET and POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"MembersHandler",
+		)
 	}
 }
 
 // GetMembersHandler : HTTP handler for retrieving members
-func GetMembersHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) GetMembersHandler(w http.ResponseWriter, r *http.Request) {
 	function := "GetMembersHandler"
 	if r.Method != "GET" {
 		LogAndWriteErr(
@@ -79,7 +86,11 @@ func GetMembersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	members, err := getActiveMembersFromDBAsMap(orgname)
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
+	}
+
+	members, err := getActiveMembersAsMap(app.Store, orgname)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
@@ -94,7 +105,7 @@ func GetMembersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	crossMatchTrait, err := GetCrossMatchTrait(orgname)
+	crossMatchTrait, err := app.Store.GetCrossMatchTrait(orgname)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
@@ -108,18 +119,12 @@ func GetMembersHandler(w http.ResponseWriter, r *http.Request) {
 		resp.CrossMatchTrait = crossMatchTrait
 	}
 
-	bytes, err := json.Marshal(resp)
-	if err != nil {
-		LogAndWriteStatusInternalServerError(w, err, function)
-		return
-	}
-
-	LogAndWrite(w, bytes, http.StatusOK, function)
+	LogAndWrite(w, resp, http.StatusOK, function)
 }
 
 // TODO: The problem is here!
 // CreateMembersHandler : HTTP handler for creating members
-func CreateMembersHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) CreateMembersHandler(w http.ResponseWriter, r *http.Request) {
 	function := "CreateMembersHandler"
 	if r.Method != "POST" {
 		LogAndWriteErr(
@@ -137,6 +142,10 @@ func CreateMembersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
 	err = r.ParseMultipartForm(MaxMemory)
 	if err != nil {
 		LogAndWriteStatusBadRequest(w, err, function)
@@ -166,7 +175,7 @@ func CreateMembersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	members, err := createMembersFromCSV(orgname, filename)
+	members, err := createMembersFromCSV(app.Store, orgname, filename)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
@@ -184,13 +193,7 @@ func CreateMembersHandler(w http.ResponseWriter, r *http.Request) {
 		Traits:  traits,
 	}
 
-	bytes, err := json.Marshal(resp)
-	if err != nil {
-		LogAndWriteStatusInternalServerError(w, err, function)
-		return
-	}
-
-	LogAndWrite(w, bytes, http.StatusCreated, function)
+	LogAndWrite(w, resp, http.StatusCreated, function)
 }
 
 // isValidFormatCSV :
@@ -204,11 +207,12 @@ func isValidFormatCSV(headers []string) bool {
 	return false
 }
 
-func createMembersFromCSV(orgname string, filename string) ([]MemberResponse, error) {
+func createMembersFromCSV(store Store, orgname string, filename string) ([]MemberResponse, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return []MemberResponse{}, err
 	}
+	defer file.Close()
 
 	reader := csv.NewReader(bufio.NewReader(file))
 	members := []Member{}
@@ -249,24 +253,14 @@ func createMembersFromCSV(orgname string, filename string) ([]MemberResponse, er
 		}
 
 		members = append(members, Member{
-			Organization:  orgname, // Need to grab from HTTP request
-			Email:         email,
-			Name:          name,
-			Metadata:      metadata,
-			LastRoundWith: map[string]int{}, // fill in later
+			Organization: orgname, // Need to grab from HTTP request
+			Email:        email,
+			Name:         name,
+			Metadata:     metadata,
 		})
 	}
 
-	for i := range members {
-		for j := range members {
-			if i == j {
-				continue
-			}
-			members[i].LastRoundWith[members[j].Email] = -1
-		}
-	}
-
-	err = saveMembersInDB(orgname, members)
+	err = saveMembers(store, orgname, members)
 	if err != nil {
 		return []MemberResponse{}, err
 	}
@@ -282,22 +276,18 @@ func createMembersFromCSV(orgname string, filename string) ([]MemberResponse, er
 	return membersJSON, nil
 }
 
+// saveMembers : Replace the organization's members w/ 'newMembers'. Existing members keep their pairing history,
+// and members who aren't in the new list are deactivated
 // TODO: Use transactions!!! Current implementation is brittle since it does
 // rollback if insertion of multiple members fails halfway
-func saveMembersInDB(orgname string, newMembers []Member) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return err
-	}
-
+func saveMembers(store Store, orgname string, newMembers []Member) error {
 	newMembersMap := map[string]Member{}
 	for _, member := range newMembers {
 		newMembersMap[member.Email] = member
 	}
 
 	membersMap := map[string]Member{}
-	members, err := GetMembersFromDB(orgname, false)
+	members, err := store.GetMembers(orgname, false)
 	if err != nil {
 		return err
 	}
@@ -317,117 +307,77 @@ func saveMembersInDB(orgname string, newMembers []Member) error {
 	for email := range membersMap {
 		if _, ok := newMembersMap[email]; ok {
 			membersMap[email] = Member{
-				Organization:  membersMap[email].Organization,
-				Email:         membersMap[email].Email,         // cannot be updated by user
-				LastRoundWith: membersMap[email].LastRoundWith, // update later
-				Name:          newMembersMap[email].Name,
-				Metadata:      newMembersMap[email].Metadata,
-			}
-		}
-	}
-
-	// update pair counts of existing members with new members
-	for email, member := range membersMap {
-		for newEmail := range newMembersMap {
-			// if new email is not existing member
-			if _, ok := membersMap[newEmail]; !ok {
-				member.LastRoundWith[newEmail] = -1
+				Organization: membersMap[email].Organization,
+				Email:        membersMap[email].Email, // cannot be updated by user
+				Name:         newMembersMap[email].Name,
+				Metadata:     newMembersMap[email].Metadata,
 			}
 		}
-
-		membersMap[email] = member
 	}
 
 	// save new member
 	for email := range newMembersMap {
 		if _, ok := membersMap[email]; !ok {
-			lastRoundWith := map[string]int{}
-
-			for otherEmail := range newMembersMap {
-				if otherEmail == email {
-					continue
-				}
-				lastRoundWith[otherEmail] = -1
-			}
-
 			membersMap[email] = Member{
-				Organization:  orgname,
-				Name:          newMembersMap[email].Name,
-				Email:         newMembersMap[email].Email,
-				Metadata:      newMembersMap[email].Metadata,
-				LastRoundWith: lastRoundWith,
+				Organization: orgname,
+				Name:         newMembersMap[email].Name,
+				Email:        newMembersMap[email].Email,
+				Metadata:     newMembersMap[email].Metadata,
 			}
 		}
 	}
 
 	existingMemberEmails := map[string]bool{}
+	activeMemberEmails := map[string]bool{}
 	for _, member := range members {
 		existingMemberEmails[member.Email] = true
+		if member.Active {
+			activeMemberEmails[member.Email] = true
+		}
 	}
 
 	for _, member := range membersMap {
-		metadataBytes, err := json.Marshal(member.Metadata)
-		if err != nil {
-			return err
-		}
-
-		lastRoundWithBytes, err := json.Marshal(member.LastRoundWith)
-		if err != nil {
-			return err
-		}
-
 		// Add new member
 		if _, ok := existingMemberEmails[member.Email]; !ok {
-			columns := "(organization, email, name, metadata, last_round_with, active)"
-			placeholders := "($1, $2, $3, $4, $5, $6)"
-			_, err = db.Exec(
-				fmt.Sprintf(
-					"INSERT INTO members %s VALUES %s",
-					columns,
-					placeholders,
-				),
-				member.Organization,
-				member.Email,
-				member.Name,
-				server.JSONB(metadataBytes),
-				server.JSONB(lastRoundWithBytes),
-				true,
-			)
-
+			err = store.InsertMember(member)
 			if err != nil {
 				return err
 			}
+
+			store.EmitEvent(orgname, EventMemberAdded, MemberEventData{Email: member.Email, Name: member.Name})
 			// Update existing member
 		} else {
-			_, err = db.Exec(
-				"UPDATE members SET name = $1, metadata = $2, last_round_with = $3, active = $4 WHERE organization = $5 AND email = $6",
-				member.Name,
-				server.JSONB(metadataBytes),
-				server.JSONB(lastRoundWithBytes),
-				true,
-				orgname,
-				member.Email,
-			)
+			err = store.UpdateMember(member)
+			if err != nil {
+				return err
+			}
+
+			// previously deactivated members who are back in the CSV count as added
+			if !activeMemberEmails[member.Email] {
+				store.EmitEvent(orgname, EventMemberAdded, MemberEventData{Email: member.Email, Name: member.Name})
+			}
 		}
 	}
 
 	// Deactivate member (note we don't delete member from the DB)
 	for email := range existingMemberEmails {
 		if _, ok := membersMap[email]; !ok {
-			_, err = db.Exec(
-				"UPDATE members SET active = $1 WHERE organization = $2 AND email = $3",
-				false,
-				orgname,
-				email,
-			)
+			err = store.DeactivateMember(orgname, email)
+			if err != nil {
+				return err
+			}
+
+			if activeMemberEmails[email] {
+				store.EmitEvent(orgname, EventMemberDeactivated, MemberEventData{Email: email})
+			}
 		}
 	}
 
 	return nil
 }
 
-func getActiveMembersFromDBAsMap(orgname string) ([]MemberResponse, error) {
-	members, err := GetMembersFromDB(orgname, true)
+func getActiveMembersAsMap(store Store, orgname string) ([]MemberResponse, error) {
+	members, err := store.GetMembers(orgname, true)
 	if err != nil {
 		return []MemberResponse{}, err
 	}
@@ -443,8 +393,8 @@ func getActiveMembersFromDBAsMap(orgname string) ([]MemberResponse, error) {
 	return mapMembers, nil
 }
 
-func getActiveMembersFromDBInPairFormat(orgname string) ([]Member, error) {
-	members, err := GetMembersFromDB(orgname, true)
+func getActiveMembersFromDBInPairFormat(db *sql.DB, orgname string) ([]Member, error) {
+	members, err := GetMembersFromDB(db, orgname, true)
 	if err != nil {
 		return []Member{}, err
 	}
@@ -461,28 +411,23 @@ func getActiveMembersFromDBInPairFormat(orgname string) ([]Member, error) {
 }
 
 // GetMembersFromDB : Placeholder
-func GetMembersFromDB(orgname string, onlyActive bool) ([]Member, error) {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return []Member{}, err
-	}
-
+func GetMembersFromDB(db *sql.DB, orgname string, onlyActive bool) ([]Member, error) {
 	members := []Member{}
 
 	rows, err := db.Query(
-		"SELECT organization, name, email, metadata, last_round_with, active FROM members WHERE organization = $1 ORDER BY name",
+		"SELECT organization, name, email, metadata, active FROM members WHERE organization = $1 ORDER BY name",
 		orgname,
 	)
 	if err != nil {
 		return members, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var organization, name, email string
-		var metadataJSON, lastRoundWithJSON server.JSONB
+		var metadataJSON server.JSONB
 		var active bool
-		err := rows.Scan(&organization, &name, &email, &metadataJSON, &lastRoundWithJSON, &active)
+		err := rows.Scan(&organization, &name, &email, &metadataJSON, &active)
 		if err != nil {
 			return members, err
 		}
@@ -502,23 +447,12 @@ func GetMembersFromDB(orgname string, onlyActive bool) ([]Member, error) {
 			return members, err
 		}
 
-		bytes, err = lastRoundWithJSON.MarshalJSON()
-		if err != nil {
-			return members, err
-		}
-
-		var lastRoundWith map[string]int
-		err = json.Unmarshal(bytes, &lastRoundWith)
-		if err != nil {
-			return members, err
-		}
-
 		members = append(members, Member{
-			Organization:  organization,
-			Name:          name,
-			Email:         email,
-			Metadata:      metadata,
-			LastRoundWith: lastRoundWith,
+			Organization: organization,
+			Name:         name,
+			Email:        email,
+			Metadata:     metadata,
+			Active:       active,
 		})
 	}
 
@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore : Store that keeps everything in memory, so that handlers & the pairing flow can be tested w/o
+// Postgres. It mirrors PostgresStore's behavior, including its errors, except that webhook deliveries are
+// queued but never attempted
+type MemoryStore struct {
+	mutex            sync.Mutex
+	organizations    map[string]Organization
+	chatWebhooks     map[string]ChatWebhook
+	avoidMissedPairs map[string]bool
+	members          map[string]map[string]Member
+	rounds           map[string][]memoryRound
+	pairs            map[string][]RoundPair
+	feedback         map[string]memoryFeedback
+	admins           map[string]map[string]string
+	apiKeys          []memoryAPIKey
+	schedules        map[string]Schedule
+	webhooks         []memoryWebhook
+	deliveries       []memoryDelivery
+	lastWebhookID    int
+	lastDeliveryID   int
+
+	// Events : Every event emitted, in order
+	Events []MemoryEvent
+}
+
+// MemoryEvent : An event emitted to a MemoryStore
+type MemoryEvent struct {
+	Organization string
+	Type         string
+	Data         interface{}
+}
+
+// memoryTimestampFormat : Go equivalent of TimestampFormat
+const memoryTimestampFormat = "2006-01-02 15:04:05Z"
+
+type memoryAPIKey struct {
+	APIKey
+	Hash string
+}
+
+type memoryRound struct {
+	ScheduledDate time.Time
+	Status        string
+	Attempts      int
+	Generated     bool
+}
+
+// memoryFeedback : A group's feedback token, along w/ their response once they've given it
+type memoryFeedback struct {
+	Organization string
+	Round        int
+	Pair         Pair
+	Met          *bool
+	Rating       *int
+	Comment      string
+}
+
+type memoryWebhook struct {
+	Webhook
+	Organization string
+	Secret       string
+}
+
+type memoryDelivery struct {
+	WebhookDelivery
+	Organization string
+}
+
+// NewMemoryStore :
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		organizations:    map[string]Organization{},
+		chatWebhooks:     map[string]ChatWebhook{},
+		avoidMissedPairs: map[string]bool{},
+		members:          map[string]map[string]Member{},
+		rounds:           map[string][]memoryRound{},
+		pairs:            map[string][]RoundPair{},
+		feedback:         map[string]memoryFeedback{},
+		admins:           map[string]map[string]string{},
+		schedules:        map[string]Schedule{},
+	}
+}
+
+// GetOrganizations :
+func (s *MemoryStore) GetOrganizations(user string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	organizations := []string{}
+	for name, admins := range s.admins {
+		if _, ok := admins[user]; ok {
+			organizations = append(organizations, name)
+		}
+	}
+	sort.Strings(organizations)
+
+	return organizations, nil
+}
+
+// CreateOrganization :
+func (s *MemoryStore) CreateOrganization(org Organization) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[org.Name]; ok {
+		return ErrOrganizationExists
+	}
+
+	s.organizations[org.Name] = org
+	s.members[org.Name] = map[string]Member{}
+	s.admins[org.Name] = map[string]string{org.Admin: RoleOwner}
+	return nil
+}
+
+// GetCrossMatchTrait :
+func (s *MemoryStore) GetCrossMatchTrait(orgname string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.organizations[orgname].CrossMatchTrait, nil
+}
+
+// SetCrossMatchTrait :
+func (s *MemoryStore) SetCrossMatchTrait(orgname string, crossMatchTrait string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if org, ok := s.organizations[orgname]; ok {
+		org.CrossMatchTrait = crossMatchTrait
+		s.organizations[orgname] = org
+	}
+	return nil
+}
+
+// GetOrganizationLocation :
+func (s *MemoryStore) GetOrganizationLocation(orgname string) (*time.Location, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timezone := s.organizations[orgname].TimeZone
+	if timezone == "" {
+		timezone = DefaultTimeZone
+	}
+
+	return loadLocation(timezone)
+}
+
+// SetTimeZone :
+func (s *MemoryStore) SetTimeZone(orgname string, timezone string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if org, ok := s.organizations[orgname]; ok {
+		org.TimeZone = timezone
+		s.organizations[orgname] = org
+	}
+	return nil
+}
+
+// GetAvoidMissedPairs :
+func (s *MemoryStore) GetAvoidMissedPairs(orgname string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.avoidMissedPairs[orgname], nil
+}
+
+// SetAvoidMissedPairs :
+func (s *MemoryStore) SetAvoidMissedPairs(orgname string, avoid bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[orgname]; ok {
+		s.avoidMissedPairs[orgname] = avoid
+	}
+	return nil
+}
+
+// GetChatWebhook :
+func (s *MemoryStore) GetChatWebhook(orgname string) (ChatWebhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if webhook, ok := s.chatWebhooks[orgname]; ok {
+		return webhook, nil
+	}
+	return ChatWebhook{Mode: ChatWebhookModeSummary, SendEmails: true}, nil
+}
+
+// SetChatWebhook :
+func (s *MemoryStore) SetChatWebhook(orgname string, webhook ChatWebhook) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[orgname]; ok {
+		s.chatWebhooks[orgname] = webhook
+	}
+	return nil
+}
+
+// GetRole :
+func (s *MemoryStore) GetRole(orgname string, user string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.admins[orgname][user], nil
+}
+
+// GetAdmins :
+func (s *MemoryStore) GetAdmins(orgname string) ([]OrganizationAdmin, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	admins := []OrganizationAdmin{}
+	for email, role := range s.admins[orgname] {
+		admins = append(admins, OrganizationAdmin{Email: email, Role: role})
+	}
+
+	sort.Slice(admins, func(i, j int) bool {
+		if admins[i].Role != admins[j].Role {
+			return roleRanks[admins[i].Role] > roleRanks[admins[j].Role]
+		}
+		return admins[i].Email < admins[j].Email
+	})
+
+	return admins, nil
+}
+
+// SetAdmin :
+func (s *MemoryStore) SetAdmin(orgname string, email string, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	admins, ok := s.admins[orgname]
+	if !ok {
+		return fmt.Errorf("organization '%s' does not exist", orgname)
+	}
+	if admins[email] == RoleOwner {
+		return ErrOwnerRole
+	}
+
+	admins[email] = role
+	return nil
+}
+
+// RemoveAdmin :
+func (s *MemoryStore) RemoveAdmin(orgname string, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	role, ok := s.admins[orgname][email]
+	if !ok {
+		return ErrAdminNotFound
+	}
+	if role == RoleOwner {
+		return ErrOwnerRole
+	}
+
+	delete(s.admins[orgname], email)
+	return nil
+}
+
+// TransferOwnership :
+func (s *MemoryStore) TransferOwnership(orgname string, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	admins, ok := s.admins[orgname]
+	if !ok {
+		return fmt.Errorf("organization '%s' does not exist", orgname)
+	}
+
+	for admin, role := range admins {
+		if role == RoleOwner {
+			admins[admin] = RoleAdmin
+		}
+	}
+	admins[email] = RoleOwner
+
+	return nil
+}
+
+// CreateAPIKey :
+func (s *MemoryStore) CreateAPIKey(apiKey APIKey, keyHash string) (APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[apiKey.Organization]; !ok {
+		return APIKey{}, fmt.Errorf("organization '%s' does not exist", apiKey.Organization)
+	}
+	for _, existing := range s.apiKeys {
+		if existing.Hash == keyHash {
+			return APIKey{}, fmt.Errorf("%s \"api_keys_key_hash_key\"", DuplicateKeyErr)
+		}
+	}
+
+	apiKey.ID = len(s.apiKeys) + 1
+	apiKey.CreatedAt = time.Now().UTC().Format(memoryTimestampFormat)
+	apiKey.LastUsedAt = ""
+	apiKey.RevokedAt = ""
+	s.apiKeys = append(s.apiKeys, memoryAPIKey{APIKey: apiKey, Hash: keyHash})
+
+	return apiKey, nil
+}
+
+// GetAPIKeys :
+func (s *MemoryStore) GetAPIKeys(orgname string) ([]APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	apiKeys := []APIKey{}
+	for _, apiKey := range s.apiKeys {
+		if apiKey.Organization == orgname {
+			apiKeys = append(apiKeys, apiKey.APIKey)
+		}
+	}
+
+	return apiKeys, nil
+}
+
+// GetAPIKeyByHash :
+func (s *MemoryStore) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, apiKey := range s.apiKeys {
+		if apiKey.Hash == keyHash && apiKey.RevokedAt == "" {
+			return apiKey.APIKey, nil
+		}
+	}
+
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+// TouchAPIKey :
+func (s *MemoryStore) TouchAPIKey(apiKeyID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].ID == apiKeyID {
+			s.apiKeys[i].LastUsedAt = time.Now().UTC().Format(memoryTimestampFormat)
+		}
+	}
+
+	return nil
+}
+
+// RevokeAPIKey :
+func (s *MemoryStore) RevokeAPIKey(orgname string, apiKeyID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.apiKeys {
+		apiKey := &s.apiKeys[i]
+		if apiKey.ID == apiKeyID && apiKey.Organization == orgname && apiKey.RevokedAt == "" {
+			apiKey.RevokedAt = time.Now().UTC().Format(memoryTimestampFormat)
+			return nil
+		}
+	}
+
+	return ErrAPIKeyNotFound
+}
+
+// GetMembers :
+func (s *MemoryStore) GetMembers(orgname string, onlyActive bool) ([]Member, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members := []Member{}
+	for _, member := range s.members[orgname] {
+		if onlyActive && !member.Active {
+			continue
+		}
+		members = append(members, copyMember(member))
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members, nil
+}
+
+// InsertMember :
+func (s *MemoryStore) InsertMember(member Member) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members, ok := s.members[member.Organization]
+	if !ok {
+		return fmt.Errorf("organization '%s' does not exist", member.Organization)
+	}
+	if _, ok := members[member.Email]; ok {
+		return fmt.Errorf("%s \"members_pkey\"", DuplicateKeyErr)
+	}
+
+	member = copyMember(member)
+	member.Active = true
+	members[member.Email] = member
+	return nil
+}
+
+// UpdateMember :
+func (s *MemoryStore) UpdateMember(member Member) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.members[member.Organization][member.Email]; !ok {
+		return nil
+	}
+
+	member = copyMember(member)
+	member.Active = true
+	s.members[member.Organization][member.Email] = member
+	return nil
+}
+
+// DeactivateMember :
+func (s *MemoryStore) DeactivateMember(orgname string, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if member, ok := s.members[orgname][email]; ok {
+		member.Active = false
+		s.members[orgname][email] = member
+	}
+	return nil
+}
+
+// GetRounds :
+func (s *MemoryStore) GetRounds(orgname string, loc *time.Location) ([]RoundResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rounds := []RoundResponse{}
+	for id := range s.rounds[orgname] {
+		rounds = append(rounds, s.roundResponse(orgname, id, loc))
+	}
+
+	return rounds, nil
+}
+
+// GetRound :
+func (s *MemoryStore) GetRound(orgname string, roundID int, loc *time.Location) (RoundResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if roundID < 0 || roundID >= len(s.rounds[orgname]) {
+		return RoundResponse{}, ErrRoundNotFound
+	}
+
+	round := s.roundResponse(orgname, roundID, loc)
+	round.Groups = []GetPairsResponsePair{}
+	for _, roundPair := range s.pairs[orgname] {
+		if roundPair.Round == roundID {
+			round.Groups = append(round.Groups, s.pairResponse(orgname, roundPair.Pair, false))
+		}
+	}
+
+	return round, nil
+}
+
+// AddRound :
+func (s *MemoryStore) AddRound(orgname string, roundDate time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[orgname]; !ok {
+		return fmt.Errorf("organization '%s' does not exist", orgname)
+	}
+
+	roundID := len(s.rounds[orgname])
+	s.rounds[orgname] = append(s.rounds[orgname], memoryRound{ScheduledDate: roundDate, Status: RoundStatusScheduled})
+	s.emitEvent(orgname, EventRoundScheduled, RoundEventData{Round: roundID, Date: roundDate.Format(time.RFC3339)})
+
+	return nil
+}
+
+// RescheduleRound :
+func (s *MemoryStore) RescheduleRound(orgname string, roundDate time.Time, roundID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if roundID < 0 || roundID >= len(s.rounds[orgname]) {
+		return ErrRoundNotPending
+	}
+
+	round := &s.rounds[orgname][roundID]
+	if round.Status == RoundStatusDone || round.Status == RoundStatusCancelled || round.Status == RoundStatusRunning {
+		return ErrRoundNotPending
+	}
+
+	if round.Generated {
+		err := s.excludeFromSchedule(orgname, round.ScheduledDate)
+		if err != nil {
+			return err
+		}
+	}
+
+	round.ScheduledDate = roundDate
+	round.Generated = false
+	round.Status = RoundStatusScheduled
+	round.Attempts = 0
+	return nil
+}
+
+// CancelRound :
+func (s *MemoryStore) CancelRound(orgname string, roundID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if roundID < 0 || roundID >= len(s.rounds[orgname]) {
+		return ErrRoundNotFound
+	}
+
+	round := &s.rounds[orgname][roundID]
+	if round.Status == RoundStatusCancelled {
+		return nil
+	}
+	if round.Status == RoundStatusDone {
+		return ErrRoundDone
+	}
+	if round.Status == RoundStatusRunning {
+		return ErrRoundRunning
+	}
+
+	if round.Generated {
+		err := s.excludeFromSchedule(orgname, round.ScheduledDate)
+		if err != nil {
+			return err
+		}
+	}
+
+	round.Status = RoundStatusCancelled
+	s.emitEvent(orgname, EventRoundCancelled, RoundEventData{Round: roundID, Date: round.ScheduledDate.Format(time.RFC3339)})
+
+	return nil
+}
+
+// RollbackRound :
+func (s *MemoryStore) RollbackRound(orgname string, roundID int, newDate time.Time) ([]GetPairsResponsePair, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if roundID < 0 || roundID >= len(s.rounds[orgname]) {
+		return nil, ErrRoundNotFound
+	}
+
+	round := &s.rounds[orgname][roundID]
+	if round.Status != RoundStatusDone {
+		return nil, ErrRoundNotDone
+	}
+
+	groups := []GetPairsResponsePair{}
+	remainingPairs := []RoundPair{}
+	for _, roundPair := range s.pairs[orgname] {
+		if roundPair.Round == roundID {
+			groups = append(groups, s.pairResponse(orgname, roundPair.Pair, false))
+		} else {
+			remainingPairs = append(remainingPairs, roundPair)
+		}
+	}
+	s.pairs[orgname] = remainingPairs
+
+	for token, feedback := range s.feedback {
+		if feedback.Organization == orgname && feedback.Round == roundID {
+			delete(s.feedback, token)
+		}
+	}
+
+	round.Status = RoundStatusScheduled
+	round.Attempts = 0
+	round.ScheduledDate = newDate
+	s.emitEvent(orgname, EventRoundRolledBack, RoundEventData{Round: roundID})
+
+	return groups, nil
+}
+
+// GetSchedule :
+func (s *MemoryStore) GetSchedule(orgname string) (Schedule, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	schedule, found := s.schedules[orgname]
+	return schedule, found, nil
+}
+
+// SetSchedule :
+func (s *MemoryStore) SetSchedule(orgname string, schedule Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[orgname]; !ok {
+		return fmt.Errorf("organization '%s' does not exist", orgname)
+	}
+	if schedule.Exclusions == nil {
+		schedule.Exclusions = []string{}
+	}
+	s.schedules[orgname] = schedule
+
+	now := time.Now()
+	occurrences, err := schedule.Occurrences(now, now.AddDate(0, 0, schedule.HorizonDays))
+	if err != nil {
+		return err
+	}
+
+	moves, cancels, inserts := planScheduleChanges(s.upcomingGeneratedRounds(orgname, now), occurrences)
+	for _, move := range moves {
+		s.rounds[orgname][move.ID].ScheduledDate = move.Date
+	}
+	for _, roundID := range cancels {
+		s.cancelGeneratedRound(orgname, roundID)
+	}
+	for _, occurrence := range inserts {
+		roundID := len(s.rounds[orgname])
+		s.rounds[orgname] = append(
+			s.rounds[orgname],
+			memoryRound{ScheduledDate: occurrence, Status: RoundStatusScheduled, Generated: true},
+		)
+		s.emitEvent(orgname, EventRoundScheduled, RoundEventData{Round: roundID, Date: occurrence.Format(time.RFC3339)})
+	}
+
+	return nil
+}
+
+// RemoveSchedule :
+func (s *MemoryStore) RemoveSchedule(orgname string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.schedules, orgname)
+	for _, round := range s.upcomingGeneratedRounds(orgname, time.Now()) {
+		s.cancelGeneratedRound(orgname, round.ID)
+	}
+
+	return nil
+}
+
+// GetPairs :
+func (s *MemoryStore) GetPairs(orgname string, filter PairsFilter) ([]RoundPairs, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pairsByRound := map[int][]GetPairsResponsePair{}
+	for _, roundPair := range s.pairs[orgname] {
+		pair := roundPair.Pair
+		if roundPair.Round < filter.RoundFrom || roundPair.Round > filter.RoundTo {
+			continue
+		}
+		if filter.Member != "" && filter.Member != pair.ID1 && filter.Member != pair.ID2 && filter.Member != pair.ExtraID {
+			continue
+		}
+
+		pairsByRound[roundPair.Round] = append(pairsByRound[roundPair.Round], s.pairResponse(orgname, pair, true))
+	}
+
+	rounds := []int{}
+	for round := range pairsByRound {
+		rounds = append(rounds, round)
+	}
+	sort.Ints(rounds)
+	if len(rounds) > filter.Limit {
+		rounds = rounds[:filter.Limit]
+	}
+
+	roundPairs := []RoundPairs{}
+	for _, round := range rounds {
+		roundPairs = append(roundPairs, RoundPairs{Round: round, Pairs: pairsByRound[round]})
+	}
+
+	return roundPairs, nil
+}
+
+// SaveRound :
+func (s *MemoryStore) SaveRound(orgname string, round Round, tokens map[Pair]string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if round.Number < 0 || round.Number >= len(s.rounds[orgname]) {
+		return ErrRoundNotFound
+	}
+	if s.rounds[orgname][round.Number].Status == RoundStatusCancelled {
+		return ErrRoundCancelled
+	}
+
+	for pair := range round.Pairs {
+		s.pairs[orgname] = append(s.pairs[orgname], RoundPair{Pair: pair, Round: round.Number})
+	}
+
+	savedRound := &s.rounds[orgname][round.Number]
+	savedRound.Status = RoundStatusDone
+	savedRound.Attempts++
+
+	for pair, token := range tokens {
+		s.feedback[token] = memoryFeedback{Organization: orgname, Round: round.Number, Pair: pair}
+	}
+
+	return nil
+}
+
+// GetMissedPairs : Only the latest response of each group counts, like getMissedPairsFromDB
+func (s *MemoryStore) GetMissedPairs(orgname string) (map[string]map[string]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	latest := map[Pair]memoryFeedback{}
+	for _, feedback := range s.feedback {
+		if feedback.Organization != orgname || feedback.Met == nil {
+			continue
+		}
+		if previous, ok := latest[feedback.Pair]; !ok || feedback.Round > previous.Round {
+			latest[feedback.Pair] = feedback
+		}
+	}
+
+	missed := map[string]map[string]bool{}
+	for pair, feedback := range latest {
+		if *feedback.Met {
+			continue
+		}
+
+		ids := groupIDs(pair)
+		for i := range ids {
+			for j := range ids {
+				if i == j {
+					continue
+				}
+				if _, ok := missed[ids[i]]; !ok {
+					missed[ids[i]] = map[string]bool{}
+				}
+				missed[ids[i]][ids[j]] = true
+			}
+		}
+	}
+
+	return missed, nil
+}
+
+// FeedbackTokenExists :
+func (s *MemoryStore) FeedbackTokenExists(token string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.feedback[token]
+	return ok, nil
+}
+
+// SaveFeedback : Answering again w/o a rating or comment keeps the ones submitted earlier
+func (s *MemoryStore) SaveFeedback(token string, body SubmitFeedbackRequestBody) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	feedback, ok := s.feedback[token]
+	if !ok {
+		return false, nil
+	}
+
+	met := *body.Met
+	feedback.Met = &met
+	if body.Rating != nil {
+		rating := *body.Rating
+		feedback.Rating = &rating
+	}
+	if body.Comment != "" {
+		feedback.Comment = body.Comment
+	}
+	s.feedback[token] = feedback
+
+	return true, nil
+}
+
+// GetFeedbackStats :
+func (s *MemoryStore) GetFeedbackStats(orgname string) ([]FeedbackRoundStats, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	statsByRound := map[int]*FeedbackRoundStats{}
+	ratingTotals := map[int]int{}
+	numRatings := map[int]int{}
+	for _, feedback := range s.feedback {
+		if feedback.Organization != orgname {
+			continue
+		}
+
+		roundStats, ok := statsByRound[feedback.Round]
+		if !ok {
+			roundStats = &FeedbackRoundStats{Round: feedback.Round}
+			statsByRound[feedback.Round] = roundStats
+		}
+
+		roundStats.Groups++
+		if feedback.Met != nil {
+			roundStats.Responses++
+			if *feedback.Met {
+				roundStats.Met++
+			}
+		}
+		if feedback.Rating != nil {
+			ratingTotals[feedback.Round] += *feedback.Rating
+			numRatings[feedback.Round]++
+		}
+	}
+
+	stats := []FeedbackRoundStats{}
+	for round, roundStats := range statsByRound {
+		roundStats.CompletionRate = float64(roundStats.Responses) / float64(roundStats.Groups)
+		if numRatings[round] > 0 {
+			roundStats.AverageRating = float64(ratingTotals[round]) / float64(numRatings[round])
+		}
+		stats = append(stats, *roundStats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Round < stats[j].Round })
+
+	return stats, nil
+}
+
+// GetPairHistory : The history is computed from the groups made so far, rather than stored separately
+func (s *MemoryStore) GetPairHistory(orgname string) (PairHistory, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return computePairHistory(s.pairs[orgname]), nil
+}
+
+// GetPartners :
+func (s *MemoryStore) GetPartners(orgname string, email string) (map[string]int, error) {
+	pairHistory, err := s.GetPairHistory(orgname)
+	if err != nil {
+		return map[string]int{}, err
+	}
+
+	return pairHistory.Partners(email), nil
+}
+
+// GetLastRoundTogether :
+func (s *MemoryStore) GetLastRoundTogether(orgname string, email1 string, email2 string) (int, error) {
+	pairHistory, err := s.GetPairHistory(orgname)
+	if err != nil {
+		return -1, err
+	}
+
+	return pairHistory.LastRound(email1, email2), nil
+}
+
+// RebuildHistory : The history is always computed from the groups made so far, so there's never anything to fix
+func (s *MemoryStore) RebuildHistory(orgname string, dryRun bool) (RebuildHistoryReport, error) {
+	pairHistory, err := s.GetPairHistory(orgname)
+	if err != nil {
+		return RebuildHistoryReport{}, err
+	}
+
+	report := RebuildHistoryReport{Organization: orgname, DryRun: dryRun}
+	for _, partners := range pairHistory {
+		report.PairsChecked += len(partners)
+	}
+	report.Inconsistencies = diffPairHistory(pairHistory, pairHistory)
+
+	return report, nil
+}
+
+// GetWebhooks :
+func (s *MemoryStore) GetWebhooks(orgname string) ([]Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	webhooks := []Webhook{}
+	for _, webhook := range s.webhooks {
+		if webhook.Organization == orgname {
+			webhooks = append(webhooks, webhook.Webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+// CreateWebhook :
+func (s *MemoryStore) CreateWebhook(orgname string, url string, secret string) (Webhook, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.organizations[orgname]; !ok {
+		return Webhook{}, fmt.Errorf("organization '%s' does not exist", orgname)
+	}
+
+	s.lastWebhookID++
+	webhook := Webhook{ID: s.lastWebhookID, URL: url, CreatedAt: time.Now().UTC().Format(memoryTimestampFormat)}
+	s.webhooks = append(s.webhooks, memoryWebhook{Webhook: webhook, Organization: orgname, Secret: secret})
+
+	return webhook, nil
+}
+
+// RemoveWebhook : Its deliveries are removed along w/ it
+func (s *MemoryStore) RemoveWebhook(orgname string, webhookID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, webhook := range s.webhooks {
+		if webhook.Organization != orgname || webhook.ID != webhookID {
+			continue
+		}
+
+		s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+
+		deliveries := []memoryDelivery{}
+		for _, delivery := range s.deliveries {
+			if delivery.WebhookID != webhookID {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		s.deliveries = deliveries
+
+		return nil
+	}
+
+	return ErrWebhookNotFound
+}
+
+// GetWebhookDeliveries : Deliveries are queued but never attempted, so they're all pending
+func (s *MemoryStore) GetWebhookDeliveries(orgname string) ([]WebhookDelivery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < WebhookDeliveryLogLimit; i-- {
+		if s.deliveries[i].Organization == orgname {
+			deliveries = append(deliveries, s.deliveries[i].WebhookDelivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// EmitEvent :
+func (s *MemoryStore) EmitEvent(orgname string, eventType string, data interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.emitEvent(orgname, eventType, data)
+}
+
+func (s *MemoryStore) emitEvent(orgname string, eventType string, data interface{}) {
+	s.Events = append(s.Events, MemoryEvent{Organization: orgname, Type: eventType, Data: data})
+
+	for _, webhook := range s.webhooks {
+		if webhook.Organization != orgname {
+			continue
+		}
+
+		s.lastDeliveryID++
+		delivery := WebhookDelivery{
+			ID:        s.lastDeliveryID,
+			WebhookID: webhook.ID,
+			EventType: eventType,
+			Status:    DeliveryStatusPending,
+			CreatedAt: time.Now().UTC().Format(memoryTimestampFormat),
+		}
+		s.deliveries = append(s.deliveries, memoryDelivery{WebhookDelivery: delivery, Organization: orgname})
+	}
+}
+
+// upcomingGeneratedRounds : Equivalent of getUpcomingGeneratedRounds
+func (s *MemoryStore) upcomingGeneratedRounds(orgname string, now time.Time) []ScheduledRound {
+	upcomingRounds := []ScheduledRound{}
+	for id, round := range s.rounds[orgname] {
+		if round.Generated && round.Status == RoundStatusScheduled && round.ScheduledDate.After(now) {
+			upcomingRounds = append(
+				upcomingRounds,
+				ScheduledRound{ID: id, Date: round.ScheduledDate.UTC().Format(RoundDateFormat)},
+			)
+		}
+	}
+
+	return upcomingRounds
+}
+
+func (s *MemoryStore) cancelGeneratedRound(orgname string, roundID int) {
+	round := &s.rounds[orgname][roundID]
+	round.Status = RoundStatusCancelled
+	s.emitEvent(orgname, EventRoundCancelled, RoundEventData{Round: roundID, Date: round.ScheduledDate.Format(time.RFC3339)})
+}
+
+// excludeFromSchedule : Equivalent of excludeFromScheduleInDB
+func (s *MemoryStore) excludeFromSchedule(orgname string, roundDate time.Time) error {
+	schedule, found := s.schedules[orgname]
+	if !found {
+		return nil
+	}
+
+	loc, err := loadLocation(schedule.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	date := roundDate.In(loc).Format(ScheduleDateFormat)
+	for _, exclusion := range schedule.Exclusions {
+		if exclusion == date {
+			return nil
+		}
+	}
+
+	schedule.Exclusions = append(schedule.Exclusions, date)
+	s.schedules[orgname] = schedule
+	return nil
+}
+
+func (s *MemoryStore) roundResponse(orgname string, roundID int, loc *time.Location) RoundResponse {
+	round := s.rounds[orgname][roundID]
+	response := RoundResponse{
+		ID:            roundID,
+		ScheduledDate: round.ScheduledDate.In(loc).Format(time.RFC3339),
+		Status:        round.Status,
+		Attempts:      round.Attempts,
+	}
+
+	for _, roundPair := range s.pairs[orgname] {
+		if roundPair.Round != roundID {
+			continue
+		}
+
+		response.NumGroups++
+		response.NumMembers += 2
+		if roundPair.Pair.ExtraID != "" {
+			response.NumMembers++
+		}
+	}
+
+	return response
+}
+
+// pairResponse : Only the name & email of each member; deactivated members are left empty if 'onlyActive' is set
+func (s *MemoryStore) pairResponse(orgname string, pair Pair, onlyActive bool) GetPairsResponsePair {
+	member := func(email string) Member {
+		saved, ok := s.members[orgname][email]
+		if !ok || (onlyActive && !saved.Active) {
+			return Member{}
+		}
+		return Member{Name: saved.Name, Email: saved.Email}
+	}
+
+	response := GetPairsResponsePair{Member1: member(pair.ID1), Member2: member(pair.ID2)}
+	if pair.ExtraID != "" {
+		response.ExtraMember = member(pair.ExtraID)
+	}
+
+	return response
+}
+
+// copyMember : Members are copied in & out of a MemoryStore, since callers modify their metadata
+func copyMember(member Member) Member {
+	copied := member
+
+	copied.Metadata = map[string]string{}
+	for key, value := range member.Metadata {
+		copied.Metadata[key] = value
+	}
+
+	return copied
+}
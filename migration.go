@@ -1,23 +1,337 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/johnamadeo/server"
 )
 
-func migrateToLastRoundWithForPairing() error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+const (
+	// MigrationsDir : Numbered SQL migrations e.g '0004_feedback.up.sql' & '0004_feedback.down.sql'. Like
+	// './static', it's relative to the directory mealbot is run from
+	MigrationsDir = "./migrations"
+	// MigrationLockNamespace : Advisory lock namespace so that two deploys never run migrations at the same time
+	MigrationLockNamespace = "mealbot.migrations"
+)
+
+// Migration : A numbered change to the database. Schema changes are SQL files in 'migrations/', while
+// data changes that need Go code are registered in dataMigrations
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// MigrationStatus : Data structure for reporting whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+var dataMigrations = []Migration{
+	{
+		Version: 3,
+		Name:    "rebuild_last_round_with",
+		Up:      migrateToLastRoundWithForPairing,
+		// the column is dropped by the previous migration's down, so there's nothing to undo
+		Down: func(tx *sql.Tx) error { return nil },
+	},
+}
+
+// runMigrateCommand : `mealbot migrate up|down|status`
+func runMigrateCommand(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mealbot migrate up|down|status")
+	}
+
+	migrations, err := loadMigrations()
 	if err != nil {
 		return err
 	}
 
-	rows, err := db.Query("SELECT name FROM organizations")
+	err = ensureMigrationsTable(db)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrateUp(db, migrations)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := migrateDown(db, migrations)
+		if err != nil {
+			return err
+		}
+		if reverted == nil {
+			fmt.Println("no migrations to revert")
+			return nil
+		}
+		fmt.Printf("reverted %04d_%s\n", reverted.Version, reverted.Name)
+		return nil
+	case "status":
+		statuses, err := getMigrationStatuses(db, migrations)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != "" {
+				appliedAt = "applied " + status.AppliedAt
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	default:
+		return fmt.Errorf("migrate argument '%s' not recognized", args[0])
+	}
+}
+
+// loadMigrations : Every SQL & data migration, sorted by version. Versions must start at 1 w/o gaps,
+// and every SQL migration needs both an up & a down file
+func loadMigrations() ([]Migration, error) {
+	entries, err := ioutil.ReadDir(MigrationsDir)
+	if err != nil {
+		return []Migration{}, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		filename := entry.Name()
+		direction := ""
+		if strings.HasSuffix(filename, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(filename, ".down.sql") {
+			direction = "down"
+		} else {
+			return []Migration{}, fmt.Errorf("migration '%s' must end in .up.sql or .down.sql", filename)
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return []Migration{}, fmt.Errorf("migration '%s' must be named <version>_<name>", filename)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return []Migration{}, fmt.Errorf("migration '%s' has an invalid version", filename)
+		}
+
+		bytes, err := ioutil.ReadFile(filepath.Join(MigrationsDir, filename))
+		if err != nil {
+			return []Migration{}, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if migration.Name != parts[1] {
+			return []Migration{}, fmt.Errorf("migration %d is named both '%s' and '%s'", version, migration.Name, parts[1])
+		}
+
+		if direction == "up" {
+			migration.Up = execMigrationSQL(string(bytes))
+		} else {
+			migration.Down = execMigrationSQL(string(bytes))
+		}
+	}
+
+	for _, dataMigration := range dataMigrations {
+		if _, ok := byVersion[dataMigration.Version]; ok {
+			return []Migration{}, fmt.Errorf("migration %d is both a SQL & a data migration", dataMigration.Version)
+		}
+		migration := dataMigration
+		byVersion[migration.Version] = &migration
+	}
+
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == nil || migration.Down == nil {
+			return []Migration{}, fmt.Errorf("migration %04d_%s needs both an up & a down", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return []Migration{}, fmt.Errorf("migration versions must start at 1 w/o gaps, but found %d after %d", migration.Version, i)
+		}
+	}
+
+	return migrations, nil
+}
+
+func execMigrationSQL(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)`,
+	)
+	return err
+}
+
+// migrateUp : Apply every pending migration in order, each in its own transaction. Returns the ones
+// that were applied before any error
+func migrateUp(db *sql.DB, migrations []Migration) ([]Migration, error) {
+	applied := []Migration{}
+	for _, migration := range migrations {
+		ok, err := runMigration(db, migration, true)
+		if err != nil {
+			return applied, fmt.Errorf("%04d_%s: %s", migration.Version, migration.Name, err.Error())
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// migrateDown : Revert the latest applied migration, if any
+func migrateDown(db *sql.DB, migrations []Migration) (*Migration, error) {
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		ok, err := runMigration(db, migration, false)
+		if err != nil {
+			return nil, fmt.Errorf("%04d_%s: %s", migration.Version, migration.Name, err.Error())
+		}
+		if ok {
+			return &migration, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// runMigration : Apply (or revert) a migration along w/ its schema_migrations row, unless it's already
+// applied (or not applied). Returns whether anything was done
+func runMigration(db *sql.DB, migration Migration, up bool) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", MigrationLockNamespace)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM schema_migrations WHERE version = $1",
+		migration.Version,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	isApplied := count > 0
+	if isApplied == up {
+		return false, nil
+	}
+
+	if up {
+		err = migration.Up(tx)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now() AT TIME ZONE 'utc')",
+			migration.Version,
+			migration.Name,
+		)
+	} else {
+		err = migration.Down(tx)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func getMigrationStatuses(db *sql.DB, migrations []Migration) ([]MigrationStatus, error) {
+	rows, err := db.Query(
+		"SELECT version, to_char(applied_at, $1) FROM schema_migrations",
+		TimestampFormat,
+	)
+	if err != nil {
+		return []MigrationStatus{}, err
+	}
+	defer rows.Close()
+
+	appliedAt := map[int]string{}
+	for rows.Next() {
+		var version int
+		var timestamp string
+		err := rows.Scan(&version, &timestamp)
+		if err != nil {
+			return []MigrationStatus{}, err
+		}
+
+		appliedAt[version] = timestamp
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if timestamp, ok := appliedAt[migration.Version]; ok {
+			status.AppliedAt = timestamp
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// migrateToLastRoundWithForPairing : Data migration that fills in every member's LastRoundWith from the
+// pairs table, for databases that were created when the pairing algorithm used pair counts. The column is
+// replaced by pair_history in 0010, so the way it was computed is kept here for this migration alone
+func migrateToLastRoundWithForPairing(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT name FROM organizations")
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
 	organizations := []string{}
 	for rows.Next() {
@@ -29,65 +343,104 @@ func migrateToLastRoundWithForPairing() error {
 
 		organizations = append(organizations, organization)
 	}
+	rows.Close()
 
 	for _, org := range organizations {
-		membersMap := map[string]Member{}
-		members, err := GetMembersFromDB(org, true)
+		err = rebuildLastRoundWith(tx, org)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// rebuildLastRoundWith : Recompute & save LastRoundWith for every member of the organization from the
+// pairs table, as part of the given transaction
+func rebuildLastRoundWith(tx *sql.Tx, orgname string) error {
+	rows, err := tx.Query("SELECT email, active FROM members WHERE organization = $1 ORDER BY email", orgname)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	emails := []string{}
+	active := map[string]bool{}
+	for rows.Next() {
+		var email string
+		var isActive bool
+		err := rows.Scan(&email, &isActive)
+		if err != nil {
+			return err
+		}
+
+		emails = append(emails, email)
+		active[email] = isActive
+	}
+	rows.Close()
+
+	history, err := getPairsHistoryInTx(tx, orgname)
+	if err != nil {
+		return err
+	}
 
-		for _, member := range members {
-			member.LastRoundWith = map[string]int{}
-			membersMap[member.Email] = member
+	lastRoundWith := computeLastRoundWith(emails, active, history)
+	for _, email := range emails {
+		bytes, err := json.Marshal(lastRoundWith[email])
+		if err != nil {
+			return err
 		}
 
-		pairs, err := getPairsFromDB(org)
+		_, err = tx.Exec(
+			"UPDATE members SET last_round_with = $1 WHERE organization = $2 AND email = $3",
+			server.JSONB(bytes),
+			orgname,
+			email,
+		)
 		if err != nil {
 			return err
 		}
+	}
 
-		for round, roundPairs := range pairs {
-			for _, pairing := range roundPairs {
-				member1Email := pairing.Member1.Email
-				member2Email := pairing.Member2.Email
-				extraMemberEmail := pairing.ExtraMember.Email
+	return nil
+}
 
-				// Need to check if member in the pairing is still active
-				if _, ok := membersMap[member1Email]; ok {
-					membersMap[member1Email].LastRoundWith[member2Email] = round
-				}
-				if _, ok := membersMap[member2Email]; ok {
-					membersMap[member2Email].LastRoundWith[member1Email] = round
-				}
-				if _, ok := membersMap[extraMemberEmail]; ok {
-					membersMap[member1Email].LastRoundWith[extraMemberEmail] = round
-					membersMap[member2Email].LastRoundWith[extraMemberEmail] = round
-					membersMap[extraMemberEmail].LastRoundWith[member1Email] = round
-					membersMap[extraMemberEmail].LastRoundWith[member2Email] = round
-				}
+// computeLastRoundWith : Every member gets an entry for every other active member (-1 if they've never been
+// grouped together), since the pairing algorithm only considered members in LastRoundWith as candidates
+func computeLastRoundWith(emails []string, active map[string]bool, history []RoundPair) map[string]map[string]int {
+	lastRoundWith := map[string]map[string]int{}
+	for _, email := range emails {
+		lastRoundWith[email] = map[string]int{}
+		for _, otherEmail := range emails {
+			if otherEmail != email && active[otherEmail] {
+				lastRoundWith[email][otherEmail] = -1
 			}
 		}
+	}
 
-		for _, member := range membersMap {
-			bytes, err := json.Marshal(member.LastRoundWith)
-			if err != nil {
-				return err
-			}
+	update := func(id1 string, id2 string, round int) {
+		if _, ok := lastRoundWith[id1]; !ok || !active[id2] {
+			return
+		}
+		if round > lastRoundWith[id1][id2] {
+			lastRoundWith[id1][id2] = round
+		}
+	}
 
-			_, err = db.Exec(
-				"UPDATE members SET last_round_with = $1 WHERE organization = $2 AND email = $3",
-				server.JSONB(bytes),
-				org,
-				member.Email,
-			)
-			if err != nil {
-				return err
-			}
+	for _, roundPair := range history {
+		ids := []string{roundPair.Pair.ID1, roundPair.Pair.ID2}
+		if roundPair.Pair.ExtraID != "" {
+			ids = append(ids, roundPair.Pair.ExtraID)
+		}
 
+		for _, id := range ids {
+			for _, otherID := range ids {
+				if id != otherID {
+					update(id, otherID, roundPair.Round)
+				}
+			}
 		}
 	}
 
-	fmt.Println("Done migrating to 'last round with' data structure in pairing algorithm!")
-	return nil
+	return lastRoundWith
 }
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	t.Log("Test that the SQL & data migrations in the repo are numbered from 1 w/o gaps & can all be reverted")
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) < len(dataMigrations)+1 {
+		t.Fatalf("expected SQL migrations as well as data migrations, got %d migrations", len(migrations))
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration %d at index %d, got %d", i+1, i, migration.Version)
+		}
+		if migration.Name == "" {
+			t.Errorf("migration %d has no name", migration.Version)
+		}
+		if migration.Up == nil || migration.Down == nil {
+			t.Errorf("migration %04d_%s is missing an up or a down", migration.Version, migration.Name)
+		}
+	}
+
+	if migrations[2].Name != "rebuild_last_round_with" {
+		t.Errorf("expected the LastRoundWith data migration to run right after the column is added, got %s", migrations[2].Name)
+	}
+}
+
+func TestComputeLastRoundWith(t *testing.T) {
+	t.Log("Test that LastRoundWith is rebuilt from pairs history, including extra members & gaps between rounds")
+
+	emails := []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "d@gmail.com"}
+	active := map[string]bool{
+		"a@gmail.com": true,
+		"b@gmail.com": true,
+		"c@gmail.com": true,
+		"d@gmail.com": false,
+	}
+	history := []RoundPair{
+		{Pair: Pair{ID1: "a@gmail.com", ID2: "b@gmail.com", ExtraID: "c@gmail.com"}, Round: 0},
+		{Pair: Pair{ID1: "a@gmail.com", ID2: "d@gmail.com"}, Round: 1},
+		// round 2 was cancelled, so there's a gap
+		{Pair: Pair{ID1: "a@gmail.com", ID2: "b@gmail.com"}, Round: 3},
+	}
+
+	lastRoundWith := computeLastRoundWith(emails, active, history)
+
+	expected := map[string]map[string]int{
+		"a@gmail.com": {"b@gmail.com": 3, "c@gmail.com": 0},
+		"b@gmail.com": {"a@gmail.com": 3, "c@gmail.com": 0},
+		"c@gmail.com": {"a@gmail.com": 0, "b@gmail.com": 0},
+		// inactive members keep their history w/ active members, but aren't candidates for anyone
+		"d@gmail.com": {"a@gmail.com": 1, "b@gmail.com": -1, "c@gmail.com": -1},
+	}
+
+	for email, partners := range expected {
+		if len(lastRoundWith[email]) != len(partners) {
+			t.Errorf("%s: expected %v, got %v", email, partners, lastRoundWith[email])
+			continue
+		}
+		for partner, round := range partners {
+			if lastRoundWith[email][partner] != round {
+				t.Errorf("%s's last round with %s: expected %d, got %d", email, partner, round, lastRoundWith[email][partner])
+			}
+		}
+	}
+}
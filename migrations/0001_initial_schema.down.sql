@@ -0,0 +1,4 @@
+DROP TABLE pairs;
+DROP TABLE rounds;
+DROP TABLE members;
+DROP TABLE organizations;
@@ -1,15 +1,12 @@
-DROP TABLE pairs;
-DROP TABLE rounds;
-DROP TABLE members;
-DROP TABLE organizations;
-
-CREATE TABLE organizations (
+-- the schema mealbot was originally deployed with; IF NOT EXISTS lets databases
+-- that were set up by hand be brought under migrations w/o losing data
+CREATE TABLE IF NOT EXISTS organizations (
     name VARCHAR PRIMARY KEY,
     admin VARCHAR NOT NULL CHECK(length(admin) > 0),
     cross_match_trait VARCHAR
 );
 
-CREATE TABLE members (
+CREATE TABLE IF NOT EXISTS members (
     organization VARCHAR REFERENCES organizations(name),
     email VARCHAR NOT NULL CHECK(length(email) > 0),
     name VARCHAR NOT NULL CHECK(length(name) > 0),
@@ -19,20 +16,15 @@ CREATE TABLE members (
     PRIMARY KEY (organization, email)
 );
 
-CREATE TABLE rounds (
+CREATE TABLE IF NOT EXISTS rounds (
     organization VARCHAR REFERENCES organizations(name),
     id INTEGER NOT NULL CHECK (id >= 0),
-    -- round dates are stored in UTC with accuracy up to seconds
-    -- when retrieved, it is formatted as a string in 'YYYY-MM-DDTHH:mm:ssZ',
-    -- the trailing Z indicating that that the datestring should be parsed 
-    -- as UTC time (& converted into local time if a client library wants to
-    -- do so e.g moment.js)
     scheduled_date TIMESTAMP NOT NULL,
     done BOOLEAN NOT NULL,
     PRIMARY KEY (organization, id)
 );
 
-CREATE TABLE pairs (
+CREATE TABLE IF NOT EXISTS pairs (
     organization VARCHAR REFERENCES organizations(name),
     id1 VARCHAR NOT NULL CHECK(length(id1) > 0),
     id2 VARCHAR NOT NULL CHECK(length(id2) > 0),
@@ -42,4 +34,4 @@ CREATE TABLE pairs (
     FOREIGN KEY (organization, round) REFERENCES rounds(organization, id),
     FOREIGN KEY (organization, id1) REFERENCES members(organization, email),
     FOREIGN KEY (organization, id2) REFERENCES members(organization, email)
-);
\ No newline at end of file
+);
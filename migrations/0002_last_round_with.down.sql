@@ -0,0 +1,2 @@
+ALTER TABLE members ADD COLUMN pair_counts JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE members DROP COLUMN last_round_with;
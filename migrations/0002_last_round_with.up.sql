@@ -0,0 +1,4 @@
+-- the pairing algorithm keeps track of the last round each member was grouped
+-- w/ every other member, instead of how many times; filled in by the next migration
+ALTER TABLE members ADD COLUMN IF NOT EXISTS last_round_with JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE members DROP COLUMN IF EXISTS pair_counts;
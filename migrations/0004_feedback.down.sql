@@ -0,0 +1,2 @@
+DROP TABLE feedback;
+ALTER TABLE organizations DROP COLUMN avoid_missed_pairs;
@@ -0,0 +1,18 @@
+-- when true, members whose last meeting didn't happen are less likely to be paired again
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS avoid_missed_pairs BOOLEAN NOT NULL DEFAULT false;
+
+-- one row per group per round; 'token' is embedded in the links sent in the
+-- pairing email, and the remaining columns are filled in when the group responds
+CREATE TABLE IF NOT EXISTS feedback (
+    token VARCHAR PRIMARY KEY,
+    organization VARCHAR REFERENCES organizations(name),
+    round INTEGER NOT NULL CHECK(round >= 0),
+    id1 VARCHAR NOT NULL,
+    id2 VARCHAR NOT NULL,
+    extraId VARCHAR,
+    met BOOLEAN,
+    rating INTEGER CHECK(rating BETWEEN 1 AND 5),
+    comment TEXT,
+    responded_at TIMESTAMP,
+    FOREIGN KEY (organization, round) REFERENCES rounds(organization, id)
+);
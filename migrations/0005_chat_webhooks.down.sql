@@ -0,0 +1,3 @@
+ALTER TABLE organizations DROP COLUMN send_emails;
+ALTER TABLE organizations DROP COLUMN chat_webhook_mode;
+ALTER TABLE organizations DROP COLUMN chat_webhook_url;
@@ -0,0 +1,4 @@
+-- Slack/Mattermost-compatible incoming webhook that new groups are posted to
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS chat_webhook_url VARCHAR;
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS chat_webhook_mode VARCHAR NOT NULL DEFAULT 'summary' CHECK(chat_webhook_mode IN ('group', 'summary'));
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS send_emails BOOLEAN NOT NULL DEFAULT true;
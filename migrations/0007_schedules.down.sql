@@ -0,0 +1,2 @@
+DROP TABLE schedules;
+ALTER TABLE rounds DROP COLUMN generated;
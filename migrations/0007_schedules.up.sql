@@ -0,0 +1,17 @@
+-- true if the round was materialized from the organization's recurring schedule
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS generated BOOLEAN NOT NULL DEFAULT false;
+
+-- recurring round schedule; upcoming rounds are materialized into 'rounds'
+-- up to 'horizon_days' ahead of the current date
+CREATE TABLE IF NOT EXISTS schedules (
+    organization VARCHAR PRIMARY KEY REFERENCES organizations(name),
+    -- subset of RFC 5545 recurrence rules e.g 'FREQ=WEEKLY;INTERVAL=2;BYDAY=TU'
+    rrule VARCHAR NOT NULL,
+    start_date DATE NOT NULL,
+    -- local time of day in 'timezone' e.g '12:00'
+    time_of_day VARCHAR NOT NULL,
+    timezone VARCHAR NOT NULL,
+    horizon_days INTEGER NOT NULL CHECK(horizon_days > 0),
+    -- dates (YYYY-MM-DD) to skip e.g holidays
+    exclusions JSONB NOT NULL
+);
@@ -0,0 +1,10 @@
+-- cancelled rounds didn't exist before, so they're deleted; any pairs they had were
+-- already removed when they were cancelled
+DELETE FROM feedback WHERE (organization, round) IN (SELECT organization, id FROM rounds WHERE status = 'cancelled');
+DELETE FROM rounds WHERE status = 'cancelled';
+
+ALTER TABLE rounds DROP COLUMN next_attempt_at;
+ALTER TABLE rounds DROP COLUMN last_attempt_at;
+ALTER TABLE rounds DROP COLUMN last_error;
+ALTER TABLE rounds DROP COLUMN attempts;
+ALTER TABLE rounds DROP COLUMN status;
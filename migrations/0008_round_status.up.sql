@@ -0,0 +1,10 @@
+-- cancelled rounds are kept (rather than deleted) so round IDs never change
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS status VARCHAR NOT NULL DEFAULT 'scheduled' CHECK(status IN ('scheduled', 'running', 'done', 'failed', 'cancelled'));
+-- no. of times the scheduler attempted the round; failed rounds are retried
+-- w/ exponential backoff until 'next_attempt_at'
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS last_attempt_at TIMESTAMP;
+ALTER TABLE rounds ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP;
+
+UPDATE rounds SET status = 'done' WHERE done = true;
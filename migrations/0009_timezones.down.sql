@@ -0,0 +1,2 @@
+ALTER TABLE rounds ALTER COLUMN scheduled_date TYPE TIMESTAMP USING scheduled_date AT TIME ZONE 'utc';
+ALTER TABLE organizations DROP COLUMN timezone;
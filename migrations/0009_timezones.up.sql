@@ -0,0 +1,7 @@
+-- IANA time zone that round dates w/o an explicit offset are interpreted in
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS timezone VARCHAR NOT NULL DEFAULT 'UTC';
+
+-- round dates are stored as absolute instants; when retrieved, they are
+-- formatted in RFC 3339 w/ the offset of the organization's time zone
+-- e.g '2019-10-01T12:00:00-04:00'. Existing dates were stored in UTC
+ALTER TABLE rounds ALTER COLUMN scheduled_date TYPE TIMESTAMPTZ USING scheduled_date AT TIME ZONE 'utc';
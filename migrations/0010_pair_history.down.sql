@@ -0,0 +1,13 @@
+ALTER TABLE members ADD COLUMN IF NOT EXISTS last_round_with JSONB NOT NULL DEFAULT '{}';
+
+-- every member gets an entry for every other active member, -1 if they've never met
+UPDATE members m SET last_round_with = COALESCE((
+    SELECT jsonb_object_agg(o.email, COALESCE(h.last_round, -1))
+    FROM members o
+    LEFT JOIN pair_history h ON h.organization = o.organization AND (
+        (h.member1 = m.email AND h.member2 = o.email) OR (h.member1 = o.email AND h.member2 = m.email)
+    )
+    WHERE o.organization = m.organization AND o.email <> m.email AND o.active
+), '{}');
+
+DROP TABLE IF EXISTS pair_history;
@@ -0,0 +1,31 @@
+-- the last round each pair of members were grouped together, one row per pair
+-- w/ member1 sorting before member2 (bytewise, like Go strings), replaces the
+-- last_round_with map that was rewritten for every member after every round
+CREATE TABLE IF NOT EXISTS pair_history (
+    organization VARCHAR NOT NULL,
+    member1 VARCHAR NOT NULL,
+    member2 VARCHAR NOT NULL,
+    last_round INTEGER NOT NULL CHECK(last_round >= 0),
+    PRIMARY KEY (organization, member1, member2),
+    CHECK(member1 COLLATE "C" < member2 COLLATE "C"),
+    FOREIGN KEY (organization, member1) REFERENCES members(organization, email),
+    FOREIGN KEY (organization, member2) REFERENCES members(organization, email)
+);
+
+-- the primary key covers lookups by member1, this covers lookups by member2
+CREATE INDEX IF NOT EXISTS pair_history_member2_idx ON pair_history (organization, member2);
+
+INSERT INTO pair_history (organization, member1, member2, last_round)
+SELECT organization, LEAST(a COLLATE "C", b COLLATE "C"), GREATEST(a COLLATE "C", b COLLATE "C"), MAX(round)
+FROM (
+    SELECT organization, id1 AS a, id2 AS b, round FROM pairs
+    UNION ALL
+    SELECT organization, id1, extraId, round FROM pairs WHERE extraId IS NOT NULL AND extraId <> ''
+    UNION ALL
+    SELECT organization, id2, extraId, round FROM pairs WHERE extraId IS NOT NULL AND extraId <> ''
+) grouped
+WHERE a <> b
+GROUP BY organization, LEAST(a COLLATE "C", b COLLATE "C"), GREATEST(a COLLATE "C", b COLLATE "C")
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE members DROP COLUMN IF EXISTS last_round_with;
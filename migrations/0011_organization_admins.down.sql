@@ -0,0 +1,10 @@
+ALTER TABLE organizations ADD COLUMN admin VARCHAR;
+
+UPDATE organizations o SET admin = a.email
+FROM organization_admins a
+WHERE a.organization = o.name AND a.role = 'owner';
+
+ALTER TABLE organizations ALTER COLUMN admin SET NOT NULL;
+ALTER TABLE organizations ADD CHECK(length(admin) > 0);
+
+DROP TABLE IF EXISTS organization_admins;
@@ -0,0 +1,18 @@
+-- organizations can have several admins; each one is an owner (exactly one per
+-- organization), an admin, or a viewer who can only see members, rounds & pairs
+CREATE TABLE IF NOT EXISTS organization_admins (
+    organization VARCHAR NOT NULL REFERENCES organizations(name),
+    email VARCHAR NOT NULL CHECK(length(email) > 0),
+    role VARCHAR NOT NULL CHECK(role IN ('owner', 'admin', 'viewer')),
+    PRIMARY KEY (organization, email)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS organization_admins_owner_idx ON organization_admins (organization) WHERE role = 'owner';
+CREATE INDEX IF NOT EXISTS organization_admins_email_idx ON organization_admins (email);
+
+-- whoever created the organization owns it
+INSERT INTO organization_admins (organization, email, role)
+SELECT name, admin, 'owner' FROM organizations
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE organizations DROP COLUMN admin;
@@ -0,0 +1,16 @@
+-- keys for tools that access an organization w/o logging in; only a SHA-256
+-- hash of each key is stored, along w/ a prefix to tell keys apart
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    organization VARCHAR NOT NULL REFERENCES organizations(name),
+    name VARCHAR NOT NULL CHECK(length(name) > 0),
+    prefix VARCHAR NOT NULL,
+    key_hash VARCHAR NOT NULL UNIQUE,
+    scope VARCHAR NOT NULL CHECK(scope IN ('read', 'write')),
+    created_by VARCHAR NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_organization_idx ON api_keys (organization);
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// OpenAPIPath : OpenAPI 3 document describing every route of the versioned API. Like MigrationsDir, it's
+	// read at runtime, so it has to be deployed alongside the binary
+	OpenAPIPath = "./openapi.json"
+)
+
+// OpenAPIHandler : HTTP handler for the API's OpenAPI document, for the frontend & scripts to generate clients
+// from. It's served as is rather than in a response envelope, so that tools can read it
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	function := "OpenAPIHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	bytes, err := ioutil.ReadFile(OpenAPIPath)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
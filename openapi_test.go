@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIMembersCSV : Roster uploaded by TestOpenAPIContract. The handler saves it to CSVPath, so it's removed
+// afterwards
+const openAPIMembersCSV = "openapi_contract_test.csv"
+
+type openAPISpec map[string]interface{}
+
+func loadOpenAPISpec(t *testing.T) openAPISpec {
+	bytes, err := ioutil.ReadFile(OpenAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var spec openAPISpec
+	err = json.Unmarshal(bytes, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return spec
+}
+
+// operations : Every operation in the spec as 'METHOD /path', sorted
+func (spec openAPISpec) operations() []string {
+	operations := []string{}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			operations = append(operations, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(operations)
+
+	return operations
+}
+
+// resolve : Follow a '$ref' to somewhere else in the spec
+func (spec openAPISpec) resolve(node map[string]interface{}) map[string]interface{} {
+	ref, ok := node["$ref"].(string)
+	if !ok {
+		return node
+	}
+
+	resolved := map[string]interface{}(spec)
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		resolved = resolved[key].(map[string]interface{})
+	}
+
+	return spec.resolve(resolved)
+}
+
+// responseContent : Media types (& their schemas) of the response to an operation w/ the given status, falling
+// back to 'default'
+func (spec openAPISpec) responseContent(method string, path string, status int) (map[string]interface{}, error) {
+	item, ok := spec["paths"].(map[string]interface{})[path].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s isn't in the spec", path)
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s isn't in the spec", method, path)
+	}
+
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[fmt.Sprint(status)].(map[string]interface{})
+	if !ok {
+		response, ok = responses["default"].(map[string]interface{})
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s %s has no response for %d", method, path, status)
+	}
+
+	return spec.resolve(response)["content"].(map[string]interface{}), nil
+}
+
+// requestContentType : Bodies of test cases are JSON, unless they're a multipart upload or a submitted form
+func requestContentType(body string) string {
+	if strings.HasPrefix(body, "--") {
+		return "multipart/form-data; boundary=" + body[2:strings.Index(body, "\r\n")]
+	}
+	if body != "" && !strings.HasPrefix(body, "{") {
+		return "application/x-www-form-urlencoded"
+	}
+	return "application/json"
+}
+
+// validate : Where 'value' doesn't match the schema. Only the parts of JSON Schema that the spec uses are
+// supported
+func (spec openAPISpec) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	schema = spec.resolve(schema)
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return []string{at + ": is null"}
+	}
+
+	problems := []string{}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %v", at, value)}
+		}
+
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := object[key.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is missing", at, key))
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, property := range object {
+			if propertySchema, ok := properties[key].(map[string]interface{}); ok {
+				problems = append(problems, spec.validate(propertySchema, property, at+"."+key)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				problems = append(problems, spec.validate(additional, property, at+"."+key)...)
+			} else if schema["additionalProperties"] == false {
+				problems = append(problems, fmt.Sprintf("%s: '%s' isn't in the spec", at, key))
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %v", at, value)}
+		}
+
+		items := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			problems = append(problems, spec.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected a string, got %v", at, value)}
+		}
+
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, allowed := range enum {
+				found = found || allowed == str
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: '%s' isn't one of %v", at, str, enum))
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return []string{fmt.Sprintf("%s: expected an integer, got %v", at, value)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{fmt.Sprintf("%s: expected a number, got %v", at, value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expected a boolean, got %v", at, value)}
+		}
+	}
+
+	return problems
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	t.Log("Test that every route is in the OpenAPI spec, and that handlers respond the way the spec says")
+
+	spec := loadOpenAPISpec(t)
+
+	app := &App{Store: NewMemoryStore()}
+	router := newAPIRouter(app, Middleware{
+		MiddlewareHandlers: [](func(handler http.Handler) http.Handler){
+			func(handler http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handler.ServeHTTP(w, withCaller(r, "admin@gmail.com"))
+				})
+			},
+		},
+	})
+
+	routes := router.Routes()
+	operations := spec.operations()
+	if strings.Join(routes, "\n") != strings.Join(operations, "\n") {
+		t.Fatalf("Expected the routes to match the spec\nroutes:\n%s\n\nspec:\n%s", strings.Join(routes, "\n"), strings.Join(operations, "\n"))
+	}
+
+	err := createOrganization(app.Store, "test", "admin@gmail.com", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Member{}
+	for _, letter := range strings.Split("abcd", "") {
+		members = append(members, Member{
+			Organization: "test",
+			Email:        letter + "@gmail.com",
+			Name:         "Person " + strings.ToUpper(letter),
+			Metadata:     map[string]string{"year": "2019"},
+		})
+	}
+	err = saveMembers(app.Store, "test", members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.Store.AddRound("test", time.Date(2019, 1, 2, 18, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runPairingRound(app.Store, "test", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var token string
+	for feedbackToken := range app.Store.(*MemoryStore).feedback {
+		token = feedbackToken
+		break
+	}
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	file, err := form.CreateFormFile("members", openAPIMembersCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("name,email,year\nPerson A,a@gmail.com,2019\nPerson B,b@gmail.com,2019\n"))
+	form.Close()
+	defer os.Remove(filepath.Join(CSVPath, openAPIMembersCSV))
+
+	cases := []struct {
+		method string
+		path   string
+		target string
+		body   string
+		status int
+	}{
+		{"GET", "/orgs", "/orgs", "", http.StatusOK},
+		{"POST", "/orgs", "/orgs", `{"org": "other"}`, http.StatusCreated},
+		{"POST", "/orgs", "/orgs", `{"org": ""}`, http.StatusBadRequest},
+		{"POST", "/orgs", "/orgs", `{"org": "x", "timezone": "Mars/Olympus_Mons"}`, http.StatusBadRequest},
+		{"POST", "/orgs", "/orgs", `{"org": "other"}`, http.StatusConflict},
+		{"GET", "/orgs/{org}/members", "/orgs/test/members", "", http.StatusOK},
+		{"GET", "/orgs/{org}/admins", "/orgs/test/admins", "", http.StatusOK},
+		{"POST", "/orgs/{org}/admins", "/orgs/test/admins", `{"email": "v@gmail.com", "role": "viewer"}`, http.StatusOK},
+		{"POST", "/orgs/{org}/admins", "/orgs/test/admins", `{"email": "v@gmail.com", "role": "owner"}`, http.StatusBadRequest},
+		{"DELETE", "/orgs/{org}/admins/{email}", "/orgs/test/admins/v@gmail.com", "", http.StatusOK},
+		{"DELETE", "/orgs/{org}/admins/{email}", "/orgs/test/admins/v@gmail.com", "", http.StatusNotFound},
+		{"POST", "/orgs/{org}/apikeys", "/orgs/test/apikeys", `{"name": "sync", "scope": "write"}`, http.StatusCreated},
+		{"GET", "/orgs/{org}/apikeys", "/orgs/test/apikeys", "", http.StatusOK},
+		{"DELETE", "/orgs/{org}/apikeys/{id}", "/orgs/test/apikeys/1", "", http.StatusOK},
+		{"GET", "/orgs/{org}/apikeys", "/orgs/test/apikeys", "", http.StatusOK},
+		{"POST", "/orgs/{org}/crossmatchtrait", "/orgs/test/crossmatchtrait", `{"trait": "year"}`, http.StatusOK},
+		{"GET", "/orgs/{org}/timezone", "/orgs/test/timezone", "", http.StatusOK},
+		{"POST", "/orgs/{org}/timezone", "/orgs/test/timezone", `{"timezone": "Asia/Jakarta"}`, http.StatusOK},
+		{"POST", "/orgs/{org}/rounds", "/orgs/test/rounds?round=2019-01-09T18:30:00Z", "", http.StatusCreated},
+		{"GET", "/orgs/{org}/rounds", "/orgs/test/rounds", "", http.StatusOK},
+		{"GET", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/0", "", http.StatusOK},
+		{"GET", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/9", "", http.StatusNotFound},
+		{"GET", "/orgs/{org}/rounds/{roundId}/groups", "/orgs/test/rounds/0/groups", "", http.StatusOK},
+		{"PATCH", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/1?round=2019-01-10T18:30:00Z", "", http.StatusOK},
+		{"PATCH", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/x?round=2019-01-10T18:30:00Z", "", http.StatusBadRequest},
+		{"DELETE", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/1", "", http.StatusOK},
+		{"DELETE", "/orgs/{org}/rounds/{roundId}", "/orgs/test/rounds/0", "", http.StatusConflict},
+		{"GET", "/orgs/{org}/pairs", "/orgs/test/pairs", "", http.StatusOK},
+		{"GET", "/orgs/{org}/pairs", "/orgs/test/pairs?member=a@gmail.com&limit=1", "", http.StatusOK},
+		{"GET", "/orgs/{org}/pairs", "/orgs/test/pairs?limit=0", "", http.StatusBadRequest},
+		{"GET", "/scheduler", "/scheduler", "", http.StatusOK},
+		{"GET", "/orgs/{org}/chatwebhook", "/orgs/test/chatwebhook", "", http.StatusOK},
+		{"POST", "/orgs/{org}/chatwebhook", "/orgs/test/chatwebhook", `{"mode": "group", "sendEmails": true}`, http.StatusOK},
+		{"POST", "/orgs/{org}/chatwebhook", "/orgs/test/chatwebhook", `{"mode": "thread"}`, http.StatusBadRequest},
+		{"POST", "/orgs/{org}/avoidmissedpairs", "/orgs/test/avoidmissedpairs", `{"avoid": true}`, http.StatusOK},
+		{"GET", "/feedback", "/feedback?token=" + token + "&met=yes", "", http.StatusOK},
+		{"GET", "/feedback", "/feedback?token=x", "", http.StatusNotFound},
+		{"POST", "/feedback", "/feedback?token=" + token, "met=yes&rating=5&comment=Lunch", http.StatusOK},
+		{"POST", "/feedback", "/feedback?token=" + token, "rating=5", http.StatusBadRequest},
+		{"POST", "/feedback", "/feedback?token=" + token, `{"met": false}`, http.StatusOK},
+		{"POST", "/feedback", "/feedback?token=x", `{"met": false}`, http.StatusNotFound},
+		{"GET", "/orgs/{org}/feedbackstats", "/orgs/test/feedbackstats", "", http.StatusOK},
+		{"POST", "/orgs/{org}/history/rebuild", "/orgs/test/history/rebuild?dryRun=true", "", http.StatusOK},
+		{"POST", "/orgs/{org}/webhooks", "/orgs/test/webhooks", `{"url": "https://example.com/hook", "secret": "shhh"}`, http.StatusCreated},
+		{"POST", "/orgs/{org}/webhooks", "/orgs/test/webhooks", `{"url": "example.com/hook", "secret": "shhh"}`, http.StatusBadRequest},
+		{"GET", "/orgs/{org}/webhooks", "/orgs/test/webhooks", "", http.StatusOK},
+		{"POST", "/orgs/{org}/schedule", "/orgs/test/schedule", `{"rrule": "FREQ=WEEKLY;BYDAY=TU", "start": "2019-01-01", "time": "12:00"}`, http.StatusOK},
+		{"POST", "/orgs/{org}/schedule", "/orgs/test/schedule", `{"rrule": "FREQ=HOURLY", "start": "2019-01-01", "time": "12:00"}`, http.StatusBadRequest},
+		{"GET", "/orgs/{org}/schedule", "/orgs/test/schedule", "", http.StatusOK},
+		{"GET", "/orgs/{org}/webhooks/deliveries", "/orgs/test/webhooks/deliveries", "", http.StatusOK},
+		{"DELETE", "/orgs/{org}/schedule", "/orgs/test/schedule", "", http.StatusOK},
+		{"GET", "/orgs/{org}/schedule", "/orgs/test/schedule", "", http.StatusNotFound},
+		{"DELETE", "/orgs/{org}/webhooks/{id}", "/orgs/test/webhooks/1", "", http.StatusOK},
+		{"DELETE", "/orgs/{org}/webhooks/{id}", "/orgs/test/webhooks/1", "", http.StatusNotFound},
+		{"POST", "/orgs/{org}/rounds/{roundId}/rollback", "/orgs/test/rounds/0/rollback", "", http.StatusBadRequest},
+		{"POST", "/orgs/{org}/rounds/{roundId}/rollback", "/orgs/test/rounds/0/rollback?round=2019-01-09T18:30:00Z", "", http.StatusBadRequest},
+		{"POST", "/orgs/{org}/rounds/{roundId}/rollback", "/orgs/test/rounds/0/rollback?round=2100-01-09T18:30:00Z&notify=true", "", http.StatusOK},
+		{"POST", "/orgs/{org}/rounds/{roundId}/rollback", "/orgs/test/rounds/0/rollback?round=2100-01-09T18:30:00Z", "", http.StatusConflict},
+		{"POST", "/orgs/{org}/members", "/orgs/test/members", upload.String(), http.StatusCreated},
+		{"POST", "/orgs/{org}/admins/transfer", "/orgs/test/admins/transfer", `{"email": "new@gmail.com"}`, http.StatusOK},
+	}
+
+	called := map[string]bool{}
+	for _, c := range cases {
+		operation := c.method + " " + c.path
+		called[operation] = true
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, APIPrefix+c.target, strings.NewReader(c.body))
+		r.Header.Set("Content-Type", requestContentType(c.body))
+		router.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", c.method, c.target, c.status, w.Code, w.Body.String())
+			continue
+		}
+
+		content, err := spec.responseContent(c.method, c.path, c.status)
+		if err != nil {
+			t.Errorf("%s %s: %s", c.method, c.target, err)
+			continue
+		}
+
+		mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Errorf("%s %s: %s", c.method, c.target, err)
+			continue
+		}
+		if _, ok := content[mediaType]; !ok {
+			t.Errorf("%s %s: the spec doesn't allow '%s' responses", c.method, c.target, mediaType)
+			continue
+		}
+		// pages are only checked for their content type
+		if mediaType != "application/json" {
+			continue
+		}
+		schema := content[mediaType].(map[string]interface{})["schema"].(map[string]interface{})
+
+		var body interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil {
+			t.Errorf("%s %s: %s", c.method, c.target, err)
+			continue
+		}
+
+		for _, problem := range spec.validate(schema, body, "body") {
+			t.Errorf("%s %s: %s", c.method, c.target, problem)
+		}
+	}
+
+	for _, operation := range operations {
+		if !called[operation] {
+			t.Errorf("%s isn't covered by the contract test", operation)
+		}
+	}
+}
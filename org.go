@@ -7,20 +7,32 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-
-	"github.com/johnamadeo/server"
+	"time"
 )
 
+// DefaultTimeZone : Time zone of organizations that haven't set one
+const DefaultTimeZone = "UTC"
+
+// ErrOrganizationExists : Returned when creating an organization w/ a name that's already taken
+var ErrOrganizationExists = errors.New("An organization with this name already exists")
+
 // Organization :
 type Organization struct {
 	Name            string
 	Admin           string
 	CrossMatchTrait string
+	TimeZone        string
 }
 
 // CreateOrganizationRequestBody :
 type CreateOrganizationRequestBody struct {
 	Organization string `json:"org"`
+	TimeZone     string `json:"timezone"`
+}
+
+// TimeZoneRequestBody : IANA time zone e.g "America/New_York"
+type TimeZoneRequestBody struct {
+	TimeZone string `json:"timezone"`
 }
 
 // SetCrossMatchTraitRequestBody :
@@ -28,8 +40,8 @@ type SetCrossMatchTraitRequestBody struct {
 	Trait string `json:"trait"`
 }
 
-// GetOrganizationsHandler : HTTP Handler for fetching all the organizations an admin manages
-func GetOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+// GetOrganizationsHandler : HTTP Handler for fetching all the organizations the caller has a role in
+func (app *App) GetOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
 	function := "GetOrganizationsHandler"
 	if r.Method != "GET" && r.Method != "" {
 		LogAndWriteErr(
@@ -41,35 +53,24 @@ func GetOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	queries, ok := r.URL.Query()["admin"]
-	if !ok || len(queries) > 1 {
-		LogAndWriteErr(
-			w,
-			errors.New("request query parameters must contain 'admin'"),
-			http.StatusBadRequest,
-			function,
-		)
-		return
-	}
-
-	organizations, err := getOrganizations(queries[0])
+	admin, err := getAdmin(r)
 	if err != nil {
-		LogAndWriteStatusInternalServerError(w, err, function)
+		LogAndWriteErr(w, err, http.StatusForbidden, function)
 		return
 	}
 
-	resp := map[string][]string{"orgs": organizations}
-	bytes, err := json.Marshal(resp)
+	organizations, err := app.Store.GetOrganizations(admin)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(w, bytes, http.StatusOK, function)
+	resp := map[string][]string{"orgs": organizations}
+	LogAndWrite(w, resp, http.StatusOK, function)
 }
 
 // CreateOrganizationHandler : HTTP handler for creating a new organization
-func CreateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) CreateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
 	function := "CreateOrganizationHandler"
 	if r.Method != "POST" {
 		LogAndWriteErr(
@@ -95,36 +96,40 @@ func CreateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	queries, ok := r.URL.Query()["admin"]
-	if !ok || len(queries) > 1 {
-		LogAndWriteErr(
-			w,
-			errors.New("request query parameters must contain 'admin'"),
-			http.StatusBadRequest,
-			function,
-		)
+	admin, err := getAdmin(r)
+	if err != nil {
+		LogAndWriteErr(w, err, http.StatusForbidden, function)
 		return
 	}
-	admin := queries[0]
 
 	fmt.Println(body.Organization, admin)
 
-	err = createOrganization(body.Organization, admin)
+	err = validateOrganization(body.Organization, body.TimeZone)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = createOrganization(app.Store, body.Organization, admin, body.TimeZone)
+	if err == ErrOrganizationExists {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(
+	LogAndWriteMessage(
 		w,
-		server.StrToBytes("Successfully created new organization"),
+		"Successfully created new organization",
 		http.StatusCreated,
 		function,
 	)
 }
 
 // CrossMatchTraitHandler : HTTP handler for changing or setting a cross match trait for an organization
-func CrossMatchTraitHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) CrossMatchTraitHandler(w http.ResponseWriter, r *http.Request) {
 	function := "CrossMatchTraitHandler"
 	if r.Method != "POST" {
 		LogAndWriteErr(w, errors.New("Only POST requests are allowed at this route"), http.StatusMethodNotAllowed, function)
@@ -137,6 +142,10 @@ func CrossMatchTraitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
 	bytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		LogAndWriteErr(w, errors.New("Malformed body."), http.StatusBadRequest, function)
@@ -151,31 +160,88 @@ func CrossMatchTraitHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = setCrossMatchTrait(orgname, body.Trait)
+	err = app.Store.SetCrossMatchTrait(orgname, body.Trait)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(server.ErrToBytes(err))
+		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(w, server.StrToBytes("Successfully set the cross match trait"), http.StatusCreated, function)
+	LogAndWriteMessage(w, "Successfully set the cross match trait", http.StatusOK, function)
 }
 
-// GetOrganizations :
-func getOrganizations(admin string) ([]string, error) {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+// TimeZoneHandler : HTTP handler for retrieving or changing the time zone an organization's rounds are scheduled in
+func (app *App) TimeZoneHandler(w http.ResponseWriter, r *http.Request) {
+	function := "TimeZoneHandler"
+	if r.Method != "GET" && r.Method != "POST" {
+		LogAndWriteErr(w, errors.New("Only GET and POST requests are allowed at this route"), http.StatusMethodNotAllowed, function)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
 	if err != nil {
-		return []string{}, err
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	// viewers can see the time zone rounds are shown in, but not change it
+	requiredRole := RoleAdmin
+	if r.Method == "GET" {
+		requiredRole = RoleViewer
+	}
+	if !app.authorizeOrganization(w, r, orgname, requiredRole, function) {
+		return
+	}
+
+	if r.Method == "GET" {
+		loc, err := app.Store.GetOrganizationLocation(orgname)
+		if err != nil {
+			LogAndWriteStatusInternalServerError(w, err, function)
+			return
+		}
+
+		LogAndWrite(w, TimeZoneRequestBody{TimeZone: loc.String()}, http.StatusOK, function)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Malformed body."), http.StatusBadRequest, function)
+		return
+	}
+	defer r.Body.Close()
+
+	var body TimeZoneRequestBody
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	_, err = loadLocation(body.TimeZone)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.SetTimeZone(orgname, body.TimeZone)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
 	}
 
+	LogAndWriteMessage(w, "Successfully set the time zone", http.StatusOK, function)
+}
+
+// GetOrganizations : Organizations that the user has any role in
+func getOrganizations(db *sql.DB, user string) ([]string, error) {
 	rows, err := db.Query(
-		"SELECT name FROM organizations WHERE admin = $1",
-		admin,
+		"SELECT organization FROM organization_admins WHERE email = $1 ORDER BY organization",
+		user,
 	)
 	if err != nil {
 		return []string{}, err
 	}
+	defer rows.Close()
 
 	organizations := []string{}
 	for rows.Next() {
@@ -191,52 +257,83 @@ func getOrganizations(admin string) ([]string, error) {
 	return organizations, nil
 }
 
-func createOrganization(name string, admin string) error {
-	if name == "" {
-		return errors.New("Organization name cannot be an empty string")
+// getAllOrganizationsFromDB : Every organization's name, e.g for commands that run across all of them
+func getAllOrganizationsFromDB(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM organizations ORDER BY name")
+	if err != nil {
+		return []string{}, err
 	}
+	defer rows.Close()
 
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return err
+	organizations := []string{}
+	for rows.Next() {
+		var organization string
+		err := rows.Scan(&organization)
+		if err != nil {
+			return []string{}, err
+		}
+
+		organizations = append(organizations, organization)
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO organizations (name, admin) VALUES ($1, $2)",
-		name,
-		admin,
-	)
+	return organizations, rows.Err()
+}
+
+// getAdmin : The caller is always the admin. The 'admin' query parameter is still accepted from older clients,
+// but only if it's the caller. API keys belong to an organization rather than a user, so they have no admin
+func getAdmin(r *http.Request) (string, error) {
+	if _, ok := getAPIKey(r); ok {
+		return "", ErrAPIKeyNotAllowed
+	}
+
+	caller, ok := getCaller(r)
+	if !ok {
+		return "", errors.New("Request is not authenticated")
+	}
+
+	queries, ok := r.URL.Query()["admin"]
+	if ok && (len(queries) > 1 || queries[0] != caller) {
+		return "", errors.New("'admin' must be the authenticated user")
+	}
+
+	return caller, nil
+}
+
+func createOrganization(store Store, name string, admin string, timezone string) error {
+	err := validateOrganization(name, timezone)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if timezone == "" {
+		timezone = DefaultTimeZone
+	}
+
+	return store.CreateOrganization(Organization{Name: name, Admin: admin, TimeZone: timezone})
 }
 
-// GetCrossMatchTrait : Placeholder
-func GetCrossMatchTrait(orgname string) (string, error) {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return "", err
+// validateOrganization : An empty time zone is valid, since it defaults to DefaultTimeZone
+func validateOrganization(name string, timezone string) error {
+	if name == "" {
+		return errors.New("Organization name cannot be an empty string")
 	}
 
-	rows, err := db.Query(
-		"SELECT cross_match_trait FROM organizations WHERE name = $1",
-		orgname,
-	)
-	if err != nil {
-		return "", err
+	if timezone == "" {
+		return nil
 	}
+	_, err := loadLocation(timezone)
+	return err
+}
 
+// GetCrossMatchTrait : Placeholder
+func GetCrossMatchTrait(db *sql.DB, orgname string) (string, error) {
 	var crossMatchTraitSQL sql.NullString
-	for rows.Next() {
-		err := rows.Scan(&crossMatchTraitSQL)
-		if err != nil {
-			return "", err
-		}
-		break
+	err := db.QueryRow(
+		"SELECT cross_match_trait FROM organizations WHERE name = $1",
+		orgname,
+	).Scan(&crossMatchTraitSQL)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
 	}
 
 	crossMatchTrait := ""
@@ -247,16 +344,47 @@ func GetCrossMatchTrait(orgname string) (string, error) {
 	return crossMatchTrait, nil
 }
 
-func setCrossMatchTrait(orgname string, crossMatchTrait string) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+func setCrossMatchTrait(db *sql.DB, orgname string, crossMatchTrait string) error {
+	_, err := db.Exec(
+		"UPDATE organizations SET cross_match_trait = $1 WHERE name = $2",
+		crossMatchTrait,
+		orgname,
+	)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(
-		"UPDATE organizations SET cross_match_trait = $1 WHERE name = $2",
-		crossMatchTrait,
+	return nil
+}
+
+// loadLocation : Load an IANA time zone, w/ an error message fit for API clients
+func loadLocation(timezone string) (*time.Location, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" {
+		return nil, fmt.Errorf("'%s' is not a valid IANA time zone (e.g America/New_York)", timezone)
+	}
+
+	return loc, nil
+}
+
+// getOrganizationLocation : Time zone that the organization's rounds are scheduled in
+func getOrganizationLocation(db *sql.DB, orgname string) (*time.Location, error) {
+	timezone := DefaultTimeZone
+	err := db.QueryRow(
+		"SELECT timezone FROM organizations WHERE name = $1",
+		orgname,
+	).Scan(&timezone)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return loadLocation(timezone)
+}
+
+func setTimeZone(db *sql.DB, orgname string, timezone string) error {
+	_, err := db.Exec(
+		"UPDATE organizations SET timezone = $1 WHERE name = $2",
+		timezone,
 		orgname,
 	)
 	if err != nil {
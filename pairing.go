@@ -1,15 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/johnamadeo/server"
 	mailgun "github.com/mailgun/mailgun-go"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -19,10 +21,16 @@ const (
 	RecentRoundRange = 5
 	// EmailIntro : Text to put in the beginning of the email body
 	EmailIntro = "Your Mealbot group this week is:"
+	// EmailFeedbackPrompt : Text asking the group to report whether they met
+	EmailFeedbackPrompt = "Once you've had a chance to meet (or not), let us know by clicking one of the links below:"
 	// EmailFooter : Text to put at the end of the email body
 	EmailFooter = "Feel free to reply all in this thread for scheduling. I'm a robot, so I can only read 1's and 0's.\n\n Sent by your friendly neighborhood Mealbot! Learn more about me at https://mealbot-web.herokuapp.com"
 	// EmailSubject : Subject of the email
 	EmailSubject = "Your new Mealbot group"
+	// DisregardEmailSubject : Subject of the email sent when a round is rolled back
+	DisregardEmailSubject = "Please disregard your latest Mealbot group"
+	// DisregardEmailText : Body of the email sent when a round is rolled back
+	DisregardEmailText = "Sorry! The Mealbot group we sent you most recently was made by mistake, so please disregard it. We'll send you a new group soon.\n\n Sent by your friendly neighborhood Mealbot! Learn more about me at https://mealbot-web.herokuapp.com"
 )
 
 // Pair :
@@ -104,6 +112,8 @@ type MinimalMember struct {
 	Name          string
 	Trait         string
 	LastRoundWith map[string]int
+	// MissedWith : partners whose last meeting w/ this member was reported as not having happened
+	MissedWith map[string]bool
 }
 
 // MembersMap :
@@ -167,7 +177,9 @@ func runPairingAlgorithm(members MembersMap, roundNum int, genRandomInt RandomIn
 					continue
 				}
 
-				notRecentlyMatched := lastRound == -1 || round.Number-lastRound > RecentRoundRange
+				// members who didn't meet last time are treated as if they were recently matched
+				notRecentlyMatched := (lastRound == -1 || round.Number-lastRound > RecentRoundRange) &&
+					!member.MissedWith[candidateID]
 				hasDifferentTraits := member.Trait == members[candidateID].Trait
 
 				switch {
@@ -208,40 +220,82 @@ func runPairingAlgorithm(members MembersMap, roundNum int, genRandomInt RandomIn
 	return members, round
 }
 
-func runPairingRound(orgname string, roundNum int, testMode bool) error {
-	members, err := getMinimalMembersFromDB(orgname)
+// runPairingRound : The round is saved (& marked done) before anyone is notified, so a round whose groups went
+// out is never paired again. Failing to notify is only logged, since retrying would pair everyone differently
+func runPairingRound(store Store, orgname string, roundNum int, testMode bool) error {
+	members, err := getMinimalMembers(store, orgname)
+	if err != nil {
+		return err
+	}
+
+	webhook, err := store.GetChatWebhook(orgname)
 	if err != nil {
 		return err
 	}
 
 	members, round := runPairingAlgorithm(members, roundNum, rand.Intn)
 
-	if !testMode {
-		err = sendEmails(orgname, round, members)
-		if err != nil {
-			return err
-		}
+	tokens, err := newFeedbackTokens(round)
+	if err != nil {
+		return err
 	}
 
-	err = saveRoundInDB(round, members, orgname)
+	err = store.SaveRound(orgname, round, tokens)
 	if err != nil {
 		return err
 	}
 
+	if !testMode {
+		notifyRound(orgname, webhook, round, members, tokens)
+		store.EmitEvent(orgname, EventRoundCompleted, RoundEventData{Round: round.Number, Groups: roundEventGroups(round)})
+	}
+
 	return nil
 }
 
-func sendEmails(orgname string, round Round, members MembersMap) error {
+// notifyRound : Email the groups and/or post them to the organization's chat webhook
+func notifyRound(orgname string, webhook ChatWebhook, round Round, members MembersMap, tokens map[Pair]string) {
+	logger := log.WithFields(log.Fields{
+		"logger":       "logrus",
+		"function":     "notifyRound",
+		"organization": orgname,
+		"round":        round.Number,
+	})
+
+	if webhook.SendEmails {
+		err := sendEmails(orgname, round, members, tokens)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+
+	if webhook.URL != "" {
+		err := sendChatMessages(webhook, round, members)
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// sendEmails : Every group is emailed, even if emailing an earlier one failed
+func sendEmails(orgname string, round Round, members MembersMap, tokens map[Pair]string) error {
+	numFailed := 0
+	var lastErr error
 	for pair := range round.Pairs {
 		toEmails := []string{pair.ID1, pair.ID2}
 		toNames := []string{members[pair.ID1].Name, members[pair.ID2].Name}
 
-		err := sendEmail(orgname, toEmails, toNames)
+		err := sendEmail(orgname, toEmails, toNames, tokens[pair])
 		if err != nil {
-			return err
+			numFailed++
+			lastErr = err
 		}
 	}
 
+	if numFailed > 0 {
+		return fmt.Errorf("%d of %d emails failed: %s", numFailed, len(round.Pairs), lastErr)
+	}
+
 	return nil
 }
 
@@ -249,48 +303,66 @@ func selectRandomPartner(genRandomInt RandomIntGenerator, members []MinimalMembe
 	return members[genRandomInt(len(members))]
 }
 
-func getMinimalMembersFromDB(orgname string) (MembersMap, error) {
-	crossMatchTrait, err := GetCrossMatchTrait(orgname)
+func getMinimalMembers(store Store, orgname string) (MembersMap, error) {
+	crossMatchTrait, err := store.GetCrossMatchTrait(orgname)
 	if err != nil {
 		return MembersMap{}, err
 	}
 
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+	minimalMembers := MembersMap{}
+	members, err := store.GetMembers(orgname, true)
 	if err != nil {
 		return MembersMap{}, err
 	}
 
-	minimalMembers := MembersMap{}
-	members, err := GetMembersFromDB(orgname, true)
+	avoidMissedPairs, err := store.GetAvoidMissedPairs(orgname)
+	if err != nil {
+		return MembersMap{}, err
+	}
+
+	pairHistory, err := store.GetPairHistory(orgname)
 	if err != nil {
 		return MembersMap{}, err
 	}
 
+	missedPairs := map[string]map[string]bool{}
+	if avoidMissedPairs {
+		missedPairs, err = store.GetMissedPairs(orgname)
+		if err != nil {
+			return MembersMap{}, err
+		}
+	}
+
+	activeIDs := []string{}
+	for _, member := range members {
+		activeIDs = append(activeIDs, member.Email)
+	}
+
 	for _, member := range members {
 		minimalMembers[member.Email] = MinimalMember{
 			ID:            member.Email,
 			Name:          member.Name,
 			Trait:         member.Metadata[crossMatchTrait],
-			LastRoundWith: member.LastRoundWith,
+			LastRoundWith: lastRoundWith(member.Email, activeIDs, pairHistory),
+			MissedWith:    missedPairs[member.Email],
 		}
 	}
 
 	return minimalMembers, nil
 }
 
-func saveRoundInDB(round Round, members MembersMap, orgname string) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+func saveRoundInDB(db *sql.DB, round Round, orgname string, tokens map[Pair]string) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
 	for pair := range round.Pairs {
 		columns := "(organization, id1, id2, extraId, round)"
 		placeholder := "($1, $2, $3, $4, $5)"
 
-		_, err := db.Exec(
+		_, err := tx.Exec(
 			fmt.Sprintf("INSERT INTO pairs %s VALUES %s", columns, placeholder),
 			orgname,
 			pair.ID1,
@@ -304,37 +376,51 @@ func saveRoundInDB(round Round, members MembersMap, orgname string) error {
 		}
 	}
 
-	for _, member := range members {
-		bytes, err := json.Marshal(member.LastRoundWith)
-		if err != nil {
-			return err
-		}
+	err = updatePairHistoryInTx(tx, orgname, round)
+	if err != nil {
+		return err
+	}
 
-		_, err = db.Exec(
-			"UPDATE members SET last_round_with = $1 WHERE organization = $2 AND email = $3",
-			server.JSONB(bytes),
-			orgname,
-			member.ID,
-		)
-		if err != nil {
-			return err
-		}
+	err = saveFeedbackTokensInTx(tx, orgname, round.Number, tokens)
+	if err != nil {
+		return err
 	}
 
-	_, err = db.Exec(
-		"UPDATE rounds SET done = $1 WHERE organization = $2 AND id = $3",
+	// the round may have been cancelled after the scheduler picked it up, in which case nothing is saved
+	result, err := tx.Exec(
+		"UPDATE rounds SET done = $1, status = $2, attempts = attempts + 1, last_error = NULL WHERE organization = $3 AND id = $4 AND status <> $5",
 		true,
+		RoundStatusDone,
 		orgname,
 		round.Number,
+		RoundStatusCancelled,
 	)
 	if err != nil {
 		return err
 	}
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrRoundCancelled
+	}
 
-	return nil
+	return tx.Commit()
 }
 
-func sendEmail(orgname string, toEmails []string, toNames []string) error {
+func sendEmail(orgname string, toEmails []string, toNames []string, feedbackToken string) error {
+	text := fmt.Sprintf(
+		"%s \n%s\n\n %s\n%s\n%s\n\n %s",
+		EmailIntro,
+		strings.Join(toNames, "\r\n"),
+		EmailFeedbackPrompt,
+		"Yes: "+feedbackURL(feedbackToken, true),
+		"No: "+feedbackURL(feedbackToken, false),
+		EmailFooter,
+	)
+
+	return sendMailgunMessage(orgname, EmailSubject, text, toEmails)
+}
+
+// sendMailgunMessage : Send a single email, from the organization's Mealbot, to every address in toEmails
+func sendMailgunMessage(orgname string, subject string, text string, toEmails []string) error {
 	smtpAddress, ok := os.LookupEnv("MAILGUN_SMTP_LOGIN")
 	if !ok {
 		return errors.New("environment variable MAILGUN_SMTP_LOGIN not set")
@@ -349,17 +435,11 @@ func sendEmail(orgname string, toEmails []string, toNames []string) error {
 	}
 
 	from := fmt.Sprintf("%s Mealbot <%s>", orgname, smtpAddress)
-	text := fmt.Sprintf(
-		"%s \n%s\n\n %s",
-		EmailIntro,
-		strings.Join(toNames, "\r\n"),
-		EmailFooter,
-	)
 
 	mg := mailgun.NewMailgun(domain, apiKey)
 	message := mg.NewMessage(
 		from,
-		EmailSubject,
+		subject,
 		text,
 		toEmails...,
 	)
@@ -374,20 +454,40 @@ func sendEmail(orgname string, toEmails []string, toNames []string) error {
 	return nil
 }
 
-func runPairingScheduler(testMode bool) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return err
+// runPairingScheduler : Pair every round that is due. Each round is attempted independently, so one
+// organization's bad data (or a Mailgun outage) doesn't hold up every other organization's rounds;
+// failures are recorded on the round and retried w/ backoff on later runs
+func runPairingScheduler(db *sql.DB, testMode bool) error {
+	err := withAdvisoryLock(db, ScheduleLockNamespace, 0, func() error {
+		return materializeAllSchedules(db, time.Now())
+	})
+	if err != nil && err != ErrLocked {
+		log.WithFields(log.Fields{
+			"logger":   "logrus",
+			"function": "runPairingScheduler",
+		}).Error(err)
 	}
 
 	rows, err := db.Query(
-		"SELECT organization, id FROM rounds WHERE scheduled_date < now() AT TIME ZONE 'utc' AND done = false",
+		`SELECT organization, id FROM rounds
+		WHERE scheduled_date < now() AND done = false AND status <> $1 AND attempts < $2
+		AND (next_attempt_at IS NULL OR next_attempt_at <= now() AT TIME ZONE 'utc')
+		ORDER BY scheduled_date ASC`,
+		RoundStatusCancelled,
+		RoundMaxAttempts,
 	)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
+	type dueRound struct {
+		orgname  string
+		roundNum int
+	}
+
+	// read every due round before pairing, so the query's connection isn't held while emails are sent
+	dueRounds := []dueRound{}
 	for rows.Next() {
 		var orgname string
 		var roundNum int
@@ -396,11 +496,39 @@ func runPairingScheduler(testMode bool) error {
 			return err
 		}
 
-		err = runPairingRound(orgname, roundNum, testMode)
+		dueRounds = append(dueRounds, dueRound{orgname: orgname, roundNum: roundNum})
+	}
+	rows.Close()
+
+	numFailed := 0
+	for _, round := range dueRounds {
+		err = runPairingRoundWithLock(db, round.orgname, round.roundNum, testMode)
+		if err == nil || err == ErrLocked || err == ErrRoundCancelled {
+			continue
+		}
+
+		numFailed++
+		log.WithFields(log.Fields{
+			"logger":       "logrus",
+			"function":     "runPairingScheduler",
+			"organization": round.orgname,
+			"round":        round.roundNum,
+		}).Error(err)
+
+		err = markRoundFailed(db, round.orgname, round.roundNum, err)
 		if err != nil {
-			return err
+			log.WithFields(log.Fields{
+				"logger":       "logrus",
+				"function":     "runPairingScheduler",
+				"organization": round.orgname,
+				"round":        round.roundNum,
+			}).Error(err)
 		}
 	}
 
+	if numFailed > 0 {
+		return fmt.Errorf("%d of %d due rounds failed", numFailed, len(dueRounds))
+	}
+
 	return nil
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func getMockMembersMap(numMembers int) (MembersMap, error) {
@@ -51,6 +53,169 @@ func TestRunPairingAlgorithmCorrectness(t *testing.T) {
 	runPairingAlgorithm(members, 2, randomIntGenerator)
 }
 
+func TestRunPairingAlgorithmAvoidsMissedPairs(t *testing.T) {
+	t.Log("Test that members who didn't meet last time aren't paired again if others are available")
+
+	randomIntGenerator := func(n int) int {
+		return 0
+	}
+
+	members, err := getMockMembersMap(4)
+	if err != nil {
+		t.Error(err)
+	}
+
+	missed := [][]string{
+		{"a@gmail.com", "b@gmail.com"},
+		{"c@gmail.com", "d@gmail.com"},
+	}
+	for _, ids := range missed {
+		members[ids[0]] = MinimalMember{
+			ID:            ids[0],
+			Name:          members[ids[0]].Name,
+			Trait:         members[ids[0]].Trait,
+			LastRoundWith: members[ids[0]].LastRoundWith,
+			MissedWith:    map[string]bool{ids[1]: true},
+		}
+		members[ids[1]] = MinimalMember{
+			ID:            ids[1],
+			Name:          members[ids[1]].Name,
+			Trait:         members[ids[1]].Trait,
+			LastRoundWith: members[ids[1]].LastRoundWith,
+			MissedWith:    map[string]bool{ids[0]: true},
+		}
+	}
+
+	_, round := runPairingAlgorithm(members, 0, randomIntGenerator)
+	for _, ids := range missed {
+		if round.Pairs[NewPair(ids[0], ids[1])] {
+			t.Errorf("%s and %s were paired again after missing their last meeting", ids[0], ids[1])
+		}
+	}
+}
+
 func TestPairingAlgorithmEndToEndTest(t *testing.T) {
+	t.Log("Test that rounds paired through a Store group every member & update the pairing history")
 
+	store := NewMemoryStore()
+	orgname := "test"
+	err := createOrganization(store, orgname, "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Member{}
+	for _, letter := range strings.Split("abcd", "") {
+		members = append(members, Member{
+			Organization: orgname,
+			Email:        letter + "@gmail.com",
+			Name:         "Person " + strings.ToUpper(letter),
+			Metadata:     map[string]string{},
+		})
+	}
+	err = saveMembers(store, orgname, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numRounds := 3
+	for i := 0; i < numRounds; i++ {
+		err = store.AddRound(orgname, time.Date(2019, 1, 2+7*i, 18, 30, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = runPairingRound(store, orgname, i, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rounds, err := store.GetRounds(orgname, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, round := range rounds {
+		if round.Status != RoundStatusDone || round.NumGroups != 2 || round.NumMembers != len(members) {
+			t.Errorf("Round %d: expected 2 groups of all %d members to be done, got %+v", round.ID, len(members), round)
+		}
+	}
+
+	roundPairs, err := store.GetPairs(orgname, NewPairsFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roundPairs) != numRounds {
+		t.Fatalf("Expected pairs for %d rounds, got %d", numRounds, len(roundPairs))
+	}
+
+	for _, member := range members {
+		partners, err := store.GetPartners(orgname, member.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lastRound := -1
+		for _, round := range partners {
+			if round > lastRound {
+				lastRound = round
+			}
+		}
+
+		if lastRound != numRounds-1 {
+			t.Errorf("%s was last paired in round %d instead of %d", member.Email, lastRound, numRounds-1)
+		}
+	}
+}
+
+func TestPairingRoundSavedBeforeNotifying(t *testing.T) {
+	t.Log("Test that a round & its feedback tokens are saved even if emailing the groups fails")
+
+	// w/o Mailgun credentials, every email fails
+	os.Unsetenv("MAILGUN_SMTP_LOGIN")
+
+	store := NewMemoryStore()
+	orgname := "test"
+	err := createOrganization(store, orgname, "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Member{}
+	for _, letter := range strings.Split("abcd", "") {
+		members = append(members, Member{Organization: orgname, Email: letter + "@gmail.com", Metadata: map[string]string{}})
+	}
+	err = saveMembers(store, orgname, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.AddRound(orgname, time.Date(2019, 1, 2, 18, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runPairingRound(store, orgname, 0, false)
+	if err != nil {
+		t.Fatalf("Expected failing to notify groups not to fail the round, got %v", err)
+	}
+
+	rounds, err := store.GetRounds(orgname, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds[0].Status != RoundStatusDone || rounds[0].NumGroups != 2 {
+		t.Errorf("Expected the round to be done w/ 2 groups, got %+v", rounds[0])
+	}
+
+	stats, err := store.GetFeedbackStats(orgname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Groups != 2 {
+		t.Errorf("Expected a feedback token for each group, got %+v", stats)
+	}
+	if len(store.Events) == 0 || store.Events[len(store.Events)-1].Type != EventRoundCompleted {
+		t.Errorf("Expected %s to be emitted, got %+v", EventRoundCompleted, store.Events)
+	}
 }
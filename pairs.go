@@ -2,11 +2,17 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
+)
 
-	"github.com/johnamadeo/server"
+const (
+	// DefaultPairsLimit : How many rounds of pairs are returned at once if 'limit' isn't given
+	DefaultPairsLimit = 20
+	// MaxPairsLimit :
+	MaxPairsLimit = 100
 )
 
 // GetPairsResponsePair : Data structure for a pairing
@@ -16,14 +22,48 @@ type GetPairsResponsePair struct {
 	ExtraMember Member `json:"extraMember"`
 }
 
-// GetPairsResponse : Data structure for storing pairings, separated by rounds
+// GetPairsResponse : Data structure for storing pairings, separated by rounds. Rounds w/o any pairs (or w/o any
+// that match the filter) are skipped, so 'roundIds' has the round of each element of 'roundPairs'
 type GetPairsResponse struct {
 	RoundPairs [][]GetPairsResponsePair `json:"roundPairs"`
+	RoundIDs   []int                    `json:"roundIds"`
+	// NextCursor : Passed as 'cursor' to get the next page. Left out on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// PairsFilter : Which pairs to get. Only rounds between RoundFrom & RoundTo (inclusive) are included, and only
+// groups w/ Member if it's set. At most Limit rounds are returned, in order
+type PairsFilter struct {
+	RoundFrom int
+	RoundTo   int
+	Member    string
+	Limit     int
+}
+
+// NewPairsFilter : Filter that includes every round, up to DefaultPairsLimit of them
+func NewPairsFilter() PairsFilter {
+	return PairsFilter{RoundFrom: 0, RoundTo: math.MaxInt32, Limit: DefaultPairsLimit}
+}
+
+// RoundPairs : The pairs made in a round
+type RoundPairs struct {
+	Round int
+	Pairs []GetPairsResponsePair
+}
+
+// GetPairsHandler : HTTP Handler for getting pairings for an organization. Optional query parameters are
+// 'roundFrom' & 'roundTo' (round IDs), 'member' (an email), 'limit' (rounds per page) & 'cursor'
+func (app *App) GetPairsHandler(w http.ResponseWriter, r *http.Request) {
+	app.getPairs(w, r, DefaultPairsLimit, "GetPairsHandler")
+}
+
+// GetLegacyPairsHandler : Like GetPairsHandler, but only paged if 'limit' is given, since clients of the '/pairs'
+// alias expect every round
+func (app *App) GetLegacyPairsHandler(w http.ResponseWriter, r *http.Request) {
+	app.getPairs(w, r, math.MaxInt32, "GetLegacyPairsHandler")
 }
 
-// GetPairsHandler : HTTP Handler for getting pairings for an organization
-func GetPairsHandler(w http.ResponseWriter, r *http.Request) {
-	function := "GetPairsHandler"
+func (app *App) getPairs(w http.ResponseWriter, r *http.Request, defaultLimit int, function string) {
 	if r.Method != "GET" {
 		LogAndWriteErr(
 			w,
@@ -40,87 +80,186 @@ func GetPairsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	roundPairs, err := getPairsFromDB(orgname)
+	filter, err := getPairsFilter(r, defaultLimit)
 	if err != nil {
-		LogAndWriteStatusInternalServerError(w, err, function)
+		LogAndWriteStatusBadRequest(w, err, function)
 		return
 	}
 
-	resp := GetPairsResponse{
-		RoundPairs: roundPairs,
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
 	}
 
-	bytes, err := json.Marshal(resp)
+	// one more round than the limit is fetched to tell whether there's another page
+	limit := filter.Limit
+	filter.Limit++
+
+	roundPairs, err := app.Store.GetPairs(orgname, filter)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(bytes)
+	resp := GetPairsResponse{
+		RoundPairs: [][]GetPairsResponsePair{},
+		RoundIDs:   []int{},
+	}
+	if len(roundPairs) > limit {
+		roundPairs = roundPairs[:limit]
+		resp.NextCursor = strconv.Itoa(roundPairs[limit-1].Round)
+	}
+	for _, round := range roundPairs {
+		resp.RoundPairs = append(resp.RoundPairs, round.Pairs)
+		resp.RoundIDs = append(resp.RoundIDs, round.Round)
+	}
+
+	LogAndWrite(w, resp, http.StatusOK, function)
 }
 
-// getPairsFromDB : Get all the pairings for a particular organization
-func getPairsFromDB(orgname string) ([][]GetPairsResponsePair, error) {
-	roundPairs := [][]GetPairsResponsePair{}
+// getPairsFilter : The cursor is the last round of the previous page, so the page starts after it
+func getPairsFilter(r *http.Request, defaultLimit int) (PairsFilter, error) {
+	filter := NewPairsFilter()
+	filter.Limit = defaultLimit
+	query := r.URL.Query()
+
+	getInt := func(key string, min int, max int, value *int) error {
+		if query.Get(key) == "" {
+			return nil
+		}
+
+		parsed, err := strconv.Atoi(query.Get(key))
+		if err != nil || parsed < min || parsed > max {
+			return errors.New(key + " must be a number between " + strconv.Itoa(min) + " and " + strconv.Itoa(max))
+		}
+
+		*value = parsed
+		return nil
+	}
+
+	cursor := -1
+	for _, err := range []error{
+		getInt("roundFrom", 0, math.MaxInt32, &filter.RoundFrom),
+		getInt("roundTo", 0, math.MaxInt32, &filter.RoundTo),
+		getInt("limit", 1, MaxPairsLimit, &filter.Limit),
+		getInt("cursor", 0, math.MaxInt32-1, &cursor),
+	} {
+		if err != nil {
+			return filter, err
+		}
+	}
 
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+	if cursor >= filter.RoundFrom {
+		filter.RoundFrom = cursor + 1
+	}
+	filter.Member = query.Get("member")
+
+	return filter, nil
+}
+
+// getPairsFromDB : Get the pairings for a particular organization in one query, paging by round w/ DENSE_RANK so
+// a round's pairs are never split across pages
+func getPairsFromDB(db *sql.DB, orgname string, filter PairsFilter) ([]RoundPairs, error) {
+	roundPairs := []RoundPairs{}
+
+	members, err := getActiveMembersFromDBInPairFormat(db, orgname)
 	if err != nil {
 		return roundPairs, err
 	}
 
-	members, err := getActiveMembersFromDBInPairFormat(orgname)
 	membersMap := map[string]Member{}
 	for _, member := range members {
 		membersMap[member.Email] = member
 	}
 
-	round := 0
+	rows, err := db.Query(
+		`SELECT round, id1, id2, extraId FROM (
+			SELECT round, id1, id2, extraId, DENSE_RANK() OVER (ORDER BY round) AS page_round
+			FROM pairs
+			WHERE organization = $1 AND round BETWEEN $2 AND $3
+				AND ($4::varchar = '' OR $4::varchar IN (id1, id2, extraId))
+		) ranked
+		WHERE page_round <= $5
+		ORDER BY round, id1, id2`,
+		orgname,
+		filter.RoundFrom,
+		filter.RoundTo,
+		filter.Member,
+		filter.Limit,
+	)
+	if err != nil {
+		return roundPairs, err
+	}
+	defer rows.Close()
 
-	for {
-		pairRows, err := db.Query(
-			"SELECT id1, id2, extraId FROM pairs WHERE organization = $1 AND round = $2",
-			orgname,
-			round,
-		)
+	for rows.Next() {
+		var round int
+		var id1, id2 string
+		var extraID sql.NullString
+		err := rows.Scan(&round, &id1, &id2, &extraID)
 		if err != nil {
 			return roundPairs, err
 		}
 
-		numPairs := 0
-		pairs := []GetPairsResponsePair{}
-		for pairRows.Next() {
-			var id1, id2 string
-			var extraID sql.NullString
-			err := pairRows.Scan(&id1, &id2, &extraID)
-			if err != nil {
-				return roundPairs, err
-			}
-
-			if extraID.Valid {
-				pairs = append(pairs, GetPairsResponsePair{
-					Member1:     membersMap[id1],
-					Member2:     membersMap[id2],
-					ExtraMember: membersMap[extraID.String],
-				})
-			} else {
-				pairs = append(pairs, GetPairsResponsePair{
-					Member1: membersMap[id1],
-					Member2: membersMap[id2],
-				})
-			}
-
-			numPairs++
+		pair := GetPairsResponsePair{
+			Member1: membersMap[id1],
+			Member2: membersMap[id2],
+		}
+		if extraID.Valid {
+			pair.ExtraMember = membersMap[extraID.String]
+		}
+
+		if len(roundPairs) == 0 || roundPairs[len(roundPairs)-1].Round != round {
+			roundPairs = append(roundPairs, RoundPairs{Round: round})
+		}
+		last := &roundPairs[len(roundPairs)-1]
+		last.Pairs = append(last.Pairs, pair)
+	}
+
+	return roundPairs, rows.Err()
+}
+
+// getRoundGroupsFromDB : Get the groups made in a round, including members who have since been deactivated
+func getRoundGroupsFromDB(db *sql.DB, orgname string, roundID int) ([]GetPairsResponsePair, error) {
+	groups := []GetPairsResponsePair{}
+
+	members, err := GetMembersFromDB(db, orgname, false)
+	if err != nil {
+		return groups, err
+	}
+
+	membersMap := map[string]Member{}
+	for _, member := range members {
+		membersMap[member.Email] = Member{Name: member.Name, Email: member.Email}
+	}
+
+	rows, err := db.Query(
+		"SELECT id1, id2, extraId FROM pairs WHERE organization = $1 AND round = $2",
+		orgname,
+		roundID,
+	)
+	if err != nil {
+		return groups, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id1, id2 string
+		var extraID sql.NullString
+		err := rows.Scan(&id1, &id2, &extraID)
+		if err != nil {
+			return groups, err
 		}
 
-		if numPairs == 0 {
-			break
+		group := GetPairsResponsePair{
+			Member1: membersMap[id1],
+			Member2: membersMap[id2],
+		}
+		if extraID.Valid {
+			group.ExtraMember = membersMap[extraID.String]
 		}
 
-		roundPairs = append(roundPairs, pairs)
-		round++
+		groups = append(groups, group)
 	}
 
-	return roundPairs, nil
+	return groups, nil
 }
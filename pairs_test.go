@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPairsHandler(t *testing.T) {
+	t.Log("Test that pairs are filtered & paged by round, w/o stopping at rounds that have no pairs")
+
+	orgname := "test"
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, orgname, "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Member{}
+	for _, letter := range strings.Split("abcd", "") {
+		members = append(members, Member{
+			Organization: orgname,
+			Email:        letter + "@gmail.com",
+			Name:         "Person " + strings.ToUpper(letter),
+			Metadata:     map[string]string{},
+		})
+	}
+	err = saveMembers(app.Store, orgname, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round 2 is never paired
+	for i := 0; i < 4; i++ {
+		err = app.Store.AddRound(orgname, time.Date(2019, 1, 2+7*i, 18, 30, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i != 2 {
+			err = runPairingRound(app.Store, orgname, i, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	getPairs := func(query string) (int, GetPairsResponse) {
+		w := httptest.NewRecorder()
+		app.GetPairsHandler(w, withCaller(httptest.NewRequest("GET", "/pairs?org="+orgname+query, nil), "admin@gmail.com"))
+
+		var resp GetPairsResponse
+		if w.Code == http.StatusOK {
+			err := decodeData(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return w.Code, resp
+	}
+
+	roundIDs := []int{}
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		code, resp := getPairs("&limit=1&cursor=" + cursor)
+		if code != http.StatusOK || len(resp.RoundPairs) != 1 || len(resp.RoundPairs[0]) != 2 {
+			t.Fatalf("Expected 1 round of 2 pairs, got %d: %+v", code, resp)
+		}
+
+		roundIDs = append(roundIDs, resp.RoundIDs...)
+		cursor = resp.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(roundIDs, []int{0, 1, 3}) {
+		t.Errorf("Expected pages of rounds [0 1 3], got %v", roundIDs)
+	}
+
+	_, resp := getPairs("&roundFrom=1&roundTo=2")
+	if !reflect.DeepEqual(resp.RoundIDs, []int{1}) || resp.NextCursor != "" {
+		t.Errorf("Expected only round 1 w/o another page, got %v (cursor '%s')", resp.RoundIDs, resp.NextCursor)
+	}
+
+	_, resp = getPairs("&member=a@gmail.com")
+	if len(resp.RoundPairs) != 3 {
+		t.Fatalf("Expected a@gmail.com to be in 3 rounds, got %d", len(resp.RoundPairs))
+	}
+	for i, pairs := range resp.RoundPairs {
+		if len(pairs) != 1 {
+			t.Errorf("Round %d: expected only the group w/ a@gmail.com, got %+v", resp.RoundIDs[i], pairs)
+		}
+	}
+
+	for _, query := range []string{"&limit=0", fmt.Sprintf("&limit=%d", MaxPairsLimit+1), "&cursor=x", "&roundFrom=-1"} {
+		code, _ := getPairs(query)
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected %d for '%s', got %d", http.StatusBadRequest, query, code)
+		}
+	}
+}
+
+func TestGetLegacyPairsHandler(t *testing.T) {
+	t.Log("Test that the '/pairs' alias still returns every round unless it's given a limit")
+
+	orgname := "test"
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, orgname, "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := []Member{}
+	for _, letter := range strings.Split("ab", "") {
+		members = append(members, Member{Organization: orgname, Email: letter + "@gmail.com", Metadata: map[string]string{}})
+	}
+	err = saveMembers(app.Store, orgname, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numRounds := DefaultPairsLimit + 1
+	for i := 0; i < numRounds; i++ {
+		err = app.Store.AddRound(orgname, time.Date(2019, 1, 2+i, 18, 30, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runPairingRound(app.Store, orgname, i, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		handler   http.HandlerFunc
+		query     string
+		numRounds int
+		paged     bool
+	}{
+		{app.GetLegacyPairsHandler, "", numRounds, false},
+		{app.GetLegacyPairsHandler, "&limit=5", 5, true},
+		{app.GetPairsHandler, "", DefaultPairsLimit, true},
+	} {
+		w := httptest.NewRecorder()
+		c.handler(w, withCaller(httptest.NewRequest("GET", "/pairs?org="+orgname+c.query, nil), "admin@gmail.com"))
+
+		var resp GetPairsResponse
+		err := decodeData(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.RoundPairs) != c.numRounds || (resp.NextCursor != "") != c.paged {
+			t.Errorf("'%s': expected %d rounds (paged: %t), got %d (cursor '%s')", c.query, c.numRounds, c.paged, len(resp.RoundPairs), resp.NextCursor)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/johnamadeo/server"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -15,16 +17,79 @@ const (
 	NoMaxRoundErr = "converting driver.Value type <nil>"
 
 	// TimestampFormat : Postgres timestamp string template patterns can be found in https://www.postgresql.org/docs/8.1/functions-formatting.html
+	// Only for TIMESTAMP columns stored in UTC; round dates are TIMESTAMPTZ and formatted in Go
 	TimestampFormat = "YYYY-MM-DD HH24:MI:ssZ"
+
+	// RoundStatusScheduled : Round hasn't been attempted yet
+	RoundStatusScheduled = "scheduled"
+	// RoundStatusRunning : Round is being paired
+	RoundStatusRunning = "running"
+	// RoundStatusDone : Round was paired successfully
+	RoundStatusDone = "done"
+	// RoundStatusFailed : Last attempt at pairing the round failed; see the round's last error
+	RoundStatusFailed = "failed"
+	// RoundStatusCancelled : Round was cancelled before it happened
+	RoundStatusCancelled = "cancelled"
+
+	// RoundMaxAttempts : Max. no. of times the scheduler attempts a round before giving up on it
+	RoundMaxAttempts = 5
+	// RoundRetryBaseDelay : Delay before a failed round is retried; doubles after every failed attempt
+	RoundRetryBaseDelay = 5 * time.Minute
 )
 
-// GetRoundsResponse : Data structure for storing the dates for each round
+// LocalRoundDateFormats : Formats accepted for round dates w/o an offset, which are interpreted in the organization's time zone
+var LocalRoundDateFormats = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// GetRoundsResponse : Data structure for storing every round of an organization
 type GetRoundsResponse struct {
-	Rounds []string `json:"rounds"`
+	Rounds   []RoundResponse `json:"rounds"`
+	TimeZone string          `json:"timezone"`
+}
+
+// RoundResponse : Data structure for a round; groups are only included when a single round is requested
+type RoundResponse struct {
+	ID            int                    `json:"id"`
+	ScheduledDate string                 `json:"scheduledDate"`
+	Status        string                 `json:"status"`
+	NumGroups     int                    `json:"numGroups"`
+	NumMembers    int                    `json:"numMembers"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"lastError,omitempty"`
+	LastAttemptAt string                 `json:"lastAttemptAt,omitempty"`
+	Groups        []GetPairsResponsePair `json:"groups,omitempty"`
 }
 
+// GetRoundGroupsResponse :
+type GetRoundGroupsResponse struct {
+	Groups []GetPairsResponsePair `json:"groups"`
+}
+
+// ErrRoundNotFound : Returned when an organization doesn't have a round w/ the requested ID
+var ErrRoundNotFound = errors.New("Round does not exist")
+
+// ErrRoundDone : Returned when trying to cancel a round that has already been paired
+var ErrRoundDone = errors.New("Round has already been paired and cannot be cancelled")
+
+// ErrRoundRunning : Returned when trying to cancel a round that is being paired
+var ErrRoundRunning = errors.New("Round is being paired and cannot be cancelled")
+
+// ErrRoundCancelled : Returned when saving the groups of a round that was cancelled while it was being paired
+var ErrRoundCancelled = errors.New("Round was cancelled")
+
+// ErrRoundNotDone : Returned when trying to roll back a round that hasn't been paired
+var ErrRoundNotDone = errors.New("Only rounds that have been paired can be rolled back")
+
+// ErrRoundNotPending : Returned when trying to reschedule a round that is being paired, has been paired or
+// cancelled, or doesn't exist
+var ErrRoundNotPending = errors.New("Only rounds that are yet to happen can be rescheduled")
+
 // AddRoundHandler : HTTP handler for scheduling a new round on a certain date
-func AddRoundHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) AddRoundHandler(w http.ResponseWriter, r *http.Request) {
 	function := "AddRoundHandler"
 	if r.Method != "POST" {
 		LogAndWriteErr(
@@ -36,7 +101,6 @@ func AddRoundHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Verify 'round' is a datestring in the YYYY-MM-DDTHH:mm:ss[Z] format
 	values, err := getQueryParams(r, []string{"org", "round"})
 	if err != nil {
 		LogAndWriteStatusBadRequest(w, err, function)
@@ -44,24 +108,38 @@ func AddRoundHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	orgname := values[0]
-	roundDate := values[1]
 
-	err = addRound(orgname, roundDate)
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+	loc, err := app.Store.GetOrganizationLocation(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	roundDate, err := parseRoundDate(values[1], loc)
 	if err != nil {
 		LogAndWriteStatusBadRequest(w, err, function)
 		return
 	}
 
-	LogAndWrite(
+	err = app.Store.AddRound(orgname, roundDate)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(
 		w,
-		server.StrToBytes("Successfully scheduled a new round"),
+		"Successfully scheduled a new round",
 		http.StatusCreated,
 		function,
 	)
 }
 
 // GetRoundsHandler : HTTP handler for retrieving the dates for all rounds scheduled
-func GetRoundsHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) GetRoundsHandler(w http.ResponseWriter, r *http.Request) {
 	function := "GetRoundsHandler"
 	if r.Method != "GET" {
 		LogAndWriteErr(
@@ -79,37 +157,119 @@ func GetRoundsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rounds, err := getRoundsFromDB(orgname)
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
+	}
+
+	loc, err := app.Store.GetOrganizationLocation(orgname)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	resp := GetRoundsResponse{Rounds: rounds}
-	bytes, err := json.Marshal(resp)
+	rounds, err := app.Store.GetRounds(orgname, loc)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(w, bytes, http.StatusOK, function)
+	resp := GetRoundsResponse{Rounds: rounds, TimeZone: loc.String()}
+	LogAndWrite(w, resp, http.StatusOK, function)
+}
+
+// GetRoundHandler : HTTP handler for retrieving a single round along w/ its groups
+func (app *App) GetRoundHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetRoundHandler"
+	round, ok := app.getRoundForRequest(w, r, function)
+	if !ok {
+		return
+	}
+
+	LogAndWrite(w, round, http.StatusOK, function)
+}
+
+// GetRoundGroupsHandler : HTTP handler for retrieving only the groups of a single round
+func (app *App) GetRoundGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetRoundGroupsHandler"
+	round, ok := app.getRoundForRequest(w, r, function)
+	if !ok {
+		return
+	}
+
+	groups := round.Groups
+	if groups == nil {
+		groups = []GetPairsResponsePair{}
+	}
+
+	LogAndWrite(w, GetRoundGroupsResponse{Groups: groups}, http.StatusOK, function)
+}
+
+// getRoundForRequest : The round identified by the 'org' & 'roundId' parameters. If it can't be retrieved, the
+// error has already been written and handlers return straight away
+func (app *App) getRoundForRequest(w http.ResponseWriter, r *http.Request, function string) (RoundResponse, bool) {
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return RoundResponse{}, false
+	}
+
+	values, err := getQueryParams(r, []string{"org", "roundId"})
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return RoundResponse{}, false
+	}
+
+	orgname := values[0]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return RoundResponse{}, false
+	}
+	roundID, err := strconv.Atoi(values[1])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return RoundResponse{}, false
+	}
+
+	loc, err := app.Store.GetOrganizationLocation(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return RoundResponse{}, false
+	}
+
+	round, err := app.Store.GetRound(orgname, roundID, loc)
+	if err == ErrRoundNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return RoundResponse{}, false
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return RoundResponse{}, false
+	}
+
+	return round, true
 }
 
 // RoundHandler : Combined HTTP handler for rounds
-func RoundHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
+func (app *App) RoundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetRoundHandler(w, r)
+	} else if r.Method == "POST" {
 		_, err := getQueryParam(r, "roundId")
 		if err != nil {
-			AddRoundHandler(w, r)
+			app.AddRoundHandler(w, r)
 		} else {
-			RescheduleRoundHandler(w, r)
+			app.RescheduleRoundHandler(w, r)
 		}
 	} else if r.Method == "DELETE" {
-		RemoveRoundHandler(w, r)
+		app.RemoveRoundHandler(w, r)
 	} else {
 		LogAndWriteErr(
 			w,
-			errors.New("Only POST and DELETE requests are allowed at this route"),
+			errors.New("Only GET, POST and DELETE requests are allowed at this route"),
 			http.StatusMethodNotAllowed,
 			"RoundHandler",
 		)
@@ -117,38 +277,77 @@ func RoundHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getRoundsFromDB(orgname string) ([]string, error) {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+// getRoundsFromDB : Get every round w/ its date formatted as RFC 3339 w/ the offset of the organization's time zone
+func getRoundsFromDB(db *sql.DB, orgname string, loc *time.Location) ([]RoundResponse, error) {
+	return queryRounds(db, orgname, loc, "")
+}
+
+// getRoundFromDB : Get a single round along w/ its groups
+func getRoundFromDB(db *sql.DB, orgname string, roundID int, loc *time.Location) (RoundResponse, error) {
+	rounds, err := queryRounds(db, orgname, loc, "AND r.id = $3", roundID)
 	if err != nil {
-		return []string{}, err
+		return RoundResponse{}, err
+	}
+	if len(rounds) == 0 {
+		return RoundResponse{}, ErrRoundNotFound
 	}
 
+	round := rounds[0]
+	round.Groups, err = getRoundGroupsFromDB(db, orgname, roundID)
+	if err != nil {
+		return RoundResponse{}, err
+	}
+
+	return round, nil
+}
+
+// queryRounds : Get rounds w/ the no. of groups & members in each; 'where' can filter on the rounds table 'r'
+// using placeholders from $3 onwards
+func queryRounds(db *sql.DB, orgname string, loc *time.Location, where string, args ...interface{}) ([]RoundResponse, error) {
 	rows, err := db.Query(
-		"SELECT to_char(scheduled_date, $1) FROM rounds WHERE organization = $2 ORDER BY id ASC",
-		TimestampFormat,
-		orgname,
+		`SELECT r.id, r.scheduled_date, r.status, r.attempts, r.last_error, to_char(r.last_attempt_at, $1),
+		COUNT(p.id1), COUNT(p.id1) * 2 + COUNT(NULLIF(p.extraId, ''))
+		FROM rounds r LEFT JOIN pairs p ON p.organization = r.organization AND p.round = r.id
+		WHERE r.organization = $2 `+where+`
+		GROUP BY r.organization, r.id ORDER BY r.id ASC`,
+		append([]interface{}{TimestampFormat, orgname}, args...)...,
 	)
 	if err != nil {
-		return []string{}, err
+		return []RoundResponse{}, err
 	}
+	defer rows.Close()
 
-	rounds := []string{}
+	rounds := []RoundResponse{}
 	for rows.Next() {
-		var roundDate string
-		err = rows.Scan(&roundDate)
+		var round RoundResponse
+		var scheduledDate time.Time
+		var lastError, lastAttemptAt sql.NullString
+		err = rows.Scan(
+			&round.ID,
+			&scheduledDate,
+			&round.Status,
+			&round.Attempts,
+			&lastError,
+			&lastAttemptAt,
+			&round.NumGroups,
+			&round.NumMembers,
+		)
 		if err != nil {
-			return []string{}, err
+			return []RoundResponse{}, err
 		}
 
-		rounds = append(rounds, roundDate)
+		round.ScheduledDate = scheduledDate.In(loc).Format(time.RFC3339)
+		round.LastError = lastError.String
+		round.LastAttemptAt = lastAttemptAt.String
+
+		rounds = append(rounds, round)
 	}
 
 	return rounds, nil
 }
 
 // RemoveRoundHandler : HTTP handler for cancelling a previously scheduled round
-func RemoveRoundHandler(w http.ResponseWriter, r *http.Request) {
+func (app *App) RemoveRoundHandler(w http.ResponseWriter, r *http.Request) {
 	function := "RemoveRoundHandler"
 	if r.Method != "DELETE" {
 		LogAndWriteErr(
@@ -167,32 +366,135 @@ func RemoveRoundHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	orgname := values[0]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+	roundID, err := strconv.Atoi(values[1])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.CancelRound(orgname, roundID)
+	if err == ErrRoundNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return
+	}
+	if err == ErrRoundDone || err == ErrRoundRunning {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(
+		w,
+		"Successfully cancelled round",
+		http.StatusOK,
+		function,
+	)
+}
+
+// RollbackRoundHandler : HTTP handler for reverting a completed round (e.g one that ran on the wrong day or
+// w/ the wrong roster) so that it can be paired again on the future date in 'round'. Emails the affected
+// groups to disregard their group if 'notify' is true
+func (app *App) RollbackRoundHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RollbackRoundHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	values, err := getQueryParams(r, []string{"org", "roundId", "round"})
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	orgname := values[0]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
 	roundID, err := strconv.Atoi(values[1])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	loc, err := app.Store.GetOrganizationLocation(orgname)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	err = removeRound(orgname, roundID)
+	roundDate, err := parseRoundDate(values[2], loc)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+	// the round's current date has passed, so it'd be paired again right away w/ the roster being fixed
+	if !roundDate.After(time.Now()) {
+		LogAndWriteStatusBadRequest(w, errors.New("Rolled back rounds must be rescheduled to a date in the future"), function)
+		return
+	}
+
+	notify := r.URL.Query().Get("notify") == "true"
+
+	groups, err := app.Store.RollbackRound(orgname, roundID, roundDate)
+	if err == ErrRoundNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return
+	}
+	if err == ErrRoundNotDone {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(
+	// the round has been rolled back either way, so failing to email the groups is only logged
+	if notify {
+		err = sendDisregardEmails(orgname, groups)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"logger":       "logrus",
+				"function":     function,
+				"organization": orgname,
+				"round":        roundID,
+			}).Error(err)
+		}
+	}
+
+	LogAndWriteMessage(
 		w,
-		server.StrToBytes("Successfully removed round"),
-		http.StatusCreated,
+		"Successfully rolled back round",
+		http.StatusOK,
 		function,
 	)
 }
 
-// RescheduleRoundHandler : HTTP handler for rescheduling the date of a particular round
-func RescheduleRoundHandler(w http.ResponseWriter, r *http.Request) {
+// RescheduleRoundHandler : HTTP handler for rescheduling the date of a particular round. It's a PATCH of the
+// round in the versioned API, and a POST w/ 'roundId' at the older '/round'
+func (app *App) RescheduleRoundHandler(w http.ResponseWriter, r *http.Request) {
 	function := "RescheduleRoundHandler"
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write(server.StrToBytes("Only POST requests are allowed at this route"))
+	if r.Method != "POST" && r.Method != "PATCH" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST and PATCH requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
 		return
 	}
 
@@ -203,34 +505,74 @@ func RescheduleRoundHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	orgname := values[0]
-	roundDate := values[1]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
 	roundID, err := strconv.Atoi(values[2])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	loc, err := app.Store.GetOrganizationLocation(orgname)
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	err = rescheduleRound(orgname, roundDate, roundID)
+	roundDate, err := parseRoundDate(values[1], loc)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.RescheduleRound(orgname, roundDate, roundID)
+	if err == ErrRoundNotPending {
+		LogAndWriteErr(w, err, http.StatusConflict, function)
+		return
+	}
 	if err != nil {
 		LogAndWriteStatusInternalServerError(w, err, function)
 		return
 	}
 
-	LogAndWrite(
+	LogAndWriteMessage(
 		w,
-		server.StrToBytes("Succesfully changed date of the round"),
-		http.StatusCreated,
+		"Successfully changed date of the round",
+		http.StatusOK,
 		function,
 	)
 }
 
-func addRound(orgname string, roundDate string) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
-	if err != nil {
-		return err
+// parseRoundDate : Parse a round date given either in RFC 3339 (w/ an explicit offset) or as a local
+// date & time in the organization's time zone e.g '2019-01-02 18:30'
+func parseRoundDate(roundDate string, loc *time.Location) (time.Time, error) {
+	// an unescaped '+' in a query string is decoded as a space e.g '2019-01-02T18:30:00 05:00'
+	if len(roundDate) > 6 && strings.Contains(roundDate, "T") && roundDate[len(roundDate)-6] == ' ' {
+		roundDate = roundDate[:len(roundDate)-6] + "+" + roundDate[len(roundDate)-5:]
+	}
+
+	date, err := time.Parse(time.RFC3339, roundDate)
+	if err == nil {
+		return date, nil
 	}
 
+	for _, layout := range LocalRoundDateFormats {
+		date, err := time.ParseInLocation(layout, roundDate, loc)
+		if err == nil {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf(
+		"Round date '%s' must be in RFC 3339 (e.g 2019-01-02T18:30:00-05:00) or a local date & time (e.g 2019-01-02 18:30)",
+		roundDate,
+	)
+}
+
+// insertRound : Schedule a new round after the latest one; 'generated' marks rounds made by a recurring schedule
+func insertRound(db *sql.DB, orgname string, roundDate time.Time, generated bool) error {
 	rows, err := db.Query(
 		"SELECT MAX(id) FROM rounds WHERE organization = $1",
 		orgname,
@@ -252,65 +594,163 @@ func addRound(orgname string, roundDate string) error {
 	}
 
 	_, err = db.Exec(
-		"INSERT INTO rounds (organization, id, scheduled_date, done) VALUES ($1, $2, $3, $4)",
+		"INSERT INTO rounds (organization, id, scheduled_date, done, generated, status, attempts) VALUES ($1, $2, $3, $4, $5, $6, $7)",
 		orgname,
 		maxRoundID+1,
 		roundDate,
 		false,
+		generated,
+		RoundStatusScheduled,
+		0,
 	)
 	if err != nil {
 		return err
 	}
 
+	emitEvent(db, orgname, EventRoundScheduled, RoundEventData{Round: maxRoundID + 1, Date: roundDate.Format(time.RFC3339)})
+
 	return nil
 }
 
-func removeRound(orgname string, roundID int) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+// cancelRound : Cancel a round that hasn't happened yet. Cancelled rounds keep their ID (so that IDs of later
+// rounds, and the round numbers stored in pairs & pair_history, stay valid) and are skipped by the scheduler.
+// If 'excludeFromSchedule' is set, cancelling a round made by a recurring schedule also excludes its date from
+// the schedule so that the round isn't materialized again
+func cancelRound(db *sql.DB, orgname string, roundID int, excludeFromSchedule bool) error {
+	var status string
+	var generated bool
+	var scheduledDate time.Time
+	err := db.QueryRow(
+		"SELECT status, generated, scheduled_date FROM rounds WHERE organization = $1 AND id = $2",
+		orgname,
+		roundID,
+	).Scan(&status, &generated, &scheduledDate)
+	if err == sql.ErrNoRows {
+		return ErrRoundNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(
-		"DELETE FROM rounds WHERE organization = $1 AND id = $2",
+	if status == RoundStatusCancelled {
+		return nil
+	}
+	if status == RoundStatusDone {
+		return ErrRoundDone
+	}
+	if status == RoundStatusRunning {
+		return ErrRoundRunning
+	}
+
+	// the status check guards against the scheduler starting the round since we read it
+	result, err := db.Exec(
+		"UPDATE rounds SET status = $1 WHERE organization = $2 AND id = $3 AND done = false AND status IN ($4, $5)",
+		RoundStatusCancelled,
 		orgname,
 		roundID,
+		RoundStatusScheduled,
+		RoundStatusFailed,
 	)
 	if err != nil {
 		return err
 	}
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrRoundRunning
+	}
 
-	for {
-		result, err := db.Exec(
-			"UPDATE rounds SET id = $1 WHERE organization = $2 AND id = $3",
-			roundID,
-			orgname,
-			roundID+1,
-		)
+	if generated && excludeFromSchedule {
+		err = excludeFromScheduleInDB(db, orgname, scheduledDate)
 		if err != nil {
 			return err
 		}
-		if numRows, _ := result.RowsAffected(); numRows == 0 {
-			break
-		}
+	}
+
+	emitEvent(db, orgname, EventRoundCancelled, RoundEventData{Round: roundID, Date: scheduledDate.Format(time.RFC3339)})
 
-		roundID++
+	return nil
+}
+
+// rescheduleRound : A round made by a recurring schedule becomes a manual round once an admin moves it, so that
+// materializing the schedule leaves it alone, and its original date is excluded from the schedule so that
+// another round isn't made in its place
+func rescheduleRound(db *sql.DB, orgname string, roundDate time.Time, roundID int) error {
+	var generated bool
+	var originalDate time.Time
+	err := db.QueryRow(
+		"SELECT generated, scheduled_date FROM rounds WHERE organization = $1 AND id = $2",
+		orgname,
+		roundID,
+	).Scan(&generated, &originalDate)
+	if err == sql.ErrNoRows {
+		return ErrRoundNotPending
+	}
+	if err != nil {
+		return err
+	}
+
+	// a round that failed gets a fresh set of attempts, since the scheduler gives up on it after RoundMaxAttempts
+	result, err := db.Exec(
+		`UPDATE rounds SET scheduled_date = $1, generated = false, status = $2, attempts = 0, last_error = NULL,
+		next_attempt_at = NULL WHERE organization = $3 AND id = $4 AND done = false AND status NOT IN ($5, $6)`,
+		roundDate,
+		RoundStatusScheduled,
+		orgname,
+		roundID,
+		RoundStatusCancelled,
+		RoundStatusRunning,
+	)
+	if err != nil {
+		return err
+	}
+
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrRoundNotPending
+	}
+
+	if generated {
+		return excludeFromScheduleInDB(db, orgname, originalDate)
+	}
+
+	return nil
+}
+
+// roundRetryDelay : Exponential backoff between attempts at a failed round
+func roundRetryDelay(attempts int) time.Duration {
+	return RoundRetryBaseDelay * time.Duration(1<<uint(attempts-1))
+}
+
+// markRoundRunning : Record that the scheduler started an attempt at pairing the round
+func markRoundRunning(db *sql.DB, orgname string, roundID int) error {
+	_, err := db.Exec(
+		"UPDATE rounds SET status = $1, last_attempt_at = now() AT TIME ZONE 'utc' WHERE organization = $2 AND id = $3",
+		RoundStatusRunning,
+		orgname,
+		roundID,
+	)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func rescheduleRound(orgname string, roundDate string, roundID int) error {
-	db, err := server.CreateDBConnection(LocalDBConnection)
-	defer db.Close()
+// markRoundFailed : Record a failed attempt at pairing the round, and when it should be retried
+func markRoundFailed(db *sql.DB, orgname string, roundID int, roundErr error) error {
+	var attempts int
+	err := db.QueryRow(
+		"UPDATE rounds SET status = $1, last_error = $2, attempts = attempts + 1 WHERE organization = $3 AND id = $4 RETURNING attempts",
+		RoundStatusFailed,
+		roundErr.Error(),
+		orgname,
+		roundID,
+	).Scan(&attempts)
 	if err != nil {
 		return err
 	}
 
 	_, err = db.Exec(
-		"UPDATE rounds SET scheduled_date = $1 WHERE organization = $2 AND id = $3",
-		roundDate,
+		"UPDATE rounds SET next_attempt_at = now() AT TIME ZONE 'utc' + $1::integer * interval '1 second' WHERE organization = $2 AND id = $3",
+		int(roundRetryDelay(attempts).Seconds()),
 		orgname,
 		roundID,
 	)
@@ -320,3 +760,85 @@ func rescheduleRound(orgname string, roundDate string, roundID int) error {
 
 	return nil
 }
+
+// rollbackRound : Delete the groups made in a completed round, recompute the pairing history from the
+// remaining pairs, and set the round back to scheduled on a new date. Returns the deleted groups
+func rollbackRound(db *sql.DB, orgname string, roundID int, newDate time.Time) ([]GetPairsResponsePair, error) {
+	status, err := getRoundStatus(db, orgname, roundID)
+	if err == sql.ErrNoRows {
+		return nil, ErrRoundNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != RoundStatusDone {
+		return nil, ErrRoundNotDone
+	}
+
+	groups, err := getRoundGroupsFromDB(db, orgname, roundID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM feedback WHERE organization = $1 AND round = $2", orgname, roundID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM pairs WHERE organization = $1 AND round = $2", orgname, roundID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rebuildPairHistory(tx, orgname)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE rounds SET done = false, status = $1, attempts = 0, last_error = NULL, last_attempt_at = NULL,
+		next_attempt_at = NULL, scheduled_date = $2 WHERE organization = $3 AND id = $4 AND done = true`,
+		RoundStatusScheduled,
+		newDate,
+		orgname,
+		roundID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return nil, ErrRoundNotDone
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	emitEvent(db, orgname, EventRoundRolledBack, RoundEventData{Round: roundID})
+
+	return groups, nil
+}
+
+// sendDisregardEmails : Email each group of a rolled back round to disregard it
+func sendDisregardEmails(orgname string, groups []GetPairsResponsePair) error {
+	for _, group := range groups {
+		toEmails := []string{group.Member1.Email, group.Member2.Email}
+		if group.ExtraMember.Email != "" {
+			toEmails = append(toEmails, group.ExtraMember.Email)
+		}
+
+		err := sendMailgunMessage(orgname, DisregardEmailSubject, DisregardEmailText, toEmails)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
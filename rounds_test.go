@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseRoundDate(t *testing.T) {
+	t.Log("Test that round dates are parsed in RFC 3339 or in the organization's time zone")
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		// explicit offsets win over the organization's time zone
+		"2019-01-02T18:30:00Z":      "2019-01-02T18:30:00Z",
+		"2019-01-02T18:30:00+07:00": "2019-01-02T11:30:00Z",
+		"2019-01-02T18:30:00 07:00": "2019-01-02T11:30:00Z",
+		// local dates & times follow DST in the organization's time zone
+		"2019-01-02 18:30":    "2019-01-02T23:30:00Z",
+		"2019-07-02T18:30":    "2019-07-02T22:30:00Z",
+		"2019-07-02 18:30:15": "2019-07-02T22:30:15Z",
+	}
+
+	for roundDate, expected := range cases {
+		date, err := parseRoundDate(roundDate, loc)
+		if err != nil {
+			t.Errorf("'%s': %s", roundDate, err)
+			continue
+		}
+		if date.UTC().Format(time.RFC3339) != expected {
+			t.Errorf("'%s': expected %s, got %s", roundDate, expected, date.UTC().Format(time.RFC3339))
+		}
+	}
+
+	for _, roundDate := range []string{"", "tomorrow", "2019-13-02 18:30", "2019-01-02"} {
+		_, err := parseRoundDate(roundDate, loc)
+		if err == nil {
+			t.Errorf("expected '%s' to be rejected", roundDate)
+		}
+	}
+}
+
+func TestRoundHandlers(t *testing.T) {
+	t.Log("Test that rounds are scheduled, listed & cancelled through the handlers")
+
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, "test", "admin@gmail.com", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{"org": {"test"}, "round": {"2019-01-02 18:30"}}
+	w := httptest.NewRecorder()
+	app.AddRoundHandler(w, withCaller(httptest.NewRequest("POST", "/round?"+query.Encode(), nil), "other@gmail.com"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected %d for someone who isn't the admin, got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.AddRoundHandler(w, withCaller(httptest.NewRequest("POST", "/round?"+query.Encode(), nil), "admin@gmail.com"))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("Expected the round to be added, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	app.AddRoundHandler(w, withCaller(httptest.NewRequest("GET", "/round?"+query.Encode(), nil), "admin@gmail.com"))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d for a GET, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	app.GetRoundsHandler(w, withCaller(httptest.NewRequest("GET", "/rounds?org=test", nil), "admin@gmail.com"))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("Expected the rounds to be returned, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp GetRoundsResponse
+	err = decodeData(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rounds) != 1 || resp.Rounds[0].ScheduledDate != "2019-01-02T18:30:00-05:00" {
+		t.Fatalf("Expected one round on 2019-01-02T18:30:00-05:00, got %+v", resp.Rounds)
+	}
+	if resp.Rounds[0].Status != RoundStatusScheduled {
+		t.Errorf("Expected the round to be %s, got %s", RoundStatusScheduled, resp.Rounds[0].Status)
+	}
+
+	err = app.Store.CancelRound("test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.Store.RescheduleRound("test", time.Now(), 0)
+	if err != ErrRoundNotPending {
+		t.Errorf("Expected a cancelled round to not be rescheduled, got %v", err)
+	}
+}
+
+// failingAddRoundStore : MemoryStore whose AddRound always fails, as if the database were unreachable
+type failingAddRoundStore struct {
+	*MemoryStore
+}
+
+func (s failingAddRoundStore) AddRound(orgname string, roundDate time.Time) error {
+	return errors.New("connection refused")
+}
+
+func TestAddRoundHandlerErrors(t *testing.T) {
+	t.Log("Test that invalid round dates are rejected w/ 400, while storage errors are reported w/ 500")
+
+	app := &App{Store: failingAddRoundStore{NewMemoryStore()}}
+	err := createOrganization(app.Store, "test", "admin@gmail.com", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	app.AddRoundHandler(w, withCaller(httptest.NewRequest("POST", "/round?org=test&round=tomorrow", nil), "admin@gmail.com"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an invalid date, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	query := url.Values{"org": {"test"}, "round": {"2019-01-02 18:30"}}
+	w = httptest.NewRecorder()
+	app.AddRoundHandler(w, withCaller(httptest.NewRequest("POST", "/round?"+query.Encode(), nil), "admin@gmail.com"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected %d when the round can't be saved, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestCancelRoundWhilePairing(t *testing.T) {
+	t.Log("Test that a round being paired can't be cancelled, and that a cancelled round's groups aren't saved")
+
+	store := NewMemoryStore()
+	app := &App{Store: store}
+	err := createOrganization(store, "test", "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = store.AddRound("test", time.Date(2019, 1, 2+i, 18, 30, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.rounds["test"][0].Status = RoundStatusRunning
+	w := httptest.NewRecorder()
+	app.RemoveRoundHandler(w, withCaller(httptest.NewRequest("DELETE", "/round?org=test&roundId=0", nil), "admin@gmail.com"))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected %d when cancelling a round being paired, got %d", http.StatusConflict, w.Code)
+	}
+
+	err = store.CancelRound("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := Pair{ID1: "a@gmail.com", ID2: "b@gmail.com"}
+	err = store.SaveRound("test", Round{Number: 1, Pairs: map[Pair]bool{pair: true}}, map[Pair]string{pair: "abc"})
+	if err != ErrRoundCancelled {
+		t.Errorf("Expected the groups of a cancelled round not to be saved, got %v", err)
+	}
+}
+
+func TestRescheduleFailedRound(t *testing.T) {
+	t.Log("Test that rescheduling a round that ran out of attempts lets the scheduler try it again")
+
+	store := NewMemoryStore()
+	err := createOrganization(store, "test", "admin@gmail.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AddRound("test", time.Date(2019, 1, 2, 18, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.rounds["test"][0].Status = RoundStatusFailed
+	store.rounds["test"][0].Attempts = RoundMaxAttempts
+
+	err = store.RescheduleRound("test", time.Date(2019, 1, 9, 18, 30, 0, 0, time.UTC), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	round, err := store.GetRound("test", 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if round.Status != RoundStatusScheduled || round.Attempts != 0 {
+		t.Errorf("Expected the round to be scheduled w/ no attempts, got %+v", round)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// APIPrefix : Where the versioned API is mounted
+const APIPrefix = "/api/v1"
+
+// pathParamsContextKey : Request context key for the parameters matched from the path by the Router
+const pathParamsContextKey contextKey = "pathParams"
+
+// Router : Dispatches requests by path & method. Patterns are like '/orgs/{org}/rounds/{roundId}', where
+// '{org}' matches any single segment. Matched parameters are read by handlers w/ getQueryParam, so the same
+// handlers serve both the versioned API & the older query string routes
+type Router struct {
+	prefix string
+	routes []route
+}
+
+type route struct {
+	segments []string
+	handlers map[string]http.Handler
+}
+
+// NewRouter : Create a router for paths under 'prefix' (e.g APIPrefix)
+func NewRouter(prefix string) *Router {
+	return &Router{prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// Handle : Register the handler for requests to 'pattern' w/ 'method'
+func (router *Router) Handle(method string, pattern string, handler http.Handler) {
+	segments := splitPath(pattern)
+	for i := range router.routes {
+		if equalSegments(router.routes[i].segments, segments) {
+			router.routes[i].handlers[method] = handler
+			return
+		}
+	}
+
+	router.routes = append(router.routes, route{
+		segments: segments,
+		handlers: map[string]http.Handler{method: handler},
+	})
+}
+
+// HandleFunc :
+func (router *Router) HandleFunc(method string, pattern string, handler func(w http.ResponseWriter, r *http.Request)) {
+	router.Handle(method, pattern, http.HandlerFunc(handler))
+}
+
+// Routes : Every registered route as 'METHOD /pattern', sorted
+func (router *Router) Routes() []string {
+	routes := []string{}
+	for _, route := range router.routes {
+		for method := range route.handlers {
+			routes = append(routes, method+" /"+strings.Join(route.segments, "/"))
+		}
+	}
+	sort.Strings(routes)
+
+	return routes
+}
+
+// ServeHTTP : 404 if no pattern matches the path, or 405 (w/ the 'Allow' header) if none of the patterns that
+// match it accept the method
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	function := "Router"
+	// segments are split before unescaping, so an organization's name can contain '/'
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, router.prefix+"/") {
+		LogAndWriteErr(w, errors.New("Route does not exist"), http.StatusNotFound, function)
+		return
+	}
+	segments := splitPath(strings.TrimPrefix(path, router.prefix))
+
+	allowed := []string{}
+	for _, route := range router.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+
+		if handler, ok := route.handlers[r.Method]; ok {
+			handler.ServeHTTP(w, withPathParams(r, params))
+			return
+		}
+
+		for method := range route.handlers {
+			allowed = append(allowed, method)
+		}
+	}
+
+	if len(allowed) == 0 {
+		LogAndWriteErr(w, errors.New("Route does not exist"), http.StatusNotFound, function)
+		return
+	}
+
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	LogAndWriteErr(
+		w,
+		errors.New("Only "+strings.Join(allowed, ", ")+" requests are allowed at this route"),
+		http.StatusMethodNotAllowed,
+		function,
+	)
+}
+
+// match : The parameters in the path if it matches the route's pattern
+func (route route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, segment := range route.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = value
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func equalSegments(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withPathParams : Add the parameters matched from the path to the request's context
+func withPathParams(r *http.Request, params map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsContextKey, params))
+}
+
+// getPathParam : A parameter matched from the path by the Router
+func getPathParam(r *http.Request, key string) (string, bool) {
+	params, _ := r.Context().Value(pathParamsContextKey).(map[string]string)
+	value, ok := params[key]
+	return value, ok
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAPIRouter(t *testing.T) {
+	t.Log("Test that the versioned API reads parameters from the path, and answers unknown routes & methods w/ 404 & 405")
+
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, "test/org", "admin@gmail.com", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stands in for the auth middleware
+	mw := Middleware{
+		MiddlewareHandlers: [](func(handler http.Handler) http.Handler){
+			func(handler http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handler.ServeHTTP(w, withCaller(r, "admin@gmail.com"))
+				})
+			},
+		},
+	}
+	router := newAPIRouter(app, mw)
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	org := APIPrefix + "/orgs/" + url.PathEscape("test/org")
+
+	w := request("POST", org+"/rounds?round="+url.QueryEscape("2019-01-02 18:30"))
+	if w.Code >= http.StatusBadRequest {
+		t.Fatalf("Expected the round to be scheduled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("GET", org+"/rounds/0")
+	var round RoundResponse
+	err = decodeData(w.Body.Bytes(), &round)
+	if err != nil || round.ID != 0 {
+		t.Fatalf("Expected round 0, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("PATCH", org+"/rounds/0?round="+url.QueryEscape("2019-01-03 18:30"))
+	if w.Code >= http.StatusBadRequest {
+		t.Errorf("Expected the round to be rescheduled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("GET", org+"/rounds/0/groups")
+	if w.Code >= http.StatusBadRequest || w.Body.String() != `{"data":{"groups":[]}}` {
+		t.Errorf("Expected no groups yet, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = request("GET", org+"/rounds/1")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for a round that doesn't exist, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = request("PUT", org+"/rounds/0")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "DELETE, GET, PATCH" {
+		t.Errorf("Expected %d w/ 'Allow: DELETE, GET, PATCH', got %d w/ '%s'", http.StatusMethodNotAllowed, w.Code, w.Header().Get("Allow"))
+	}
+
+	for _, target := range []string{APIPrefix + "/orgs/test/nothing", APIPrefix + "/orgs//rounds", "/members"} {
+		w = request("GET", target)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected %d, got %d", target, http.StatusNotFound, w.Code)
+		}
+	}
+
+	w = request("DELETE", org+"/rounds/0")
+	if w.Code >= http.StatusBadRequest {
+		t.Errorf("Expected the round to be cancelled, got %d: %s", w.Code, w.Body.String())
+	}
+}
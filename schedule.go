@@ -0,0 +1,691 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnamadeo/server"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultScheduleHorizonDays : How far ahead rounds are materialized if a schedule doesn't say
+	DefaultScheduleHorizonDays = 28
+	// MaxScheduleHorizonDays : Upper bound on how far ahead rounds can be materialized
+	MaxScheduleHorizonDays = 366
+	// ScheduleDateFormat : Format of a schedule's start date & exclusions
+	ScheduleDateFormat = "2006-01-02"
+	// ScheduleTimeFormat : Format of the local time of day rounds are scheduled at
+	ScheduleTimeFormat = "15:04"
+	// RoundDateFormat : Format used to compare round dates (in UTC) when materializing a schedule
+	RoundDateFormat = "2006-01-02 15:04:05"
+
+	// FreqDaily : RRULE frequency for rounds every n days
+	FreqDaily = "DAILY"
+	// FreqWeekly : RRULE frequency for rounds every n weeks
+	FreqWeekly = "WEEKLY"
+	// FreqMonthly : RRULE frequency for rounds every n months
+	FreqMonthly = "MONTHLY"
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Schedule : An organization's recurring round schedule
+type Schedule struct {
+	// RRule : subset of RFC 5545 recurrence rules e.g "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU"
+	RRule string `json:"rrule"`
+	Start string `json:"start"`
+	Time  string `json:"time"`
+	// TimeZone : defaults to the organization's time zone
+	TimeZone    string   `json:"timezone"`
+	HorizonDays int      `json:"horizonDays"`
+	Exclusions  []string `json:"exclusions"`
+}
+
+// Recurrence : Parsed form of a schedule's RRULE
+type Recurrence struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    time.Time
+}
+
+// ScheduledRound : A round that is yet to happen, identified by its ID & UTC date
+type ScheduledRound struct {
+	ID   int
+	Date string
+}
+
+// ScheduleHandler : Combined HTTP handler for reading, setting and removing a recurring schedule
+func (app *App) ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetScheduleHandler(w, r)
+	} else if r.Method == "POST" {
+		app.SetScheduleHandler(w, r)
+	} else if r.Method == "DELETE" {
+		app.RemoveScheduleHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET, POST and DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"ScheduleHandler",
+		)
+	}
+}
+
+// GetScheduleHandler : HTTP handler for retrieving an organization's recurring schedule
+func (app *App) GetScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetScheduleHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleViewer, function) {
+		return
+	}
+
+	schedule, found, err := app.Store.GetSchedule(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+	if !found {
+		LogAndWriteErr(w, errors.New("Organization does not have a recurring schedule"), http.StatusNotFound, function)
+		return
+	}
+
+	LogAndWrite(w, schedule, http.StatusOK, function)
+}
+
+// SetScheduleHandler : HTTP handler for creating or editing a recurring schedule. Upcoming rounds that
+// haven't happened yet are regenerated; rounds that are done are left untouched
+func (app *App) SetScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	function := "SetScheduleHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+	defer r.Body.Close()
+
+	var schedule Schedule
+	err = json.Unmarshal(bytes, &schedule)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	if schedule.HorizonDays == 0 {
+		schedule.HorizonDays = DefaultScheduleHorizonDays
+	}
+	if schedule.TimeZone == "" {
+		loc, err := app.Store.GetOrganizationLocation(orgname)
+		if err != nil {
+			LogAndWriteStatusInternalServerError(w, err, function)
+			return
+		}
+		schedule.TimeZone = loc.String()
+	}
+
+	err = schedule.Validate()
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.SetSchedule(orgname, schedule)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(
+		w,
+		"Successfully set the recurring schedule",
+		http.StatusOK,
+		function,
+	)
+}
+
+// RemoveScheduleHandler : HTTP handler for removing a recurring schedule and cancelling the upcoming rounds it made
+func (app *App) RemoveScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RemoveScheduleHandler"
+	if r.Method != "DELETE" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	err = app.Store.RemoveSchedule(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(
+		w,
+		"Successfully removed the recurring schedule",
+		http.StatusOK,
+		function,
+	)
+}
+
+// parseRRule : Parse the FREQ, INTERVAL, BYDAY, COUNT and UNTIL parts of an RFC 5545 recurrence rule
+func parseRRule(rule string) (Recurrence, error) {
+	recurrence := Recurrence{Interval: 1}
+
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+	for _, part := range strings.Split(rule, ";") {
+		if part == "" {
+			continue
+		}
+
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return Recurrence{}, fmt.Errorf("RRULE part '%s' must be in the KEY=VALUE format", part)
+		}
+		key, value := keyValue[0], keyValue[1]
+
+		switch key {
+		case "FREQ":
+			if value != FreqDaily && value != FreqWeekly && value != FreqMonthly {
+				return Recurrence{}, fmt.Errorf("FREQ must be one of %s, %s or %s", FreqDaily, FreqWeekly, FreqMonthly)
+			}
+			recurrence.Freq = value
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return Recurrence{}, errors.New("INTERVAL must be a positive integer")
+			}
+			recurrence.Interval = interval
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleWeekdays[day]
+				if !ok {
+					return Recurrence{}, fmt.Errorf("BYDAY value '%s' is not a weekday (MO, TU, ...)", day)
+				}
+				recurrence.ByDay = append(recurrence.ByDay, weekday)
+			}
+		case "COUNT":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return Recurrence{}, errors.New("COUNT must be a positive integer")
+			}
+			recurrence.Count = count
+		case "UNTIL":
+			// UNTIL may be a date or a date-time; only the date matters since rounds happen once a day at most
+			if len(value) > 8 {
+				value = value[:8]
+			}
+			until, err := time.Parse("20060102", value)
+			if err != nil {
+				return Recurrence{}, errors.New("UNTIL must be a date in the YYYYMMDD format")
+			}
+			recurrence.Until = until
+		default:
+			return Recurrence{}, fmt.Errorf("RRULE part '%s' is not supported", key)
+		}
+	}
+
+	if recurrence.Freq == "" {
+		return Recurrence{}, errors.New("RRULE must contain FREQ")
+	}
+	if len(recurrence.ByDay) > 0 && recurrence.Freq != FreqWeekly {
+		return Recurrence{}, errors.New("BYDAY is only supported w/ FREQ=WEEKLY")
+	}
+
+	return recurrence, nil
+}
+
+// Validate : Check that every field of the schedule can be parsed
+func (s Schedule) Validate() error {
+	_, err := parseRRule(s.RRule)
+	if err != nil {
+		return err
+	}
+
+	_, err = loadLocation(s.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	_, err = time.Parse(ScheduleDateFormat, s.Start)
+	if err != nil {
+		return errors.New("Start must be a date in the YYYY-MM-DD format")
+	}
+
+	_, err = time.Parse(ScheduleTimeFormat, s.Time)
+	if err != nil {
+		return errors.New("Time must be a local time of day in the HH:mm format")
+	}
+
+	for _, exclusion := range s.Exclusions {
+		_, err = time.Parse(ScheduleDateFormat, exclusion)
+		if err != nil {
+			return fmt.Errorf("Exclusion '%s' must be a date in the YYYY-MM-DD format", exclusion)
+		}
+	}
+
+	if s.HorizonDays < 1 || s.HorizonDays > MaxScheduleHorizonDays {
+		return fmt.Errorf("Horizon must be between 1 and %d days", MaxScheduleHorizonDays)
+	}
+
+	return nil
+}
+
+// Occurrences : Every date in [from, to] that a round should be scheduled on, in ascending order.
+// Dates are computed in the schedule's time zone so rounds stay at the same local time across DST
+func (s Schedule) Occurrences(from time.Time, to time.Time) ([]time.Time, error) {
+	err := s.Validate()
+	if err != nil {
+		return []time.Time{}, err
+	}
+
+	recurrence, _ := parseRRule(s.RRule)
+	loc, _ := time.LoadLocation(s.TimeZone)
+	startDate, _ := time.Parse(ScheduleDateFormat, s.Start)
+	timeOfDay, _ := time.Parse(ScheduleTimeFormat, s.Time)
+
+	excluded := map[string]bool{}
+	for _, exclusion := range s.Exclusions {
+		excluded[exclusion] = true
+	}
+
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, timeOfDay.Hour(), timeOfDay.Minute(), 0, 0, loc)
+	}
+	start := at(startDate.Year(), startDate.Month(), startDate.Day())
+
+	// candidates in each period (day, week or month) that the recurrence lands on
+	periodDates := func(period int) []time.Time {
+		switch recurrence.Freq {
+		case FreqDaily:
+			return []time.Time{at(start.Year(), start.Month(), start.Day()+period*recurrence.Interval)}
+		case FreqWeekly:
+			weekdays := recurrence.ByDay
+			if len(weekdays) == 0 {
+				weekdays = []time.Weekday{start.Weekday()}
+			}
+			// weeks start on Monday, as RRULE's default WKST
+			weekStart := start.Day() - (int(start.Weekday())+6)%7 + period*recurrence.Interval*7
+			dates := []time.Time{}
+			for _, weekday := range weekdays {
+				dates = append(dates, at(start.Year(), start.Month(), weekStart+(int(weekday)+6)%7))
+			}
+			sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+			return dates
+		default:
+			month := start.Month() + time.Month(period*recurrence.Interval)
+			date := at(start.Year(), month, start.Day())
+			// skip months that don't have the start's day of the month (e.g the 31st)
+			if date.Day() != start.Day() {
+				return []time.Time{}
+			}
+			return []time.Time{date}
+		}
+	}
+
+	occurrences := []time.Time{}
+	count := 0
+	for period := 0; ; period++ {
+		dates := periodDates(period)
+		if len(dates) > 0 && dates[0].After(to) {
+			break
+		}
+
+		for _, date := range dates {
+			if date.Before(start) || date.After(to) {
+				continue
+			}
+			if !recurrence.Until.IsZero() && date.Format(ScheduleDateFormat) > recurrence.Until.Format(ScheduleDateFormat) {
+				return occurrences, nil
+			}
+
+			count++
+			if recurrence.Count > 0 && count > recurrence.Count {
+				return occurrences, nil
+			}
+
+			if date.Before(from) || excluded[date.Format(ScheduleDateFormat)] {
+				continue
+			}
+			occurrences = append(occurrences, date)
+		}
+	}
+
+	return occurrences, nil
+}
+
+// withScheduleLock : Run fn while holding the lock the scheduler takes to materialize schedules, so that changes
+// to a schedule (or to the rounds it made) never race it into making duplicate rounds
+func withScheduleLock(db *sql.DB, fn func() error) error {
+	return withAdvisoryLockWait(db, ScheduleLockNamespace, 0, fn)
+}
+
+// roundMove : A round made by a schedule that should be moved to another occurrence
+type roundMove struct {
+	ID   int
+	Date time.Time
+}
+
+// planScheduleChanges : How to make the upcoming rounds made by a schedule (in ID order) match its occurrences.
+// Rounds are moved to the occurrences in order, rather than cancelled & made again, so that round IDs aren't
+// used up and stay in chronological order, which pairing relies on to tell how recently members met. Rounds
+// left over are cancelled, and occurrences left over get new rounds
+func planScheduleChanges(upcomingRounds []ScheduledRound, occurrences []time.Time) ([]roundMove, []int, []time.Time) {
+	moves := []roundMove{}
+	cancels := []int{}
+	for i, round := range upcomingRounds {
+		if i >= len(occurrences) {
+			cancels = append(cancels, round.ID)
+			continue
+		}
+
+		if round.Date != occurrences[i].UTC().Format(RoundDateFormat) {
+			moves = append(moves, roundMove{ID: round.ID, Date: occurrences[i]})
+		}
+	}
+
+	inserts := []time.Time{}
+	if len(occurrences) > len(upcomingRounds) {
+		inserts = occurrences[len(upcomingRounds):]
+	}
+
+	return moves, cancels, inserts
+}
+
+// materializeSchedule : Make sure the rounds table has exactly one round for every occurrence of the
+// schedule between now and its horizon (see planScheduleChanges). Must be run w/ the schedule lock held. Rounds
+// that an admin rescheduled aren't the schedule's anymore, so they're left alone
+func materializeSchedule(db *sql.DB, orgname string, schedule Schedule, now time.Time) error {
+	occurrences, err := schedule.Occurrences(now, now.AddDate(0, 0, schedule.HorizonDays))
+	if err != nil {
+		return err
+	}
+
+	upcomingRounds, err := getUpcomingGeneratedRounds(db, orgname, now)
+	if err != nil {
+		return err
+	}
+
+	moves, cancels, inserts := planScheduleChanges(upcomingRounds, occurrences)
+	for _, move := range moves {
+		err = moveGeneratedRound(db, orgname, move.ID, move.Date)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, roundID := range cancels {
+		err = cancelRound(db, orgname, roundID, false)
+		if err != nil && err != ErrRoundDone && err != ErrRoundRunning {
+			return err
+		}
+	}
+
+	for _, occurrence := range inserts {
+		err = insertRound(db, orgname, occurrence, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveGeneratedRound : Change the date of a round made by a schedule, as long as it hasn't started
+func moveGeneratedRound(db *sql.DB, orgname string, roundID int, roundDate time.Time) error {
+	_, err := db.Exec(
+		"UPDATE rounds SET scheduled_date = $1 WHERE organization = $2 AND id = $3 AND generated = true AND status = $4",
+		roundDate,
+		orgname,
+		roundID,
+		RoundStatusScheduled,
+	)
+	return err
+}
+
+// materializeAllSchedules : Materialize upcoming rounds for every organization w/ a recurring schedule.
+// One organization's broken schedule doesn't stop the others from being materialized
+func materializeAllSchedules(db *sql.DB, now time.Time) error {
+	schedules, err := getAllSchedulesFromDB(db)
+	if err != nil {
+		return err
+	}
+
+	for orgname, schedule := range schedules {
+		err = materializeSchedule(db, orgname, schedule, now)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"logger":   "logrus",
+				"function": "materializeAllSchedules",
+				"org":      orgname,
+			}).Error(err)
+		}
+	}
+
+	return nil
+}
+
+func getScheduleFromDB(db *sql.DB, orgname string) (Schedule, bool, error) {
+	schedules, err := querySchedules(db, "WHERE organization = $1", orgname)
+	if err != nil {
+		return Schedule{}, false, err
+	}
+
+	schedule, found := schedules[orgname]
+	return schedule, found, nil
+}
+
+func getAllSchedulesFromDB(db *sql.DB) (map[string]Schedule, error) {
+	return querySchedules(db, "")
+}
+
+func querySchedules(db *sql.DB, where string, args ...interface{}) (map[string]Schedule, error) {
+	schedules := map[string]Schedule{}
+
+	rows, err := db.Query(
+		"SELECT organization, rrule, to_char(start_date, 'YYYY-MM-DD'), time_of_day, timezone, horizon_days, exclusions FROM schedules "+where,
+		args...,
+	)
+	if err != nil {
+		return schedules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orgname string
+		var schedule Schedule
+		var exclusionsJSON server.JSONB
+		err := rows.Scan(
+			&orgname,
+			&schedule.RRule,
+			&schedule.Start,
+			&schedule.Time,
+			&schedule.TimeZone,
+			&schedule.HorizonDays,
+			&exclusionsJSON,
+		)
+		if err != nil {
+			return schedules, err
+		}
+
+		schedule.Exclusions = []string{}
+		if !exclusionsJSON.IsNull() {
+			err = json.Unmarshal(exclusionsJSON, &schedule.Exclusions)
+			if err != nil {
+				return schedules, err
+			}
+		}
+
+		schedules[orgname] = schedule
+	}
+
+	return schedules, nil
+}
+
+func saveScheduleInDB(db *sql.DB, orgname string, schedule Schedule) error {
+	if schedule.Exclusions == nil {
+		schedule.Exclusions = []string{}
+	}
+	exclusionsBytes, err := json.Marshal(schedule.Exclusions)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO schedules (organization, rrule, start_date, time_of_day, timezone, horizon_days, exclusions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (organization) DO UPDATE SET rrule = $2, start_date = $3, time_of_day = $4, timezone = $5, horizon_days = $6, exclusions = $7`,
+		orgname,
+		schedule.RRule,
+		schedule.Start,
+		schedule.Time,
+		schedule.TimeZone,
+		schedule.HorizonDays,
+		server.JSONB(exclusionsBytes),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// excludeFromScheduleInDB : Add the local date of a round to the exclusions of the organization's schedule
+func excludeFromScheduleInDB(db *sql.DB, orgname string, roundDate time.Time) error {
+	schedule, found, err := getScheduleFromDB(db, orgname)
+	if err != nil || !found {
+		return err
+	}
+
+	loc, err := loadLocation(schedule.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	date := roundDate.In(loc).Format(ScheduleDateFormat)
+	for _, exclusion := range schedule.Exclusions {
+		if exclusion == date {
+			return nil
+		}
+	}
+
+	schedule.Exclusions = append(schedule.Exclusions, date)
+	return saveScheduleInDB(db, orgname, schedule)
+}
+
+func removeSchedule(db *sql.DB, orgname string, now time.Time) error {
+	_, err := db.Exec("DELETE FROM schedules WHERE organization = $1", orgname)
+	if err != nil {
+		return err
+	}
+
+	upcomingRounds, err := getUpcomingGeneratedRounds(db, orgname, now)
+	if err != nil {
+		return err
+	}
+
+	for _, round := range upcomingRounds {
+		err = cancelRound(db, orgname, round.ID, false)
+		if err != nil && err != ErrRoundDone && err != ErrRoundRunning {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getUpcomingGeneratedRounds : Rounds made by a schedule that are after now and haven't started, in ID order
+func getUpcomingGeneratedRounds(db *sql.DB, orgname string, now time.Time) ([]ScheduledRound, error) {
+	rows, err := db.Query(
+		"SELECT id, scheduled_date FROM rounds WHERE organization = $1 AND generated = true AND done = false AND status = $2 AND scheduled_date > $3 ORDER BY id ASC",
+		orgname,
+		RoundStatusScheduled,
+		now,
+	)
+	if err != nil {
+		return []ScheduledRound{}, err
+	}
+	defer rows.Close()
+
+	rounds := []ScheduledRound{}
+	for rows.Next() {
+		var round ScheduledRound
+		var date time.Time
+		err := rows.Scan(&round.ID, &date)
+		if err != nil {
+			return []ScheduledRound{}, err
+		}
+
+		round.Date = date.UTC().Format(RoundDateFormat)
+
+		rounds = append(rounds, round)
+	}
+
+	return rounds, nil
+}
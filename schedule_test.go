@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func formatOccurrences(occurrences []time.Time) []string {
+	dates := []string{}
+	for _, occurrence := range occurrences {
+		dates = append(dates, occurrence.UTC().Format(RoundDateFormat))
+	}
+	return dates
+}
+
+func assertOccurrences(t *testing.T, schedule Schedule, from time.Time, to time.Time, expected []string) {
+	occurrences, err := schedule.Occurrences(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := formatOccurrences(occurrences)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, actual)
+			return
+		}
+	}
+}
+
+func TestScheduleOccurrencesAcrossDST(t *testing.T) {
+	t.Log("Test that every other Tuesday at noon stays at noon local time across a DST change")
+
+	schedule := Schedule{
+		RRule:       "FREQ=WEEKLY;INTERVAL=2;BYDAY=TU",
+		Start:       "2019-10-01",
+		Time:        "12:00",
+		TimeZone:    "America/New_York",
+		HorizonDays: DefaultScheduleHorizonDays,
+		Exclusions:  []string{"2019-11-26"},
+	}
+
+	from := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC)
+	assertOccurrences(t, schedule, from, to, []string{
+		"2019-10-01 16:00:00",
+		"2019-10-15 16:00:00",
+		"2019-10-29 16:00:00",
+		"2019-11-12 17:00:00",
+	})
+}
+
+func TestScheduleOccurrencesFromMidway(t *testing.T) {
+	t.Log("Test that occurrences before 'from' are skipped but still count towards COUNT")
+
+	schedule := Schedule{
+		RRule:       "FREQ=DAILY;INTERVAL=3;COUNT=4",
+		Start:       "2019-01-01",
+		Time:        "09:30",
+		TimeZone:    "UTC",
+		HorizonDays: DefaultScheduleHorizonDays,
+	}
+
+	from := time.Date(2019, 1, 5, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	assertOccurrences(t, schedule, from, to, []string{
+		"2019-01-07 09:30:00",
+		"2019-01-10 09:30:00",
+	})
+}
+
+func TestScheduleOccurrencesMonthly(t *testing.T) {
+	t.Log("Test that monthly schedules skip months w/o the start's day of the month")
+
+	schedule := Schedule{
+		RRule:       "FREQ=MONTHLY;UNTIL=20190601",
+		Start:       "2019-01-31",
+		Time:        "18:00",
+		TimeZone:    "UTC",
+		HorizonDays: DefaultScheduleHorizonDays,
+	}
+
+	from := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)
+	assertOccurrences(t, schedule, from, to, []string{
+		"2019-01-31 18:00:00",
+		"2019-03-31 18:00:00",
+		"2019-05-31 18:00:00",
+	})
+}
+
+func TestParseRRuleErrors(t *testing.T) {
+	t.Log("Test that unsupported or malformed RRULEs are rejected")
+
+	for _, rule := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=YEARLY",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=WEEKLY;INTERVAL=0",
+		"FREQ=WEEKLY;BYSETPOS=1",
+	} {
+		_, err := parseRRule(rule)
+		if err == nil {
+			t.Errorf("expected '%s' to be rejected", rule)
+		}
+	}
+}
+
+func TestPlanScheduleChanges(t *testing.T) {
+	t.Log("Test that upcoming rounds are moved to the schedule's occurrences in order instead of being made again")
+
+	occurrences := []time.Time{
+		time.Date(2019, 10, 1, 16, 0, 0, 0, time.UTC),
+		time.Date(2019, 10, 8, 16, 0, 0, 0, time.UTC),
+		time.Date(2019, 10, 15, 16, 0, 0, 0, time.UTC),
+	}
+
+	upcomingRounds := []ScheduledRound{
+		{ID: 4, Date: "2019-10-01 16:00:00"},
+		{ID: 5, Date: "2019-10-15 16:00:00"},
+	}
+	moves, cancels, inserts := planScheduleChanges(upcomingRounds, occurrences)
+	if len(moves) != 1 || moves[0].ID != 5 || !moves[0].Date.Equal(occurrences[1]) {
+		t.Errorf("expected round 5 to move to %v, got %v", occurrences[1], moves)
+	}
+	if len(cancels) != 0 {
+		t.Errorf("expected no rounds to be cancelled, got %v", cancels)
+	}
+	if len(inserts) != 1 || !inserts[0].Equal(occurrences[2]) {
+		t.Errorf("expected a round to be made for %v, got %v", occurrences[2], inserts)
+	}
+
+	upcomingRounds = append(upcomingRounds, ScheduledRound{ID: 6, Date: "2019-10-22 16:00:00"}, ScheduledRound{ID: 7, Date: "2019-10-29 16:00:00"})
+	moves, cancels, inserts = planScheduleChanges(upcomingRounds, occurrences)
+	if len(moves) != 2 || moves[1].ID != 6 || !moves[1].Date.Equal(occurrences[2]) {
+		t.Errorf("expected rounds 5 & 6 to move, got %v", moves)
+	}
+	if len(cancels) != 1 || cancels[0] != 7 {
+		t.Errorf("expected round 7 to be cancelled, got %v", cancels)
+	}
+	if len(inserts) != 0 {
+		t.Errorf("expected no rounds to be made, got %v", inserts)
+	}
+}
+
+func TestSetScheduleHandlerMovesRounds(t *testing.T) {
+	t.Log("Test that editing a schedule moves its upcoming rounds instead of making new ones, and leaves rescheduled rounds alone")
+
+	app := &App{Store: NewMemoryStore()}
+	err := createOrganization(app.Store, "test", "admin@gmail.com", "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSchedule := func(rrule string) {
+		body := `{"rrule": "` + rrule + `", "start": "2019-01-01", "time": "12:00", "horizonDays": 28}`
+		w := httptest.NewRecorder()
+		app.SetScheduleHandler(w, withCaller(httptest.NewRequest("POST", "/schedule?org=test", strings.NewReader(body)), "admin@gmail.com"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the schedule to be set, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	setSchedule("FREQ=WEEKLY;BYDAY=MO")
+	rounds, err := app.Store.GetRounds("test", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) < 4 {
+		t.Fatalf("Expected a round for every Monday in the next 28 days, got %+v", rounds)
+	}
+
+	err = app.Store.RescheduleRound("test", time.Now().AddDate(0, 0, 2), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSchedule("FREQ=WEEKLY;BYDAY=TU")
+	rounds, err = app.Store.GetRounds("test", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, round := range rounds {
+		if round.Status != RoundStatusScheduled {
+			t.Fatalf("Expected the rounds to be moved rather than cancelled & made again, got %+v", rounds)
+		}
+	}
+	for _, round := range rounds[1:] {
+		date, err := time.Parse(time.RFC3339, round.ScheduledDate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if date.Weekday() != time.Tuesday {
+			t.Errorf("Expected round %d to be moved to a Tuesday, got %s", round.ID, round.ScheduledDate)
+		}
+	}
+	if rounds[0].Status != RoundStatusScheduled || strings.HasSuffix(rounds[0].ScheduledDate, "T12:00:00Z") {
+		t.Errorf("Expected the rescheduled round to be left alone, got %+v", rounds[0])
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SchedulerMaxSleep : Longest the scheduler sleeps, so rounds added in the meantime aren't missed
+	SchedulerMaxSleep = 5 * time.Minute
+	// SchedulerMinSleep : Shortest the scheduler sleeps, so a round that keeps failing isn't retried in a hot loop
+	SchedulerMinSleep = 10 * time.Second
+	// ScheduleLockNamespace : Advisory lock namespace for materializing recurring schedules
+	ScheduleLockNamespace = "mealbot.schedules"
+)
+
+// ErrLocked : Returned when another scheduler instance is already doing the same work
+var ErrLocked = errors.New("locked by another scheduler")
+
+// Scheduler : Long-running replacement for running `mealbot pair` from an external cron
+type Scheduler struct {
+	DB       *sql.DB
+	TestMode bool
+	MaxSleep time.Duration
+
+	mutex    sync.Mutex
+	running  bool
+	nextWake time.Time
+	lastRun  time.Time
+	lastErr  error
+}
+
+// SchedulerStatus : Data structure for reporting what the scheduler is up to
+type SchedulerStatus struct {
+	Running   bool   `json:"running"`
+	NextWake  string `json:"nextWake,omitempty"`
+	LastRun   string `json:"lastRun,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// NewScheduler :
+func NewScheduler(db *sql.DB, testMode bool) *Scheduler {
+	return &Scheduler{
+		DB:       db,
+		TestMode: testMode,
+		MaxSleep: SchedulerMaxSleep,
+	}
+}
+
+// Run : Pair due rounds, then sleep until the next round is due, until ctx is cancelled. Rounds that are
+// being paired when ctx is cancelled are allowed to finish
+func (s *Scheduler) Run(ctx context.Context) {
+	s.setRunning(true)
+	defer s.setRunning(false)
+
+	for {
+		runErr := runPairingScheduler(s.DB, s.TestMode)
+		if runErr != nil {
+			log.WithFields(log.Fields{
+				"logger":   "logrus",
+				"function": "Scheduler.Run",
+			}).Error(runErr)
+		}
+
+		sleep, err := s.timeUntilNextRound()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"logger":   "logrus",
+				"function": "Scheduler.Run",
+			}).Error(err)
+			sleep = s.MaxSleep
+		}
+
+		nextWake := time.Now().Add(sleep)
+		s.recordRun(nextWake, runErr)
+		log.WithFields(log.Fields{
+			"logger":   "logrus",
+			"function": "Scheduler.Run",
+		}).Infof("scheduler sleeping until %s", nextWake.UTC().Format(time.RFC3339))
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Status : Snapshot of the scheduler's state
+func (s *Scheduler) Status() SchedulerStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := SchedulerStatus{Running: s.running}
+	if !s.nextWake.IsZero() {
+		status.NextWake = s.nextWake.UTC().Format(time.RFC3339)
+	}
+	if !s.lastRun.IsZero() {
+		status.LastRun = s.lastRun.UTC().Format(time.RFC3339)
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+
+	return status
+}
+
+func (s *Scheduler) setRunning(running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running = running
+}
+
+func (s *Scheduler) recordRun(nextWake time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastRun = time.Now()
+	s.nextWake = nextWake
+	s.lastErr = err
+}
+
+// timeUntilNextRound : How long to sleep until the earliest round that isn't done, clamped between
+// SchedulerMinSleep and MaxSleep
+func (s *Scheduler) timeUntilNextRound() (time.Duration, error) {
+	var seconds sql.NullFloat64
+	// failed rounds aren't due again until they're next retried
+	err := s.DB.QueryRow(
+		`SELECT EXTRACT(EPOCH FROM MIN(GREATEST(scheduled_date, COALESCE(next_attempt_at AT TIME ZONE 'utc', scheduled_date))) - now())
+		FROM rounds WHERE done = false AND status <> $1 AND attempts < $2`,
+		RoundStatusCancelled,
+		RoundMaxAttempts,
+	).Scan(&seconds)
+	if err != nil {
+		return s.MaxSleep, err
+	}
+
+	if !seconds.Valid {
+		return s.MaxSleep, nil
+	}
+
+	sleep := time.Duration(seconds.Float64 * float64(time.Second))
+	if sleep < SchedulerMinSleep {
+		return SchedulerMinSleep, nil
+	}
+	if sleep > s.MaxSleep {
+		return s.MaxSleep, nil
+	}
+
+	return sleep, nil
+}
+
+// withAdvisoryLock : Run fn while holding a transaction-level Postgres advisory lock on (namespace, key),
+// so that multiple scheduler instances never do the same work twice. Returns ErrLocked if another
+// instance holds the lock. The lock is released when the transaction ends
+func withAdvisoryLock(db *sql.DB, namespace string, key int, fn func() error) error {
+	return runWithAdvisoryLock(db, "SELECT pg_try_advisory_xact_lock(hashtext($1), $2)", namespace, key, fn)
+}
+
+// withAdvisoryLockWait : Like withAdvisoryLock, but waits for the lock instead of returning ErrLocked. fn runs on
+// other connections than the lock's, so it mustn't wait for the same lock
+func withAdvisoryLockWait(db *sql.DB, namespace string, key int, fn func() error) error {
+	return runWithAdvisoryLock(db, "SELECT true FROM pg_advisory_xact_lock(hashtext($1), $2)", namespace, key, fn)
+}
+
+func runWithAdvisoryLock(db *sql.DB, lockQuery string, namespace string, key int, fn func() error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRow(lockQuery, namespace, key).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrLocked
+	}
+
+	err = fn()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runPairingRoundWithLock : Run a round unless another scheduler instance is running or already ran it
+func runPairingRoundWithLock(db *sql.DB, orgname string, roundNum int, testMode bool) error {
+	return withAdvisoryLock(db, orgname, roundNum, func() error {
+		// another instance may have finished the round (or an admin cancelled it) between our query for
+		// due rounds and taking the lock
+		status, err := getRoundStatus(db, orgname, roundNum)
+		if err != nil {
+			return err
+		}
+		if status == RoundStatusDone || status == RoundStatusCancelled {
+			return nil
+		}
+
+		err = markRoundRunning(db, orgname, roundNum)
+		if err != nil {
+			return err
+		}
+
+		return runPairingRound(NewPostgresStore(db), orgname, roundNum, testMode)
+	})
+}
+
+func getRoundStatus(db *sql.DB, orgname string, roundNum int) (string, error) {
+	var status string
+	err := db.QueryRow(
+		"SELECT status FROM rounds WHERE organization = $1 AND id = $2",
+		orgname,
+		roundNum,
+	).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// GetSchedulerStatusHandler : HTTP handler for checking on the scheduler running inside the server
+func (app *App) GetSchedulerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetSchedulerStatusHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	status := SchedulerStatus{}
+	if app.Scheduler != nil {
+		status = app.Scheduler.Status()
+	}
+
+	LogAndWrite(w, status, http.StatusOK, function)
+}
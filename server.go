@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// ShutdownTimeout : Max. time to wait for in-flight requests when the server is stopped
+const ShutdownTimeout = 20 * time.Second
+
 // Middleware class
 type Middleware struct {
 	MiddlewareHandlers [](func(handler http.Handler) http.Handler)
@@ -32,13 +41,70 @@ func (mw Middleware) ApplyFake(
 	return http.Handler(http.HandlerFunc(coreHandler))
 }
 
-func runTestSequence(testMode bool) {
-	err := createOrganization("ysc", "johnamadeo.daniswara@yale.edu")
+// newAPIRouter : Routes of the versioned API. Every route except '/feedback' is wrapped w/ 'mw', which should
+// authenticate the caller
+func newAPIRouter(app *App, mw Middleware) *Router {
+	router := NewRouter(APIPrefix)
+
+	router.Handle("GET", "/orgs", mw.Apply(app.GetOrganizationsHandler))
+	router.Handle("POST", "/orgs", mw.Apply(app.CreateOrganizationHandler))
+
+	router.Handle("GET", "/orgs/{org}/members", mw.Apply(app.GetMembersHandler))
+	router.Handle("POST", "/orgs/{org}/members", mw.Apply(app.CreateMembersHandler))
+
+	router.Handle("GET", "/orgs/{org}/admins", mw.Apply(app.GetAdminsHandler))
+	router.Handle("POST", "/orgs/{org}/admins", mw.Apply(app.SetAdminHandler))
+	router.Handle("DELETE", "/orgs/{org}/admins/{email}", mw.Apply(app.RemoveAdminHandler))
+	router.Handle("POST", "/orgs/{org}/admins/transfer", mw.Apply(app.TransferOwnershipHandler))
+
+	router.Handle("GET", "/orgs/{org}/apikeys", mw.Apply(app.GetAPIKeysHandler))
+	router.Handle("POST", "/orgs/{org}/apikeys", mw.Apply(app.CreateAPIKeyHandler))
+	router.Handle("DELETE", "/orgs/{org}/apikeys/{id}", mw.Apply(app.RevokeAPIKeyHandler))
+
+	router.Handle("POST", "/orgs/{org}/crossmatchtrait", mw.Apply(app.CrossMatchTraitHandler))
+	router.Handle("GET", "/orgs/{org}/timezone", mw.Apply(app.TimeZoneHandler))
+	router.Handle("POST", "/orgs/{org}/timezone", mw.Apply(app.TimeZoneHandler))
+	router.Handle("POST", "/orgs/{org}/avoidmissedpairs", mw.Apply(app.AvoidMissedPairsHandler))
+	router.Handle("GET", "/orgs/{org}/chatwebhook", mw.Apply(app.GetChatWebhookHandler))
+	router.Handle("POST", "/orgs/{org}/chatwebhook", mw.Apply(app.SetChatWebhookHandler))
+
+	router.Handle("GET", "/orgs/{org}/schedule", mw.Apply(app.GetScheduleHandler))
+	router.Handle("POST", "/orgs/{org}/schedule", mw.Apply(app.SetScheduleHandler))
+	router.Handle("DELETE", "/orgs/{org}/schedule", mw.Apply(app.RemoveScheduleHandler))
+
+	router.Handle("GET", "/orgs/{org}/rounds", mw.Apply(app.GetRoundsHandler))
+	router.Handle("POST", "/orgs/{org}/rounds", mw.Apply(app.AddRoundHandler))
+	router.Handle("GET", "/orgs/{org}/rounds/{roundId}", mw.Apply(app.GetRoundHandler))
+	router.Handle("PATCH", "/orgs/{org}/rounds/{roundId}", mw.Apply(app.RescheduleRoundHandler))
+	router.Handle("DELETE", "/orgs/{org}/rounds/{roundId}", mw.Apply(app.RemoveRoundHandler))
+	router.Handle("GET", "/orgs/{org}/rounds/{roundId}/groups", mw.Apply(app.GetRoundGroupsHandler))
+	router.Handle("POST", "/orgs/{org}/rounds/{roundId}/rollback", mw.Apply(app.RollbackRoundHandler))
+
+	router.Handle("GET", "/orgs/{org}/pairs", mw.Apply(app.GetPairsHandler))
+	router.Handle("POST", "/orgs/{org}/history/rebuild", mw.Apply(app.RebuildHistoryHandler))
+	router.Handle("GET", "/orgs/{org}/feedbackstats", mw.Apply(app.GetFeedbackStatsHandler))
+
+	router.Handle("GET", "/orgs/{org}/webhooks", mw.Apply(app.GetWebhooksHandler))
+	router.Handle("POST", "/orgs/{org}/webhooks", mw.Apply(app.CreateWebhookHandler))
+	router.Handle("DELETE", "/orgs/{org}/webhooks/{id}", mw.Apply(app.RemoveWebhookHandler))
+	router.Handle("GET", "/orgs/{org}/webhooks/deliveries", mw.Apply(app.GetWebhookDeliveriesHandler))
+
+	router.Handle("GET", "/scheduler", mw.Apply(app.GetSchedulerStatusHandler))
+
+	// feedback links are opened straight from the pairing email, so they're authenticated by token instead
+	router.HandleFunc("GET", "/feedback", app.FeedbackHandler)
+	router.HandleFunc("POST", "/feedback", app.FeedbackHandler)
+
+	return router
+}
+
+func runTestSequence(store Store, testMode bool) {
+	err := createOrganization(store, "ysc", "johnamadeo.daniswara@yale.edu", "America/New_York")
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	_, err = createMembersFromCSV("ysc", "./csv/test_john3.csv")
+	_, err = createMembersFromCSV(store, "ysc", "./csv/test_john3.csv")
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -46,14 +112,14 @@ func runTestSequence(testMode bool) {
 
 	i := 0
 	for i < 2 {
-		err = addRound("ysc", fmt.Sprintf("2019-01-02 %d:55:00", i))
+		err = store.AddRound("ysc", time.Date(2019, 1, 2, i, 55, 0, 0, time.UTC))
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
 		// NOTE: Do you want to actually send out emails?
-		err = runPairingRound("ysc", i, testMode)
+		err = runPairingRound(store, "ysc", i, testMode)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -65,47 +131,226 @@ func runTestSequence(testMode bool) {
 
 func main() {
 	args := os.Args
+
+	// every command shares a single connection pool
+	db, err := openDBFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(args) > 1 && args[1] == "rebuild-history" {
+		runRebuildHistoryCommand(db, args[2:])
+		return
+	}
+
+	if len(args) > 1 && args[1] == "migrate" {
+		err := runMigrateCommand(db, args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(args) == 2 {
 		if args[1] == "pair" {
 			// runTestSequence(true)
-			err := runPairingScheduler(false)
+			err := runPairingScheduler(db, false)
 			if err != nil {
 				fmt.Println(err)
 			}
-			return
-		} else if args[1] == "migrate" {
-			err := migrateToLastRoundWithForPairing()
+
+			// give round.completed events a first delivery attempt before the process exits
+			err = deliverPendingWebhooks(db)
 			if err != nil {
 				fmt.Println(err)
 			}
 			return
+		} else if args[1] == "scheduler" {
+			// long-running alternative to running `mealbot pair` from an external cron
+			ctx, cancel := context.WithCancel(context.Background())
+			go cancelOnShutdownSignal(cancel)
+
+			NewScheduler(db, false).Run(ctx)
+			return
 		} else {
 			fmt.Printf("argument '%s' not recognized", args[1])
 			return
 		}
 	}
 
+	authConfig, err := loadAuthConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	corsConfig, err := loadCorsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &App{DB: db, Store: NewPostgresStore(db)}
+
+	// both the versioned API & the older routes share one auth handler, so that they share its JWKS cache
+	authHandler := NewAuthHandler(authConfig, app.Store)
+
 	mw := Middleware{
 		MiddlewareHandlers: [](func(handler http.Handler) http.Handler){
-			GetAuthHandler,
-			GetCorsHandler,
+			authHandler,
+			NewCorsHandler(corsConfig),
+		},
+	}
+
+	publicMw := Middleware{
+		MiddlewareHandlers: [](func(handler http.Handler) http.Handler){
+			NewCorsHandler(corsConfig),
+		},
+	}
+
+	authMw := Middleware{
+		MiddlewareHandlers: [](func(handler http.Handler) http.Handler){
+			authHandler,
 		},
 	}
 
 	serveMux := http.NewServeMux()
-	serveMux.Handle("/members", mw.Apply(MembersHandler))
-	serveMux.Handle("/orgs", mw.Apply(GetOrganizationsHandler))
-	serveMux.Handle("/org", mw.Apply(CreateOrganizationHandler))
-	serveMux.Handle("/crossmatchtrait", mw.Apply(CrossMatchTraitHandler))
-	serveMux.Handle("/rounds", mw.Apply(GetRoundsHandler))
-	serveMux.Handle("/round", mw.Apply(RoundHandler))
-	serveMux.Handle("/pairs", mw.Apply(GetPairsHandler))
+	// CORS wraps the whole router, so that its 404s & 405s can be read by the frontend too
+	serveMux.Handle(APIPrefix+"/", NewCorsHandler(corsConfig)(newAPIRouter(app, authMw)))
+
+	// the routes before the versioned API are kept as aliases for older clients & scripts
+	serveMux.Handle("/members", mw.Apply(app.MembersHandler))
+	serveMux.Handle("/orgs", mw.Apply(app.GetOrganizationsHandler))
+	serveMux.Handle("/org", mw.Apply(app.CreateOrganizationHandler))
+	serveMux.Handle("/admins", mw.Apply(app.AdminsHandler))
+	serveMux.Handle("/admins/transfer", mw.Apply(app.TransferOwnershipHandler))
+	serveMux.Handle("/apikeys", mw.Apply(app.APIKeysHandler))
+	serveMux.Handle("/crossmatchtrait", mw.Apply(app.CrossMatchTraitHandler))
+	serveMux.Handle("/timezone", mw.Apply(app.TimeZoneHandler))
+	serveMux.Handle("/rounds", mw.Apply(app.GetRoundsHandler))
+	serveMux.Handle("/round", mw.Apply(app.RoundHandler))
+	serveMux.Handle("/round/rollback", mw.Apply(app.RollbackRoundHandler))
+	serveMux.Handle("/schedule", mw.Apply(app.ScheduleHandler))
+	serveMux.Handle("/history/rebuild", mw.Apply(app.RebuildHistoryHandler))
+	serveMux.Handle("/pairs", mw.Apply(app.GetLegacyPairsHandler))
+	serveMux.Handle("/feedbackstats", mw.Apply(app.GetFeedbackStatsHandler))
+	serveMux.Handle("/avoidmissedpairs", mw.Apply(app.AvoidMissedPairsHandler))
+	serveMux.Handle("/chatwebhook", mw.Apply(app.ChatWebhookHandler))
+	serveMux.Handle("/webhooks", mw.Apply(app.WebhooksHandler))
+	serveMux.Handle("/webhookdeliveries", mw.Apply(app.GetWebhookDeliveriesHandler))
+	serveMux.Handle("/scheduler", mw.Apply(app.GetSchedulerStatusHandler))
+	// feedback links are opened straight from the pairing email, so they're authenticated by token instead
+	serveMux.Handle("/feedback", publicMw.Apply(app.FeedbackHandler))
+	serveMux.Handle("/openapi.json", publicMw.Apply(OpenAPIHandler))
 	serveMux.Handle("/", http.FileServer(http.Dir("./static")))
 
+	go runWebhookDeliveryWorker(db)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Fatal(http.ListenAndServe(":"+port, serveMux))
+	httpServer := &http.Server{Addr: ":" + port, Handler: serveMux}
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancelOnShutdownSignal(cancel)
+
+	// the scheduler can run inside the web server instead of as a separate process
+	schedulerDone := make(chan bool, 1)
+	if os.Getenv("RUN_SCHEDULER") == "true" {
+		app.Scheduler = NewScheduler(db, false)
+		go func() {
+			app.Scheduler.Run(ctx)
+			schedulerDone <- true
+		}()
+	} else {
+		schedulerDone <- true
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancelShutdown()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	err = httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// let a round that's being paired finish before exiting
+	<-schedulerDone
+}
+
+// runRebuildHistoryCommand : `mealbot rebuild-history [--org <name>] [--dry-run]`. Every organization is
+// rebuilt if '--org' isn't given
+func runRebuildHistoryCommand(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("rebuild-history", flag.ExitOnError)
+	orgname := flags.String("org", "", "organization whose pairing history should be rebuilt (default every organization)")
+	dryRun := flags.Bool("dry-run", false, "report inconsistencies without saving anything")
+	flags.Parse(args)
+
+	orgnames := []string{*orgname}
+	if *orgname == "" {
+		var err error
+		orgnames, err = getAllOrganizationsFromDB(db)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	failed := false
+	for _, orgname := range orgnames {
+		report, err := rebuildHistory(db, orgname, *dryRun)
+		if err != nil {
+			fmt.Printf("%s: %s\n", orgname, err)
+			failed = true
+			continue
+		}
+
+		for _, inconsistency := range report.Inconsistencies {
+			fmt.Printf(
+				"%s: %s -> %s: stored %s, computed %s\n",
+				orgname,
+				inconsistency.Member,
+				inconsistency.Partner,
+				formatHistoryRound(inconsistency.Stored),
+				formatHistoryRound(inconsistency.Computed),
+			)
+		}
+
+		verb := "updated"
+		if report.DryRun {
+			verb = "would update"
+		}
+		fmt.Printf(
+			"%s: %d inconsistencies across %d pairs; %s %d pairs\n",
+			orgname,
+			len(report.Inconsistencies),
+			report.PairsChecked,
+			verb,
+			report.PairsUpdated,
+		)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func formatHistoryRound(round *int) string {
+	if round == nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d", *round)
+}
+
+// cancelOnShutdownSignal : Cancel when the process is asked to stop (e.g by Heroku when restarting dynos)
+func cancelOnShutdownSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	cancel()
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/johnamadeo/server"
+)
+
+// Store : Persistence for organizations, members, rounds & pairs, so that the HTTP handlers & the pairing flow
+// don't depend on Postgres directly. PostgresStore is used by the server & scheduler, while MemoryStore lets
+// them be tested w/o a database
+type Store interface {
+	// GetOrganizations : Organizations that the user has any role in
+	GetOrganizations(user string) ([]string, error)
+	// CreateOrganization : The organization's Admin becomes its owner; ErrOrganizationExists if the name is taken
+	CreateOrganization(org Organization) error
+	GetCrossMatchTrait(orgname string) (string, error)
+	SetCrossMatchTrait(orgname string, crossMatchTrait string) error
+	GetOrganizationLocation(orgname string) (*time.Location, error)
+	SetTimeZone(orgname string, timezone string) error
+	GetAvoidMissedPairs(orgname string) (bool, error)
+	SetAvoidMissedPairs(orgname string, avoid bool) error
+	GetChatWebhook(orgname string) (ChatWebhook, error)
+	SetChatWebhook(orgname string, webhook ChatWebhook) error
+
+	// GetRole : The user's role in the organization, or "" if they have none (or it doesn't exist)
+	GetRole(orgname string, user string) (string, error)
+	GetAdmins(orgname string) ([]OrganizationAdmin, error)
+	// SetAdmin : Invite an admin or change their role; ErrOwnerRole if they're the owner
+	SetAdmin(orgname string, email string, role string) error
+	// RemoveAdmin : ErrAdminNotFound if they aren't an admin, or ErrOwnerRole if they're the owner
+	RemoveAdmin(orgname string, email string) error
+	// TransferOwnership : Make 'email' the owner; the previous owner becomes an admin
+	TransferOwnership(orgname string, email string) error
+
+	// CreateAPIKey : Save a new key w/ the hash of its secret, and return it w/ its ID & creation time
+	CreateAPIKey(apiKey APIKey, keyHash string) (APIKey, error)
+	// GetAPIKeys : Every key of the organization, including revoked ones
+	GetAPIKeys(orgname string) ([]APIKey, error)
+	// GetAPIKeyByHash : ErrAPIKeyNotFound if there's no such key, or it has been revoked
+	GetAPIKeyByHash(keyHash string) (APIKey, error)
+	// TouchAPIKey : Record that a key was just used
+	TouchAPIKey(apiKeyID int) error
+	// RevokeAPIKey : ErrAPIKeyNotFound if the key doesn't exist or has already been revoked
+	RevokeAPIKey(orgname string, apiKeyID int) error
+
+	// GetMembers : Members ordered by name, including deactivated ones unless 'onlyActive' is set
+	GetMembers(orgname string, onlyActive bool) ([]Member, error)
+	InsertMember(member Member) error
+	// UpdateMember : Save a member's name & metadata, and (re)activate them
+	UpdateMember(member Member) error
+	DeactivateMember(orgname string, email string) error
+
+	GetRounds(orgname string, loc *time.Location) ([]RoundResponse, error)
+	// GetRound : A single round along w/ its groups; ErrRoundNotFound if it doesn't exist
+	GetRound(orgname string, roundID int, loc *time.Location) (RoundResponse, error)
+	// AddRound : Schedule a new round after the latest one
+	AddRound(orgname string, roundDate time.Time) error
+	// RescheduleRound : Failed rounds are scheduled again w/ a fresh set of attempts. ErrRoundNotPending if the
+	// round is being paired, has been paired or cancelled, or doesn't exist
+	RescheduleRound(orgname string, roundDate time.Time, roundID int) error
+	// CancelRound : ErrRoundNotFound, ErrRoundDone or ErrRoundRunning if the round can't be cancelled
+	CancelRound(orgname string, roundID int) error
+	// RollbackRound : Discard the groups made in a completed round & return them, and schedule the round again on
+	// 'newDate'. ErrRoundNotFound or ErrRoundNotDone if it can't be rolled back
+	RollbackRound(orgname string, roundID int, newDate time.Time) ([]GetPairsResponsePair, error)
+
+	// GetSchedule : 'found' is false if the organization doesn't have a recurring schedule
+	GetSchedule(orgname string) (Schedule, bool, error)
+	// SetSchedule : Save the recurring schedule and make (or move) rounds for its upcoming occurrences
+	SetSchedule(orgname string, schedule Schedule) error
+	// RemoveSchedule : Remove the recurring schedule and cancel the upcoming rounds it made
+	RemoveSchedule(orgname string) error
+
+	// GetPairs : Groups of the rounds that match the filter, in round order w/ only active members filled in.
+	// Rounds w/o any matching groups are skipped
+	GetPairs(orgname string, filter PairsFilter) ([]RoundPairs, error)
+	// SaveRound : Save the groups made in a round along w/ their feedback tokens, update the pairing history, and
+	// mark the round done, all at once. ErrRoundCancelled if the round was cancelled while it was being paired
+	SaveRound(orgname string, round Round, tokens map[Pair]string) error
+	// GetMissedPairs : For each member, the members they didn't meet the last time they were grouped together
+	GetMissedPairs(orgname string) (map[string]map[string]bool, error)
+	// FeedbackTokenExists : Whether a group was sent the feedback token
+	FeedbackTokenExists(token string) (bool, error)
+	// SaveFeedback : Record a group's response; returns false if no group has the token
+	SaveFeedback(token string, body SubmitFeedbackRequestBody) (bool, error)
+	// GetFeedbackStats : How many groups responded & met in each round that feedback was asked for, in round order
+	GetFeedbackStats(orgname string) ([]FeedbackRoundStats, error)
+
+	// GetPairHistory : The last round every pair of members in the organization were grouped together
+	GetPairHistory(orgname string) (PairHistory, error)
+	// GetPartners : Every member that has been grouped w/ 'email', and the last round they were
+	GetPartners(orgname string, email string) (map[string]int, error)
+	// GetLastRoundTogether : The last round 2 members were grouped together, or -1 if they never have been
+	GetLastRoundTogether(orgname string, email1 string, email2 string) (int, error)
+	// RebuildHistory : Recompute the pairing history from the groups made so far, and save it unless 'dryRun'
+	RebuildHistory(orgname string, dryRun bool) (RebuildHistoryReport, error)
+
+	GetWebhooks(orgname string) ([]Webhook, error)
+	CreateWebhook(orgname string, url string, secret string) (Webhook, error)
+	// RemoveWebhook : ErrWebhookNotFound if the organization doesn't have such a webhook
+	RemoveWebhook(orgname string, webhookID int) error
+	// GetWebhookDeliveries : The WebhookDeliveryLogLimit most recent deliveries, newest first
+	GetWebhookDeliveries(orgname string) ([]WebhookDelivery, error)
+
+	// EmitEvent : Notify the organization's webhooks; failures are logged rather than returned
+	EmitEvent(orgname string, eventType string, data interface{})
+}
+
+// PostgresStore : Store backed by the shared connection pool
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore :
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// GetOrganizations :
+func (s *PostgresStore) GetOrganizations(user string) ([]string, error) {
+	return getOrganizations(s.db, user)
+}
+
+// CreateOrganization :
+func (s *PostgresStore) CreateOrganization(org Organization) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO organizations (name, timezone) VALUES ($1, $2)",
+		org.Name,
+		org.TimeZone,
+	)
+	if err != nil && strings.Contains(err.Error(), DuplicateKeyErr) {
+		return ErrOrganizationExists
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO organization_admins (organization, email, role) VALUES ($1, $2, $3)",
+		org.Name,
+		org.Admin,
+		RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetCrossMatchTrait :
+func (s *PostgresStore) GetCrossMatchTrait(orgname string) (string, error) {
+	return GetCrossMatchTrait(s.db, orgname)
+}
+
+// SetCrossMatchTrait :
+func (s *PostgresStore) SetCrossMatchTrait(orgname string, crossMatchTrait string) error {
+	return setCrossMatchTrait(s.db, orgname, crossMatchTrait)
+}
+
+// GetOrganizationLocation :
+func (s *PostgresStore) GetOrganizationLocation(orgname string) (*time.Location, error) {
+	return getOrganizationLocation(s.db, orgname)
+}
+
+// SetTimeZone :
+func (s *PostgresStore) SetTimeZone(orgname string, timezone string) error {
+	return setTimeZone(s.db, orgname, timezone)
+}
+
+// GetAvoidMissedPairs :
+func (s *PostgresStore) GetAvoidMissedPairs(orgname string) (bool, error) {
+	return getAvoidMissedPairs(s.db, orgname)
+}
+
+// SetAvoidMissedPairs :
+func (s *PostgresStore) SetAvoidMissedPairs(orgname string, avoid bool) error {
+	return setAvoidMissedPairs(s.db, orgname, avoid)
+}
+
+// GetChatWebhook :
+func (s *PostgresStore) GetChatWebhook(orgname string) (ChatWebhook, error) {
+	return getChatWebhook(s.db, orgname)
+}
+
+// SetChatWebhook :
+func (s *PostgresStore) SetChatWebhook(orgname string, webhook ChatWebhook) error {
+	return setChatWebhook(s.db, orgname, webhook)
+}
+
+// GetRole :
+func (s *PostgresStore) GetRole(orgname string, user string) (string, error) {
+	return getRoleFromDB(s.db, orgname, user)
+}
+
+// GetAdmins :
+func (s *PostgresStore) GetAdmins(orgname string) ([]OrganizationAdmin, error) {
+	return getAdminsFromDB(s.db, orgname)
+}
+
+// SetAdmin :
+func (s *PostgresStore) SetAdmin(orgname string, email string, role string) error {
+	return setAdminInDB(s.db, orgname, email, role)
+}
+
+// RemoveAdmin :
+func (s *PostgresStore) RemoveAdmin(orgname string, email string) error {
+	return removeAdminFromDB(s.db, orgname, email)
+}
+
+// TransferOwnership :
+func (s *PostgresStore) TransferOwnership(orgname string, email string) error {
+	return transferOwnershipInDB(s.db, orgname, email)
+}
+
+// CreateAPIKey :
+func (s *PostgresStore) CreateAPIKey(apiKey APIKey, keyHash string) (APIKey, error) {
+	return createAPIKey(s.db, apiKey, keyHash)
+}
+
+// GetAPIKeys :
+func (s *PostgresStore) GetAPIKeys(orgname string) ([]APIKey, error) {
+	return getAPIKeysFromDB(s.db, orgname)
+}
+
+// GetAPIKeyByHash :
+func (s *PostgresStore) GetAPIKeyByHash(keyHash string) (APIKey, error) {
+	return getAPIKeyByHashFromDB(s.db, keyHash)
+}
+
+// TouchAPIKey :
+func (s *PostgresStore) TouchAPIKey(apiKeyID int) error {
+	return touchAPIKey(s.db, apiKeyID)
+}
+
+// RevokeAPIKey :
+func (s *PostgresStore) RevokeAPIKey(orgname string, apiKeyID int) error {
+	return revokeAPIKey(s.db, orgname, apiKeyID)
+}
+
+// GetMembers :
+func (s *PostgresStore) GetMembers(orgname string, onlyActive bool) ([]Member, error) {
+	return GetMembersFromDB(s.db, orgname, onlyActive)
+}
+
+// InsertMember :
+func (s *PostgresStore) InsertMember(member Member) error {
+	metadataBytes, err := json.Marshal(member.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO members (organization, email, name, metadata, active) VALUES ($1, $2, $3, $4, $5)",
+		member.Organization,
+		member.Email,
+		member.Name,
+		server.JSONB(metadataBytes),
+		true,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateMember :
+func (s *PostgresStore) UpdateMember(member Member) error {
+	metadataBytes, err := json.Marshal(member.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE members SET name = $1, metadata = $2, active = $3 WHERE organization = $4 AND email = $5",
+		member.Name,
+		server.JSONB(metadataBytes),
+		true,
+		member.Organization,
+		member.Email,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeactivateMember : Members are never deleted, since pairs still reference them
+func (s *PostgresStore) DeactivateMember(orgname string, email string) error {
+	_, err := s.db.Exec(
+		"UPDATE members SET active = $1 WHERE organization = $2 AND email = $3",
+		false,
+		orgname,
+		email,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRounds :
+func (s *PostgresStore) GetRounds(orgname string, loc *time.Location) ([]RoundResponse, error) {
+	return getRoundsFromDB(s.db, orgname, loc)
+}
+
+// GetRound :
+func (s *PostgresStore) GetRound(orgname string, roundID int, loc *time.Location) (RoundResponse, error) {
+	return getRoundFromDB(s.db, orgname, roundID, loc)
+}
+
+// AddRound :
+func (s *PostgresStore) AddRound(orgname string, roundDate time.Time) error {
+	return insertRound(s.db, orgname, roundDate, false)
+}
+
+// RescheduleRound : Takes the schedule lock, since rounds made by a recurring schedule can be rescheduled
+func (s *PostgresStore) RescheduleRound(orgname string, roundDate time.Time, roundID int) error {
+	return withScheduleLock(s.db, func() error {
+		return rescheduleRound(s.db, orgname, roundDate, roundID)
+	})
+}
+
+// CancelRound : Cancelling a round made by a recurring schedule also excludes its date from the schedule
+func (s *PostgresStore) CancelRound(orgname string, roundID int) error {
+	return withScheduleLock(s.db, func() error {
+		return cancelRound(s.db, orgname, roundID, true)
+	})
+}
+
+// RollbackRound :
+func (s *PostgresStore) RollbackRound(orgname string, roundID int, newDate time.Time) ([]GetPairsResponsePair, error) {
+	return rollbackRound(s.db, orgname, roundID, newDate)
+}
+
+// GetSchedule :
+func (s *PostgresStore) GetSchedule(orgname string) (Schedule, bool, error) {
+	return getScheduleFromDB(s.db, orgname)
+}
+
+// SetSchedule : Saving & materializing the schedule is done w/ the schedule lock held, so the scheduler
+// doesn't materialize it at the same time
+func (s *PostgresStore) SetSchedule(orgname string, schedule Schedule) error {
+	return withScheduleLock(s.db, func() error {
+		err := saveScheduleInDB(s.db, orgname, schedule)
+		if err != nil {
+			return err
+		}
+
+		return materializeSchedule(s.db, orgname, schedule, time.Now())
+	})
+}
+
+// RemoveSchedule :
+func (s *PostgresStore) RemoveSchedule(orgname string) error {
+	return withScheduleLock(s.db, func() error {
+		return removeSchedule(s.db, orgname, time.Now())
+	})
+}
+
+// GetPairs :
+func (s *PostgresStore) GetPairs(orgname string, filter PairsFilter) ([]RoundPairs, error) {
+	return getPairsFromDB(s.db, orgname, filter)
+}
+
+// SaveRound :
+func (s *PostgresStore) SaveRound(orgname string, round Round, tokens map[Pair]string) error {
+	return saveRoundInDB(s.db, round, orgname, tokens)
+}
+
+// GetMissedPairs :
+func (s *PostgresStore) GetMissedPairs(orgname string) (map[string]map[string]bool, error) {
+	return getMissedPairsFromDB(s.db, orgname)
+}
+
+// FeedbackTokenExists :
+func (s *PostgresStore) FeedbackTokenExists(token string) (bool, error) {
+	return feedbackTokenExistsInDB(s.db, token)
+}
+
+// SaveFeedback :
+func (s *PostgresStore) SaveFeedback(token string, body SubmitFeedbackRequestBody) (bool, error) {
+	return saveFeedbackInDB(s.db, token, body)
+}
+
+// GetFeedbackStats :
+func (s *PostgresStore) GetFeedbackStats(orgname string) ([]FeedbackRoundStats, error) {
+	return getFeedbackStatsFromDB(s.db, orgname)
+}
+
+// GetPairHistory :
+func (s *PostgresStore) GetPairHistory(orgname string) (PairHistory, error) {
+	return getPairHistoryFromDB(s.db, orgname)
+}
+
+// GetPartners :
+func (s *PostgresStore) GetPartners(orgname string, email string) (map[string]int, error) {
+	return getPartnersFromDB(s.db, orgname, email)
+}
+
+// GetLastRoundTogether :
+func (s *PostgresStore) GetLastRoundTogether(orgname string, email1 string, email2 string) (int, error) {
+	return getLastRoundTogetherFromDB(s.db, orgname, email1, email2)
+}
+
+// RebuildHistory :
+func (s *PostgresStore) RebuildHistory(orgname string, dryRun bool) (RebuildHistoryReport, error) {
+	return rebuildHistory(s.db, orgname, dryRun)
+}
+
+// GetWebhooks :
+func (s *PostgresStore) GetWebhooks(orgname string) ([]Webhook, error) {
+	return getWebhooksFromDB(s.db, orgname)
+}
+
+// CreateWebhook :
+func (s *PostgresStore) CreateWebhook(orgname string, url string, secret string) (Webhook, error) {
+	return createWebhook(s.db, orgname, url, secret)
+}
+
+// RemoveWebhook :
+func (s *PostgresStore) RemoveWebhook(orgname string, webhookID int) error {
+	return removeWebhook(s.db, orgname, webhookID)
+}
+
+// GetWebhookDeliveries :
+func (s *PostgresStore) GetWebhookDeliveries(orgname string) ([]WebhookDelivery, error) {
+	return getWebhookDeliveriesFromDB(s.db, orgname)
+}
+
+// EmitEvent :
+func (s *PostgresStore) EmitEvent(orgname string, eventType string, data interface{}) {
+	emitEvent(s.db, orgname, eventType, data)
+}
@@ -5,7 +5,12 @@ import (
 	"net/http"
 )
 
+// getQueryParam : Parameters matched from the path by the Router take precedence over the query string
 func getQueryParam(r *http.Request, key string) (string, error) {
+	if value, ok := getPathParam(r, key); ok {
+		return value, nil
+	}
+
 	queries, ok := r.URL.Query()[key]
 	if !ok || len(queries) > 1 {
 		return "", errors.New("Request query parameters must contain " + key)
@@ -16,6 +21,11 @@ func getQueryParam(r *http.Request, key string) (string, error) {
 func getQueryParams(r *http.Request, keys []string) ([]string, error) {
 	values := []string{}
 	for _, key := range keys {
+		if value, ok := getPathParam(r, key); ok {
+			values = append(values, value)
+			continue
+		}
+
 		queries, ok := r.URL.Query()[key]
 		if !ok || len(queries) > 1 {
 			return []string{}, errors.New("Request query parameters does not contain " + key)
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnamadeo/server"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EventRoundScheduled : Emitted when a new round is added to an organization's schedule
+	EventRoundScheduled = "round.scheduled"
+	// EventRoundCancelled : Emitted when a round is cancelled before it happens
+	EventRoundCancelled = "round.cancelled"
+	// EventRoundRolledBack : Emitted when a completed round's groups are discarded
+	EventRoundRolledBack = "round.rolled_back"
+	// EventRoundCompleted : Emitted after a round's groups have been made and saved
+	EventRoundCompleted = "round.completed"
+	// EventMemberAdded : Emitted when a new member is added from a CSV upload
+	EventMemberAdded = "member.added"
+	// EventMemberDeactivated : Emitted when a member is left out of a CSV upload
+	EventMemberDeactivated = "member.deactivated"
+
+	// WebhookSignatureHeader : Header containing the hex-encoded HMAC-SHA256 of the request body
+	WebhookSignatureHeader = "X-Mealbot-Signature"
+	// WebhookEventHeader : Header containing the event type
+	WebhookEventHeader = "X-Mealbot-Event"
+	// WebhookDeliveryHeader : Header containing the delivery ID, which stays the same across retries
+	WebhookDeliveryHeader = "X-Mealbot-Delivery"
+
+	// WebhookTimeout : Max. time to wait for a webhook receiver to respond
+	WebhookTimeout = 10 * time.Second
+	// WebhookMaxAttempts : Max. no. of times a delivery is attempted before it's marked as failed
+	WebhookMaxAttempts = 8
+	// WebhookRetryBaseDelay : Delay before the first retry; doubles on every subsequent retry
+	WebhookRetryBaseDelay = 30 * time.Second
+	// WebhookPollInterval : How often the server checks for deliveries that are due
+	WebhookPollInterval = 15 * time.Second
+	// WebhookBatchSize : Max. no. of deliveries attempted per poll
+	WebhookBatchSize = 50
+	// WebhookClaimDuration : How long deliveries claimed by a worker are left alone by other workers. Longer
+	// than a batch can take (WebhookBatchSize * WebhookTimeout)
+	WebhookClaimDuration = 15 * time.Minute
+	// WebhookDeliveryLogLimit : Max. no. of deliveries returned by the delivery log
+	WebhookDeliveryLogLimit = 100
+
+	// DeliveryStatusPending : Delivery hasn't succeeded yet but will be retried
+	DeliveryStatusPending = "pending"
+	// DeliveryStatusDelivered : Receiver responded w/ a 2xx status
+	DeliveryStatusDelivered = "delivered"
+	// DeliveryStatusFailed : Delivery gave up after WebhookMaxAttempts
+	DeliveryStatusFailed = "failed"
+)
+
+// Webhook : An endpoint an organization registered to receive events
+type Webhook struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// Event : Envelope for every event POSTed to a webhook
+type Event struct {
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Organization string      `json:"organization"`
+	CreatedAt    string      `json:"createdAt"`
+	Data         interface{} `json:"data"`
+}
+
+// RoundEventData : Data for round.* events
+type RoundEventData struct {
+	Round  int        `json:"round"`
+	Date   string     `json:"date,omitempty"`
+	Groups [][]string `json:"groups,omitempty"`
+}
+
+// MemberEventData : Data for member.* events
+type MemberEventData struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// WebhookDelivery : One attempt (or series of retries) at POSTing an event to a webhook
+type WebhookDelivery struct {
+	ID             int    `json:"id"`
+	WebhookID      int    `json:"webhookId"`
+	EventType      string `json:"eventType"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	ResponseStatus int    `json:"responseStatus,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	LastAttemptAt  string `json:"lastAttemptAt,omitempty"`
+}
+
+// CreateWebhookRequestBody :
+type CreateWebhookRequestBody struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// GetWebhooksResponse :
+type GetWebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// GetWebhookDeliveriesResponse :
+type GetWebhookDeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// ErrWebhookNotFound : The organization doesn't have a webhook w/ the requested ID
+var ErrWebhookNotFound = errors.New("Webhook does not exist")
+
+var webhookClient = &http.Client{Timeout: WebhookTimeout}
+
+// WebhooksHandler : Combined HTTP handler for listing, registering and removing webhooks
+func (app *App) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		app.GetWebhooksHandler(w, r)
+	} else if r.Method == "POST" {
+		app.CreateWebhookHandler(w, r)
+	} else if r.Method == "DELETE" {
+		app.RemoveWebhookHandler(w, r)
+	} else {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET, POST and DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			"WebhooksHandler",
+		)
+	}
+}
+
+// GetWebhooksHandler : HTTP handler for listing an organization's webhooks. Secrets are never returned
+func (app *App) GetWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetWebhooksHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	webhooks, err := app.Store.GetWebhooks(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, GetWebhooksResponse{Webhooks: webhooks}, http.StatusOK, function)
+}
+
+// CreateWebhookHandler : HTTP handler for registering a new webhook
+func (app *App) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	function := "CreateWebhookHandler"
+	if r.Method != "POST" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only POST requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+	defer r.Body.Close()
+
+	var body CreateWebhookRequestBody
+	err = json.Unmarshal(bytes, &body)
+	if err != nil {
+		LogAndWriteErr(w, errors.New("Request body is malformed"), http.StatusBadRequest, function)
+		return
+	}
+
+	if !strings.HasPrefix(body.URL, "http://") && !strings.HasPrefix(body.URL, "https://") {
+		LogAndWriteStatusBadRequest(w, errors.New("Webhook URL must start with http:// or https://"), function)
+		return
+	}
+	if body.Secret == "" {
+		LogAndWriteStatusBadRequest(w, errors.New("Webhook secret cannot be an empty string"), function)
+		return
+	}
+
+	webhook, err := app.Store.CreateWebhook(orgname, body.URL, body.Secret)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, webhook, http.StatusCreated, function)
+}
+
+// RemoveWebhookHandler : HTTP handler for removing a webhook along w/ its pending deliveries
+func (app *App) RemoveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	function := "RemoveWebhookHandler"
+	if r.Method != "DELETE" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only DELETE requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	values, err := getQueryParams(r, []string{"org", "id"})
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	orgname := values[0]
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+	webhookID, err := strconv.Atoi(values[1])
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	err = app.Store.RemoveWebhook(orgname, webhookID)
+	if err == ErrWebhookNotFound {
+		LogAndWriteErr(w, err, http.StatusNotFound, function)
+		return
+	}
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWriteMessage(
+		w,
+		"Successfully removed webhook",
+		http.StatusOK,
+		function,
+	)
+}
+
+// GetWebhookDeliveriesHandler : HTTP handler for the most recent webhook deliveries of an organization
+func (app *App) GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	function := "GetWebhookDeliveriesHandler"
+	if r.Method != "GET" {
+		LogAndWriteErr(
+			w,
+			errors.New("Only GET requests are allowed at this route"),
+			http.StatusMethodNotAllowed,
+			function,
+		)
+		return
+	}
+
+	orgname, err := getQueryParam(r, "org")
+	if err != nil {
+		LogAndWriteStatusBadRequest(w, err, function)
+		return
+	}
+
+	if !app.authorizeOrganization(w, r, orgname, RoleAdmin, function) {
+		return
+	}
+
+	deliveries, err := app.Store.GetWebhookDeliveries(orgname)
+	if err != nil {
+		LogAndWriteStatusInternalServerError(w, err, function)
+		return
+	}
+
+	LogAndWrite(w, GetWebhookDeliveriesResponse{Deliveries: deliveries}, http.StatusOK, function)
+}
+
+// emitEvent : Queue an event for delivery to every webhook registered by the organization. Failing to
+// queue an event is logged rather than returned, so that webhooks never block pairing or member updates
+func emitEvent(db *sql.DB, orgname string, eventType string, data interface{}) {
+	err := queueEvent(db, orgname, eventType, data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"logger":       "logrus",
+			"organization": orgname,
+			"event":        eventType,
+		}).Error(err)
+	}
+}
+
+func queueEvent(db *sql.DB, orgname string, eventType string, data interface{}) error {
+	eventID, err := newEventID()
+	if err != nil {
+		return err
+	}
+
+	event := Event{
+		ID:           eventID,
+		Type:         eventType,
+		Organization: orgname,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+		Data:         data,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, attempts, next_attempt_at, created_at)
+		SELECT id, $1, $2, $3, 0, now() AT TIME ZONE 'utc', now() AT TIME ZONE 'utc' FROM webhooks WHERE organization = $4`,
+		eventType,
+		server.JSONB(payload),
+		DeliveryStatusPending,
+		orgname,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func newEventID() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// roundEventGroups : List the emails in each group of the round, for round.completed events
+func roundEventGroups(round Round) [][]string {
+	groups := [][]string{}
+	for _, pair := range round.DrawOrderedPairs {
+		group := []string{pair.ID1, pair.ID2}
+		if pair.ExtraID != "" {
+			group = append(group, pair.ExtraID)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// signWebhookPayload : Hex-encoded HMAC-SHA256 of the payload, keyed w/ the webhook's shared secret
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhookEvent : POST a signed payload to a webhook; returns the response status, if any
+func postWebhookEvent(url string, secret string, deliveryID int, eventType string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signWebhookPayload(secret, payload))
+	req.Header.Set(WebhookEventHeader, eventType)
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(deliveryID))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// webhookRetryDelay : Exponential backoff between attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	return WebhookRetryBaseDelay * time.Duration(1<<uint(attempts-1))
+}
+
+// runWebhookDeliveryWorker : Deliver queued events every WebhookPollInterval, forever
+func runWebhookDeliveryWorker(db *sql.DB) {
+	for {
+		err := deliverPendingWebhooks(db)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"logger":   "logrus",
+				"function": "runWebhookDeliveryWorker",
+			}).Error(err)
+		}
+
+		time.Sleep(WebhookPollInterval)
+	}
+}
+
+// pendingDelivery : A delivery claimed by deliverPendingWebhooks, along w/ the result of attempting it
+type pendingDelivery struct {
+	id        int
+	eventType string
+	payload   server.JSONB
+	attempts  int
+	url       string
+	secret    string
+
+	responseStatus int
+	err            error
+}
+
+// deliverPendingWebhooks : Attempt every delivery that is due. Deliveries are claimed first, so that several
+// server instances can run the worker w/o delivering an event twice, and no transaction is open while waiting
+// on receivers
+func deliverPendingWebhooks(db *sql.DB) error {
+	pending, err := claimPendingDeliveries(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	for i := range pending {
+		delivery := &pending[i]
+		delivery.responseStatus, delivery.err = postWebhookEvent(
+			delivery.url,
+			delivery.secret,
+			delivery.id,
+			delivery.eventType,
+			delivery.payload,
+		)
+	}
+
+	return recordDeliveryAttempts(db, pending)
+}
+
+// claimPendingDeliveries : Deliveries that are due, pushed back by WebhookClaimDuration so that no other worker
+// picks them up in the meantime. If this worker dies before recording the attempts, they're retried after that
+func claimPendingDeliveries(db *sql.DB) ([]pendingDelivery, error) {
+	rows, err := db.Query(
+		`UPDATE webhook_deliveries d SET next_attempt_at = now() AT TIME ZONE 'utc' + $3::integer * interval '1 second'
+		FROM webhooks w
+		WHERE d.webhook_id = w.id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $1 AND next_attempt_at <= now() AT TIME ZONE 'utc'
+			ORDER BY id ASC LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event_type, d.payload, d.attempts, w.url, w.secret`,
+		DeliveryStatusPending,
+		WebhookBatchSize,
+		int(WebhookClaimDuration.Seconds()),
+	)
+	if err != nil {
+		return []pendingDelivery{}, err
+	}
+	defer rows.Close()
+
+	pending := []pendingDelivery{}
+	for rows.Next() {
+		var delivery pendingDelivery
+		err := rows.Scan(
+			&delivery.id,
+			&delivery.eventType,
+			&delivery.payload,
+			&delivery.attempts,
+			&delivery.url,
+			&delivery.secret,
+		)
+		if err != nil {
+			return []pendingDelivery{}, err
+		}
+
+		pending = append(pending, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return []pendingDelivery{}, err
+	}
+
+	// events are delivered in the order they happened
+	sort.Slice(pending, func(i, j int) bool { return pending[i].id < pending[j].id })
+	return pending, nil
+}
+
+// recordDeliveryAttempts : Save the result of each attempt, and when to retry the ones that failed
+func recordDeliveryAttempts(db *sql.DB, attempted []pendingDelivery) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, delivery := range attempted {
+		attempts := delivery.attempts + 1
+
+		status := DeliveryStatusDelivered
+		lastError := sql.NullString{}
+		if delivery.err != nil {
+			status = DeliveryStatusPending
+			if attempts >= WebhookMaxAttempts {
+				status = DeliveryStatusFailed
+			}
+			lastError = sql.NullString{String: delivery.err.Error(), Valid: true}
+		}
+
+		_, err = tx.Exec(
+			`UPDATE webhook_deliveries SET status = $1, attempts = $2, response_status = $3, last_error = $4,
+			last_attempt_at = now() AT TIME ZONE 'utc', next_attempt_at = now() AT TIME ZONE 'utc' + $5::integer * interval '1 second'
+			WHERE id = $6`,
+			status,
+			attempts,
+			sql.NullInt64{Int64: int64(delivery.responseStatus), Valid: delivery.responseStatus != 0},
+			lastError,
+			int(webhookRetryDelay(attempts).Seconds()),
+			delivery.id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func getWebhooksFromDB(db *sql.DB, orgname string) ([]Webhook, error) {
+	rows, err := db.Query(
+		"SELECT id, url, to_char(created_at, $1) FROM webhooks WHERE organization = $2 ORDER BY id ASC",
+		TimestampFormat,
+		orgname,
+	)
+	if err != nil {
+		return []Webhook{}, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.CreatedAt)
+		if err != nil {
+			return []Webhook{}, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+func createWebhook(db *sql.DB, orgname string, url string, secret string) (Webhook, error) {
+	webhook := Webhook{URL: url}
+	err := db.QueryRow(
+		`INSERT INTO webhooks (organization, url, secret, created_at) VALUES ($1, $2, $3, now() AT TIME ZONE 'utc')
+		RETURNING id, to_char(created_at, $4)`,
+		orgname,
+		url,
+		secret,
+		TimestampFormat,
+	).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+func removeWebhook(db *sql.DB, orgname string, webhookID int) error {
+	result, err := db.Exec(
+		"DELETE FROM webhooks WHERE organization = $1 AND id = $2",
+		orgname,
+		webhookID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if numRows, _ := result.RowsAffected(); numRows == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+func getWebhookDeliveriesFromDB(db *sql.DB, orgname string) ([]WebhookDelivery, error) {
+	rows, err := db.Query(
+		`SELECT d.id, d.webhook_id, d.event_type, d.status, d.attempts, d.response_status, d.last_error,
+		to_char(d.created_at, $1), to_char(d.last_attempt_at, $1)
+		FROM webhook_deliveries d JOIN webhooks w ON d.webhook_id = w.id
+		WHERE w.organization = $2 ORDER BY d.id DESC LIMIT $3`,
+		TimestampFormat,
+		orgname,
+		WebhookDeliveryLogLimit,
+	)
+	if err != nil {
+		return []WebhookDelivery{}, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var responseStatus sql.NullInt64
+		var lastError, lastAttemptAt sql.NullString
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventType,
+			&delivery.Status,
+			&delivery.Attempts,
+			&responseStatus,
+			&lastError,
+			&delivery.CreatedAt,
+			&lastAttemptAt,
+		)
+		if err != nil {
+			return []WebhookDelivery{}, err
+		}
+
+		delivery.ResponseStatus = int(responseStatus.Int64)
+		delivery.LastError = lastError.String
+		delivery.LastAttemptAt = lastAttemptAt.String
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
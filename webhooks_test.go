@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostWebhookEventSignature(t *testing.T) {
+	t.Log("Test that webhook payloads are signed w/ the shared secret")
+
+	secret := "shhh"
+	payload := []byte(`{"type":"round.completed"}`)
+
+	var signature, eventType, body string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(WebhookSignatureHeader)
+		eventType = r.Header.Get(WebhookEventHeader)
+		bytes, _ := ioutil.ReadAll(r.Body)
+		body = string(bytes)
+	}))
+	defer receiver.Close()
+
+	status, err := postWebhookEvent(receiver.URL, secret, 1, EventRoundCompleted, payload)
+	if err != nil {
+		t.Error(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("expected status 200, got %d", status)
+	}
+
+	if body != string(payload) {
+		t.Errorf("expected body %s, got %s", payload, body)
+	}
+	if eventType != EventRoundCompleted {
+		t.Errorf("expected event type %s, got %s", EventRoundCompleted, eventType)
+	}
+	if signature != signWebhookPayload(secret, payload) {
+		t.Errorf("signature %s doesn't match payload", signature)
+	}
+	if signature == signWebhookPayload("wrong secret", payload) {
+		t.Error("signature should depend on the secret")
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	t.Log("Test that the delay between webhook retries doubles")
+
+	for attempts := 1; attempts < WebhookMaxAttempts; attempts++ {
+		if webhookRetryDelay(attempts+1) != 2*webhookRetryDelay(attempts) {
+			t.Errorf("delay after attempt %d isn't double the previous delay", attempts+1)
+		}
+	}
+}